@@ -0,0 +1,45 @@
+package alarm
+
+import (
+	"encoding/json"
+
+	"github.com/dh1tw/gorigctl/comms"
+)
+
+// Ack is sent by an operator to acknowledge a protection alarm
+// (e.g. high SWR). The server refuses to key the transmitter again
+// until the alarm has been acknowledged.
+type Ack struct {
+	UserID string `json:"user_id"`
+}
+
+// Marshal encodes the acknowledgement for the wire
+func (a *Ack) Marshal() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// Unmarshal decodes an acknowledgement received from the wire
+func (a *Ack) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, a)
+}
+
+// SendAck publishes an acknowledgement on the given topic
+func SendAck(toWireCh chan comms.IOMsg, topic, userID string) error {
+
+	a := Ack{
+		UserID: userID,
+	}
+
+	data, err := a.Marshal()
+	if err != nil {
+		return err
+	}
+
+	msg := comms.IOMsg{}
+	msg.Data = data
+	msg.Topic = topic
+
+	toWireCh <- msg
+
+	return nil
+}
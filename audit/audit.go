@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ResultOK is the result of a request which has been executed successfully
+const ResultOK = "ok"
+
+// Entry is a single record of the audit trail. Each entry is written
+// as one line of JSON.
+type Entry struct {
+	Time     time.Time   `json:"time"`
+	UserID   string      `json:"user_id"`
+	Field    string      `json:"field"`
+	OldValue interface{} `json:"old_value,omitempty"`
+	NewValue interface{} `json:"new_value,omitempty"`
+	Result   string      `json:"result"`
+}
+
+// Result returns the audit result of an executed request
+func Result(err error) string {
+	if err == nil {
+		return ResultOK
+	}
+	return "error: " + err.Error()
+}
+
+// Denied returns the audit result of a request which has been rejected
+func Denied(err error) string {
+	return "denied: " + err.Error()
+}
+
+// Logger writes the audit trail to a file. Once the file exceeds MaxSize
+// bytes, it is rotated and up to MaxBackups old files are kept
+// (<path>.1 being the most recent one). A nil Logger discards all entries.
+type Logger struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewLogger opens (or creates) the audit file at path.
+func NewLogger(path string, maxSize int64, maxBackups int) (*Logger, error) {
+
+	l := &Logger{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Log appends an entry to the audit trail. If the entry's time
+// is not set, the current time is used.
+func (l *Logger) Log(e Entry) error {
+
+	if l == nil {
+		return nil
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	var rotateErr error
+	if l.maxSize > 0 && l.size+int64(len(data)) > l.maxSize && l.size > 0 {
+		rotateErr = l.rotate()
+		if l.file == nil {
+			return rotateErr
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return rotateErr
+}
+
+// Close closes the audit file
+func (l *Logger) Close() error {
+
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	return l.file.Close()
+}
+
+func (l *Logger) open() error {
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+
+	return nil
+}
+
+// rotate shifts <path> => <path>.1 => <path>.2 ... and discards the
+// oldest file. If the file can't be rotated, <path> is reopened so
+// that the entries are still written; the error is returned anyway.
+// l.file is nil only if <path> couldn't be reopened.
+func (l *Logger) rotate() error {
+
+	err := l.file.Close()
+	l.file = nil
+
+	if err == nil {
+		if l.maxBackups > 0 {
+			os.Remove(backupName(l.path, l.maxBackups))
+			for i := l.maxBackups - 1; i > 0; i-- {
+				os.Rename(backupName(l.path, i), backupName(l.path, i+1))
+			}
+			err = os.Rename(l.path, backupName(l.path, 1))
+		} else {
+			err = os.Remove(l.path)
+		}
+	}
+
+	if openErr := l.open(); openErr != nil {
+		return openErr
+	}
+
+	return err
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
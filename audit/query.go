@@ -0,0 +1,85 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// Filter selects entries from the audit trail. Empty fields match
+// all entries.
+type Filter struct {
+	UserID string
+	// Field matches the field itself and all its sub fields
+	// (e.g. "level" matches "level.RFPOWER")
+	Field string
+	From  time.Time
+	To    time.Time
+}
+
+// Match returns true if the entry passes the filter
+func (f *Filter) Match(e *Entry) bool {
+
+	if f.UserID != "" && !strings.EqualFold(f.UserID, e.UserID) {
+		return false
+	}
+
+	if f.Field != "" && !strings.EqualFold(f.Field, e.Field) &&
+		!strings.HasPrefix(strings.ToLower(e.Field), strings.ToLower(f.Field)+".") {
+		return false
+	}
+
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && e.Time.After(f.To) {
+		return false
+	}
+
+	return true
+}
+
+// Query reads the audit file at path including its rotated backups and
+// returns all matching entries, the oldest entry first. Lines which
+// can not be decoded are skipped.
+func Query(path string, maxBackups int, filter Filter) ([]Entry, error) {
+
+	files := []string{}
+	for i := maxBackups; i > 0; i-- {
+		files = append(files, backupName(path, i))
+	}
+	files = append(files, path)
+
+	entries := []Entry{}
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			e := Entry{}
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if filter.Match(&e) {
+				entries = append(entries, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,104 @@
+package bandplan
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Band describes a frequency segment in which transmitting is allowed.
+// Frequencies are in Hz. An empty Modes or Licenses list permits any mode
+// or license class respectively.
+type Band struct {
+	Name     string   `mapstructure:"name"`
+	Lower    float64  `mapstructure:"lower"`
+	Upper    float64  `mapstructure:"upper"`
+	Modes    []string `mapstructure:"modes"`
+	Licenses []string `mapstructure:"licenses"`
+}
+
+// Contains returns true if the frequency is within the band edges
+func (b *Band) Contains(freq float64) bool {
+	return freq >= b.Lower && freq <= b.Upper
+}
+
+// Guard checks if a user is allowed to transmit on a given frequency
+// and mode according to the band plan and the user's license class.
+type Guard struct {
+	Bands          []Band
+	Licenses       map[string]string // userID => license class
+	DefaultLicense string
+}
+
+// NewGuard returns a Guard for the given band plan.
+func NewGuard(bands []Band, licenses map[string]string, defaultLicense string) (*Guard, error) {
+
+	for _, b := range bands {
+		if b.Lower > b.Upper {
+			return nil, fmt.Errorf("band %s: lower edge above upper edge", b.Name)
+		}
+	}
+
+	g := &Guard{
+		Bands:          bands,
+		Licenses:       make(map[string]string),
+		DefaultLicense: defaultLicense,
+	}
+
+	// user IDs are matched case insensitive since the config keys
+	// are lower case anyway
+	for user, class := range licenses {
+		g.Licenses[strings.ToLower(user)] = class
+	}
+
+	return g, nil
+}
+
+// License returns the license class of a user
+func (g *Guard) License(userID string) string {
+	if class, ok := g.Licenses[strings.ToLower(userID)]; ok {
+		return class
+	}
+	return g.DefaultLicense
+}
+
+// CheckTx returns an error if the user is not permitted to transmit on
+// the frequency [Hz] with the given mode.
+func (g *Guard) CheckTx(userID string, freq float64, mode string) error {
+
+	class := g.License(userID)
+
+	var reason error
+
+	for _, b := range g.Bands {
+		if !b.Contains(freq) {
+			continue
+		}
+
+		if len(b.Modes) > 0 && !containsFold(b.Modes, mode) {
+			reason = fmt.Errorf("mode %s not permitted in %s segment", mode, b.Name)
+			continue
+		}
+
+		if len(b.Licenses) > 0 && !containsFold(b.Licenses, class) {
+			reason = fmt.Errorf("license class '%s' not permitted to transmit in %s segment", class, b.Name)
+			continue
+		}
+
+		return nil
+	}
+
+	if reason != nil {
+		return reason
+	}
+
+	return fmt.Errorf("%.0f Hz is outside of the licensed allocations", freq)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, el := range list {
+		if strings.EqualFold(el, s) {
+			return true
+		}
+	}
+	return false
+}
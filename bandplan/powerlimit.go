@@ -0,0 +1,76 @@
+package bandplan
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PowerLimit is the maximum RFPOWER level (0...1) which may be applied
+// within a frequency segment. Frequencies are in Hz.
+type PowerLimit struct {
+	Name    string  `mapstructure:"name"`
+	Lower   float64 `mapstructure:"lower"`
+	Upper   float64 `mapstructure:"upper"`
+	RfPower float32 `mapstructure:"rfpower"`
+}
+
+// Contains returns true if the frequency is within the segment edges
+func (p *PowerLimit) Contains(freq float64) bool {
+	return freq >= p.Lower && freq <= p.Upper
+}
+
+// PowerLimits is a table of per band power limits
+type PowerLimits []PowerLimit
+
+// NewPowerLimits validates the power limit table
+func NewPowerLimits(limits []PowerLimit) (PowerLimits, error) {
+
+	for _, l := range limits {
+		if l.Lower > l.Upper {
+			return nil, fmt.Errorf("power limit %s: lower edge above upper edge", l.Name)
+		}
+		if l.RfPower < 0 || l.RfPower > 1 {
+			return nil, fmt.Errorf("power limit %s: rfpower must be between 0 and 1", l.Name)
+		}
+	}
+
+	return PowerLimits(limits), nil
+}
+
+// Lookup returns the power limit which applies to the frequency [Hz].
+// If several segments overlap, the most restrictive limit wins.
+func (pl PowerLimits) Lookup(freq float64) (PowerLimit, bool) {
+
+	found := false
+	limit := PowerLimit{}
+
+	for _, l := range pl {
+		if !l.Contains(freq) {
+			continue
+		}
+		if !found || l.RfPower < limit.RfPower {
+			limit = l
+			found = true
+		}
+	}
+
+	return limit, found
+}
+
+// ActivePowerLimit is published by the server whenever the power limit
+// for the current transmit frequency changes.
+type ActivePowerLimit struct {
+	Active  bool    `json:"active"`
+	Band    string  `json:"band"`
+	RfPower float32 `json:"rfpower"`
+}
+
+// Marshal encodes the active power limit for the wire
+func (a *ActivePowerLimit) Marshal() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// Unmarshal decodes an active power limit received from the wire
+func (a *ActivePowerLimit) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, a)
+}
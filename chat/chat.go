@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dh1tw/gorigctl/comms"
+)
+
+// DefaultHistory is the default number of messages which are kept
+// (retained) on the broker for clients which join later
+const DefaultHistory = 20
+
+// Message is a chat message between the operators of a station.
+// Messages are published (retained) on <station>/chat/<user>/<slot>,
+// where slot is the sender's sequence number modulo the size of the
+// history. This way the broker keeps the last messages of each
+// operator for newly joining clients, and operators who talk at the
+// same time don't overwrite each other's messages.
+type Message struct {
+	Seq       uint64 `json:"seq"`
+	UserID    string `json:"user_id"`
+	Text      string `json:"text"`
+	Timestamp int64  `json:"timestamp"` // [ms]
+}
+
+// Marshal encodes the chat message for the wire
+func (m *Message) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Unmarshal decodes a chat message received from the wire
+func (m *Message) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, m)
+}
+
+// Time returns the time when the message has been sent
+func (m *Message) Time() time.Time {
+	return time.Unix(0, m.Timestamp*int64(time.Millisecond))
+}
+
+// String formats the message for printing
+func (m Message) String() string {
+	return m.Time().Local().Format("15:04:05") + " " + m.UserID + ": " + m.Text
+}
+
+// Topic returns the chat topic of a station
+func Topic(station string) string {
+	return station + "/chat"
+}
+
+// Chat keeps the history of the chat of a station
+type Chat struct {
+	topic    string
+	userID   string
+	history  int
+	toWireCh chan comms.IOMsg
+	messages []Message
+	lastSeq  uint64
+}
+
+// NewChat returns the chat of a station
+func NewChat(station, userID string, history int, toWireCh chan comms.IOMsg) *Chat {
+
+	if history <= 0 {
+		history = DefaultHistory
+	}
+
+	c := &Chat{
+		topic:    Topic(station),
+		userID:   userID,
+		history:  history,
+		toWireCh: toWireCh,
+	}
+
+	return c
+}
+
+// SubscriptionTopic is the topic which has to be subscribed to
+// receive the chat messages
+func (c *Chat) SubscriptionTopic() string {
+	return c.topic + "/+/+"
+}
+
+// Say sends a message. The message is added to the history once it
+// has been received from the broker.
+func (c *Chat) Say(text string) error {
+
+	if len(text) == 0 {
+		return errors.New("empty message")
+	}
+
+	msg := Message{
+		Seq:       c.lastSeq + 1,
+		UserID:    c.userID,
+		Text:      text,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+
+	// the next message must not reuse the slot, even if this one
+	// hasn't been received from the broker yet
+	c.lastSeq = msg.Seq
+	slot := msg.Seq % uint64(c.history)
+
+	c.toWireCh <- comms.IOMsg{
+		Topic:  c.topic + "/" + c.userID + "/" + strconv.FormatUint(slot, 10),
+		Data:   data,
+		Retain: true,
+	}
+
+	return nil
+}
+
+// Deserialize adds a received message to the history. It returns
+// false if the message is already known.
+func (c *Chat) Deserialize(data []byte) (Message, bool, error) {
+
+	msg := Message{}
+
+	// an empty message clears a slot
+	if len(data) == 0 {
+		return msg, false, nil
+	}
+
+	if err := msg.Unmarshal(data); err != nil {
+		return msg, false, err
+	}
+
+	for _, m := range c.messages {
+		if m.Seq == msg.Seq && m.UserID == msg.UserID && m.Timestamp == msg.Timestamp {
+			return msg, false, nil
+		}
+	}
+
+	if msg.Seq > c.lastSeq {
+		c.lastSeq = msg.Seq
+	}
+
+	c.messages = append(c.messages, msg)
+	sort.Slice(c.messages, func(i, j int) bool {
+		return c.messages[i].Timestamp < c.messages[j].Timestamp
+	})
+	if len(c.messages) > c.history {
+		c.messages = c.messages[len(c.messages)-c.history:]
+	}
+
+	return msg, true, nil
+}
+
+// Messages returns the history, sorted by time
+func (c *Chat) Messages() []Message {
+	return c.messages
+}
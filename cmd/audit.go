@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dh1tw/gorigctl/audit"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show the audit trail of the commands executed by the server",
+	Long: `Show the audit trail of the commands executed by the server
+
+The audit trail is read from the file written by the server (--audit-file),
+including its rotated backups. The entries can be filtered by user, field
+and time range. Times are in local time and can be specified as
+"2006-01-02", "2006-01-02 15:04" or in RFC3339 format. A date without
+a time includes the whole day, so "--from 2017-03-01 --to 2017-03-01"
+shows all entries of March 1st.
+
+Example:
+gorigctl audit --user dh1tw-gui --field frequency --since 2h
+`,
+	Run: showAudit,
+}
+
+func init() {
+	RootCmd.AddCommand(auditCmd)
+	auditCmd.Flags().String("audit-file", "", "Audit file written by the server")
+	auditCmd.Flags().Int("audit-max-backups", 5, "Number of rotated audit files to search")
+	auditCmd.Flags().String("user", "", "Only show entries of this user ID")
+	auditCmd.Flags().String("field", "", "Only show entries of this field (e.g. frequency, ptt, level)")
+	auditCmd.Flags().String("from", "", "Only show entries after this time")
+	auditCmd.Flags().String("to", "", "Only show entries up to this time (a date includes the whole day)")
+	auditCmd.Flags().Duration("since", 0, "Only show entries of the last duration (e.g. 30m)")
+}
+
+func showAudit(cmd *cobra.Command, args []string) {
+
+	// If a config file is found, read it in.
+	if err := viper.ReadInConfig(); err == nil {
+		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	}
+
+	viper.BindPFlag("audit.file", cmd.Flags().Lookup("audit-file"))
+	viper.BindPFlag("audit.max-backups", cmd.Flags().Lookup("audit-max-backups"))
+
+	auditFile := viper.GetString("audit.file")
+	if auditFile == "" {
+		fmt.Println("no audit file specified (--audit-file)")
+		os.Exit(-1)
+	}
+
+	filter := audit.Filter{}
+	filter.UserID, _ = cmd.Flags().GetString("user")
+	filter.Field, _ = cmd.Flags().GetString("field")
+
+	var err error
+
+	from, _ := cmd.Flags().GetString("from")
+	if filter.From, err = parseAuditTime(from, false); err != nil {
+		fmt.Println("invalid --from time:", err)
+		os.Exit(-1)
+	}
+
+	to, _ := cmd.Flags().GetString("to")
+	if filter.To, err = parseAuditTime(to, true); err != nil {
+		fmt.Println("invalid --to time:", err)
+		os.Exit(-1)
+	}
+
+	if since, _ := cmd.Flags().GetDuration("since"); since > 0 {
+		filter.From = time.Now().Add(-since)
+	}
+
+	entries, err := audit.Query(auditFile, viper.GetInt("audit.max-backups"), filter)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Time", "User", "Field", "Old Value", "New Value", "Result"})
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+
+	for _, e := range entries {
+		table.Append([]string{
+			e.Time.Local().Format("2006-01-02 15:04:05"),
+			e.UserID,
+			e.Field,
+			formatAuditValue(e.OldValue),
+			formatAuditValue(e.NewValue),
+			e.Result,
+		})
+	}
+
+	table.Render()
+	fmt.Printf("%d entries\n", len(entries))
+}
+
+// parseAuditTime parses the time of the --from and --to flags. For
+// a date without a time, the start of the day is returned, or its end
+// if endOfDay is set.
+func parseAuditTime(s string, endOfDay bool) (time.Time, error) {
+
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil || !endOfDay {
+		return t, err
+	}
+
+	return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
+func formatAuditValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
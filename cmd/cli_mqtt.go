@@ -10,10 +10,15 @@ import (
 	"time"
 
 	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/chat"
 	"github.com/dh1tw/gorigctl/cli"
 	"github.com/dh1tw/gorigctl/comms"
 	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/presence"
 	"github.com/dh1tw/gorigctl/remoteradio"
+	"github.com/dh1tw/gorigctl/serverstatus"
+	"github.com/dh1tw/gorigctl/station"
 	"github.com/dh1tw/gorigctl/utils"
 	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
@@ -45,12 +50,14 @@ func init() {
 	clientMqttCmd.Flags().StringP("client-id", "C", "gorigctl-cli", "MQTT ClientID")
 	clientMqttCmd.Flags().StringP("station", "X", "mystation", "remote station callsign")
 	clientMqttCmd.Flags().StringP("radio", "Y", "myradio", "Radio ID")
+	clientMqttCmd.Flags().Int("rate-limit", 10, "Max. requests per second for frequency, RIT/XIT and level changes (0 = unlimited)")
 }
 
 type remoteCli struct {
 	cliCmds       []cli.CliCmd
 	remoteCliCmds []remoteradio.RemoteCliCmd
 	radio         remoteradio.RemoteRadio
+	chat          *chat.Chat
 }
 
 func mqttCliClient(cmd *cobra.Command, args []string) {
@@ -68,6 +75,7 @@ func mqttCliClient(cmd *cobra.Command, args []string) {
 	viper.BindPFlag("mqtt.username", cmd.Flags().Lookup("username"))
 	viper.BindPFlag("mqtt.password", cmd.Flags().Lookup("password"))
 	viper.BindPFlag("mqtt.client-id", cmd.Flags().Lookup("client-id"))
+	viper.BindPFlag("mqtt.rate-limit", cmd.Flags().Lookup("rate-limit"))
 
 	mqttBrokerURL := viper.GetString("mqtt.broker-url")
 	mqttBrokerPort := viper.GetInt("mqtt.broker-port")
@@ -85,19 +93,42 @@ func mqttCliClient(cmd *cobra.Command, args []string) {
 
 	serverCatRequestTopic := baseTopic + "/setstate"
 	serverStatusTopic := baseTopic + "/status"
+	serverPingTopic := baseTopic + "/ping"
 
 	// tx topics
-	serverCatResponseTopic := baseTopic + "/state"
+	serverStateDeltaTopic := baseTopic + "/statedelta"
+	serverStateReqTopic := baseTopic + "/statereq"
 	serverCapsTopic := baseTopic + "/caps"
 	serverCapsReqTopic := baseTopic + "/capsreq"
+	serverRigStatusTopic := baseTopic + "/rigstatus"
+	serverPongTopic := baseTopic + "/pong"
+	presenceTopic := presence.Topic(baseTopic, mqttClientID)
+
+	me := presence.Presence{
+		UserID:     mqttClientID,
+		ClientType: presence.ClientCli,
+		Version:    version,
+		Since:      time.Now().UnixNano() / int64(time.Millisecond),
+	}
 
-	mqttRxTopics := []string{serverCatResponseTopic, serverCapsTopic, serverStatusTopic}
+	mqttRxTopics := []string{serverStateDeltaTopic, serverCapsTopic, serverStatusTopic, serverRigStatusTopic, serverPongTopic,
+		serverstatus.Topic(baseTopic), ping.ClientPingTopic(baseTopic, mqttClientID)}
 
 	toWireCh := make(chan comms.IOMsg, 20)
-	toDeserializeCatResponseCh := make(chan []byte, 10)
+	toDeserializeStateDeltaCh := make(chan []byte, 10)
 	toDeserializePingResponseCh := make(chan []byte, 10)
 	toDeserializeCapsCh := make(chan []byte, 5)
 	toDeserializeStatusCh := make(chan []byte, 5)
+	toDeserializeServerStatusCh := make(chan []byte, 5)
+	toDeserializeStationCh := make(chan []byte, 5)
+	toDeserializeRigStatusCh := make(chan []byte, 5)
+	toDeserializeChatCh := make(chan []byte, 20)
+	toDeserializeClientPingCh := make(chan []byte, 10)
+
+	stationChat := chat.NewChat(viper.GetString("mqtt.station"), mqttClientID,
+		viper.GetInt("chat.history"), toWireCh)
+	mqttRxTopics = append(mqttRxTopics, stationChat.SubscriptionTopic(),
+		station.Topic(viper.GetString("mqtt.station")))
 
 	// Event PubSub
 	evPS := pubsub.New(1)
@@ -105,9 +136,34 @@ func mqttCliClient(cmd *cobra.Command, args []string) {
 	// WaitGroup to coordinate a graceful shutdown
 	var wg sync.WaitGroup
 
+	pingSettings := ping.Settings{
+		ToWireCh:   toWireCh,
+		PingTopic:  serverPingTopic,
+		PongCh:     toDeserializePingResponseCh,
+		UserID:     mqttClientID,
+		WaitGroup:  &wg,
+		Events:     evPS,
+		Thresholds: pingThresholds(),
+	}
+
+	// the server measures our latency, too
+	echoSettings := ping.Settings{
+		ToWireCh:  toWireCh,
+		PongTopic: ping.ClientPongTopic(baseTopic),
+		PongCh:    toDeserializeClientPingCh,
+		WaitGroup: &wg,
+		Events:    evPS,
+	}
+
 	// logger := utils.NewChLogger(evPS, events.AppLog, "")
 	logger := utils.NewStdLogger("", 0)
 
+	// mqtt Last Will Message; tells the server that we went offline
+	lastWill, err := presence.NewLastWill(presenceTopic, mqttClientID)
+	if err != nil {
+		logger.Println(err)
+	}
+
 	mqttSettings := comms.MqttSettings{
 		WaitGroup:  &wg,
 		Transport:  "tcp",
@@ -117,30 +173,43 @@ func mqttCliClient(cmd *cobra.Command, args []string) {
 		Username:   mqttUsername,
 		Password:   mqttPassword,
 		Topics:     mqttRxTopics,
-		ToDeserializeCatResponseCh:  toDeserializeCatResponseCh,
-		ToDeserializeCatRequestCh:   toDeserializePingResponseCh,
+		ToDeserializeStateDeltaCh:   toDeserializeStateDeltaCh,
+		ToDeserializePingResponseCh: toDeserializePingResponseCh,
 		ToDeserializeCapabilitiesCh: toDeserializeCapsCh,
 		ToDeserializeStatusCh:       toDeserializeStatusCh,
+		ToDeserializeServerStatusCh: toDeserializeServerStatusCh,
+		ToDeserializeStationCh:      toDeserializeStationCh,
+		ToDeserializeRigStatusCh:    toDeserializeRigStatusCh,
+		ToDeserializeChatCh:         toDeserializeChatCh,
+		ToDeserializeClientPingCh:   toDeserializeClientPingCh,
 		ToWire:                      toWireCh,
 		Events:                      evPS,
-		LastWill:                    nil,
+		LastWill:                    lastWill,
 		Logger:                      logger,
 	}
 
-	wg.Add(3) //MQTT + SysEvents
+	wg.Add(4) //MQTT + SysEvents + ping + echo
 
 	connectionStatusCh := evPS.Sub(events.MqttConnStatus)
 	prepareShutdownCh := evPS.Sub(events.PrepareShutdown)
 	shutdownCh := evPS.Sub(events.Shutdown)
 	cliInputCh := evPS.Sub(events.CliInput)
 	radioOnlineCh := evPS.Sub(events.RadioOnline)
+	netStatsCh := evPS.Sub(events.NetStats)
 
 	rcli := remoteCli{}
 	rcli.radio = remoteradio.NewRemoteRadio(serverCatRequestTopic, mqttClientID, toWireCh, logger, evPS)
+	rcli.radio.SetAlarmAckTopic(baseTopic + "/alarmack")
+	rcli.radio.SetPollingRequestTopic(baseTopic + "/setpolling")
+	rcli.radio.SetStateRequestTopic(serverStateReqTopic)
+	rcli.radio.SetRateLimit(viper.GetInt("mqtt.rate-limit"))
 	rcli.cliCmds = cli.PopulateCliCmds()
 	rcli.remoteCliCmds = remoteradio.GetRemoteCliCmds()
+	rcli.chat = stationChat
 
 	go events.WatchSystemEvents(evPS, &wg)
+	go ping.CheckLatency(pingSettings)
+	go ping.EchoPing(echoSettings)
 	time.Sleep(200 * time.Millisecond)
 	go comms.MqttClient(mqttSettings)
 	go events.CaptureKeyboard(evPS)
@@ -151,6 +220,11 @@ func mqttCliClient(cmd *cobra.Command, args []string) {
 		// CTRL-C has been pressed; let's prepare the shutdown
 		case <-prepareShutdownCh:
 			// advice that we are going offline
+			me.Online = false
+			if err := presence.Send(toWireCh, presenceTopic, me); err != nil {
+				logger.Println(err)
+			}
+			time.Sleep(time.Millisecond * 100)
 			evPS.Pub(true, events.Shutdown)
 
 		// shutdown the application gracefully
@@ -169,8 +243,8 @@ func mqttCliClient(cmd *cobra.Command, args []string) {
 				logger.Println(err)
 			}
 
-		case msg := <-toDeserializeCatResponseCh:
-			if err := rcli.radio.DeserializeCatResponse(msg); err != nil {
+		case msg := <-toDeserializeStateDeltaCh:
+			if err := rcli.radio.DeserializeStateDelta(msg); err != nil {
 				logger.Println(err)
 			}
 
@@ -179,13 +253,45 @@ func mqttCliClient(cmd *cobra.Command, args []string) {
 				logger.Println(err)
 			}
 
+		case msg := <-toDeserializeServerStatusCh:
+			if err := rcli.radio.DeserializeServerStatus(msg); err != nil {
+				logger.Println(err)
+			}
+
+		case msg := <-toDeserializeRigStatusCh:
+			if err := rcli.radio.DeserializeRigStatus(msg); err != nil {
+				logger.Println(err)
+			}
+
+		case msg := <-toDeserializeStationCh:
+			if err := rcli.radio.DeserializeStationStatus(viper.GetString("mqtt.radio"), msg); err != nil {
+				logger.Println(err)
+			}
+
+		case msg := <-toDeserializeChatCh:
+			m, isNew, err := rcli.chat.Deserialize(msg)
+			if err != nil {
+				logger.Println(err)
+			} else if isNew {
+				logger.Println("chat:", m)
+			}
+
 		case msg := <-cliInputCh:
 			rcli.parseCli(logger, msg.([]string))
 
+		case <-rcli.radio.FlushCh():
+			rcli.radio.Flush()
+
+		case ev := <-netStatsCh:
+			rcli.radio.SetNetStats(ev.(ping.NetStats))
+
 		case ev := <-connectionStatusCh:
 			connStatus := ev.(int)
 			if connStatus == comms.CONNECTED {
-
+				me.Online = true
+				if err := presence.Send(toWireCh, presenceTopic, me); err != nil {
+					logger.Println(err)
+				}
 			}
 		case ev := <-radioOnlineCh:
 			radioOnline := ev.(bool)
@@ -196,6 +302,9 @@ func mqttCliClient(cmd *cobra.Command, args []string) {
 					Data:  []byte{'x'},
 				}
 				toWireCh <- reqCapsMsg
+				if err := rcli.radio.RequestState(); err != nil {
+					logger.Println(err)
+				}
 				fmt.Println("radio is online")
 				fmt.Println()
 				fmt.Printf("rig command: ")
@@ -229,6 +338,13 @@ func (rcli *remoteCli) parseCli(logger *log.Logger, cliInput []string) {
 		}
 	}
 
+	if cliInput[0] == "say" {
+		if err := rcli.chat.Say(strings.Join(cliInput[1:], " ")); err != nil {
+			logger.Println(err)
+		}
+		found = true
+	}
+
 	if cliInput[0] == "help" || cliInput[0] == "?" {
 		rcli.PrintHelp(logger)
 		found = true
@@ -261,6 +377,8 @@ func (rcli *remoteCli) PrintHelp(log *log.Logger) {
 		table.Append([]string{el.Name, el.Shortcut, el.Parameters})
 	}
 
+	table.Append([]string{"say", "", "Message"})
+
 	table.Render()
 
 	lines := strings.Split(buf.String(), "\n")
@@ -269,3 +387,22 @@ func (rcli *remoteCli) PrintHelp(log *log.Logger) {
 		log.Println(line)
 	}
 }
+
+// pingThresholds returns the limits of the network statistics above
+// which the link to the server is considered unsafe for transmitting
+func pingThresholds() *ping.Thresholds {
+
+	t := ping.DefaultThresholds
+
+	if viper.IsSet("network.max-loss") {
+		t.MaxLoss = viper.GetFloat64("network.max-loss") / 100
+	}
+	if viper.IsSet("network.max-rtt") {
+		t.MaxRtt = viper.GetDuration("network.max-rtt")
+	}
+	if viper.IsSet("network.max-jitter") {
+		t.MaxJitter = viper.GetDuration("network.max-jitter")
+	}
+
+	return &t
+}
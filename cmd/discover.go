@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dh1tw/gorigctl/discovery"
+	"github.com/dh1tw/gorigctl/utils"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// discoverCmd represents the discover command
+var discoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "List the radios which are online on the MQTT broker",
+	Long: `List the radios which are online on the MQTT broker
+
+All radio servers publish their status on <station>/radios/<radio>/cat/status.
+The radios of a server which is offline according to <station>/radios/status
+(multi-radio servers) are not listed.
+The station and radio names listed here can be used for the --station and
+--radio flags of the clients.
+`,
+	Run: discover,
+}
+
+func init() {
+	RootCmd.AddCommand(discoverCmd)
+	discoverCmd.Flags().StringP("broker-url", "u", "test.mosquitto.org", "MQTT Broker URL")
+	discoverCmd.Flags().IntP("broker-port", "p", 1883, "MQTT Broker Port")
+	discoverCmd.Flags().StringP("username", "U", "", "MQTT Username")
+	discoverCmd.Flags().StringP("password", "P", "", "MQTT Password")
+	discoverCmd.Flags().DurationP("duration", "t", time.Second*3, "Time to wait for the radios to answer")
+}
+
+func discover(cmd *cobra.Command, args []string) {
+
+	// If a config file is found, read it in.
+	if err := viper.ReadInConfig(); err == nil {
+		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	}
+
+	viper.BindPFlag("mqtt.broker-url", cmd.Flags().Lookup("broker-url"))
+	viper.BindPFlag("mqtt.broker-port", cmd.Flags().Lookup("broker-port"))
+	viper.BindPFlag("mqtt.username", cmd.Flags().Lookup("username"))
+	viper.BindPFlag("mqtt.password", cmd.Flags().Lookup("password"))
+
+	duration, _ := cmd.Flags().GetDuration("duration")
+
+	radios, err := discoverRadios(duration)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	if len(radios) == 0 {
+		fmt.Println("no radios found")
+		return
+	}
+
+	printRadios(radios)
+}
+
+// discoverRadios searches the broker from the mqtt settings for
+// radios which are online
+func discoverRadios(duration time.Duration) ([]discovery.Radio, error) {
+
+	fmt.Printf("searching for radios on %s:%d ...\n",
+		viper.GetString("mqtt.broker-url"), viper.GetInt("mqtt.broker-port"))
+
+	s := discovery.Settings{
+		BrokerURL:  viper.GetString("mqtt.broker-url"),
+		BrokerPort: viper.GetInt("mqtt.broker-port"),
+		Username:   viper.GetString("mqtt.username"),
+		Password:   viper.GetString("mqtt.password"),
+		ClientID:   "gorigctl-discover-" + utils.RandStringRunes(5),
+		Duration:   duration,
+		Logger:     utils.NewNullLogger(),
+	}
+
+	return discovery.Discover(s)
+}
+
+// printRadios prints the discovered radios as a numbered table
+func printRadios(radios []discovery.Radio) {
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"#", "Station", "Radio", "Manufacturer", "Model", "Server Version", "Last seen"})
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+
+	for i, r := range radios {
+		lastSeen := "-"
+		if !r.LastSeen.IsZero() {
+			lastSeen = r.LastSeen.Local().Format("2006-01-02 15:04:05")
+		}
+		version := r.Version
+		if len(version) == 0 {
+			version = "unknown"
+		}
+		table.Append([]string{strconv.Itoa(i + 1), r.Station, r.Radio,
+			r.Manufacturer, r.Model, version, lastSeen})
+	}
+
+	table.Render()
+}
+
+// pickRadio lets the user choose one of the radios on the broker
+// and sets the station and the radio of the mqtt settings
+func pickRadio(duration time.Duration) error {
+
+	radios, err := discoverRadios(duration)
+	if err != nil {
+		return err
+	}
+
+	if len(radios) == 0 {
+		return errors.New("no radios found")
+	}
+
+	printRadios(radios)
+
+	reader := bufio.NewReader(os.Stdin)
+
+	for {
+		fmt.Printf("select radio [1-%d]: ", len(radios))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil || n < 1 || n > len(radios) {
+			continue
+		}
+		viper.Set("mqtt.station", radios[n-1].Station)
+		viper.Set("mqtt.radio", radios[n-1].Radio)
+		return nil
+	}
+}
@@ -42,7 +42,7 @@ func init() {
 	guiLocalCmd.Flags().StringP("parity", "r", "none", "Parity")
 	guiLocalCmd.Flags().StringP("handshake", "a", "none", "Handshake")
 	guiLocalCmd.Flags().DurationP("polling-interval", "t", time.Duration(time.Millisecond*100), "Timer for polling the rig's meter values [ms] (0 = disabled)")
-	guiLocalCmd.Flags().DurationP("sync-interval", "k", time.Duration(time.Second*3), "Timer for syncing all values with the rig [s] (0 = disabled)")
+	guiLocalCmd.Flags().DurationP("sync-interval", "k", time.Duration(time.Second*3), "Maximum interval for syncing all values with the rig [s] (0 = disabled)")
 
 }
 
@@ -106,6 +106,12 @@ func runLocalGui(cmd *cobra.Command, args []string) {
 		port.Handshake = hl.NO_HANDSHAKE
 	}
 
+	polling, err := pollingFromConfig()
+	if err != nil {
+		fmt.Println("invalid radio.polling configuration:", err)
+		os.Exit(-1)
+	}
+
 	evPS := pubsub.New(10000)
 
 	toServerCh := make(chan comms.IOMsg, 1000)
@@ -136,17 +142,20 @@ func runLocalGui(cmd *cobra.Command, args []string) {
 		CatResponseTopic: "state",
 		ToWireCh:         toClientCh,
 		CapsTopic:        "caps",
+		MetersTopic:      "meters",
+		RigStatusTopic:   "rigstatus",
 		WaitGroup:        &wg,
 		Events:           evPS,
 		PollingInterval:  pollingInterval,
 		SyncInterval:     syncInterval,
+		Polling:          polling,
 		RadioLogger:      logger,
 		AppLogger:        nullLogger,
 	}
 
 	wg.Add(1) // radioServer
 
-	// prepareShutdownCh := evPS.Sub(events.PrepareShutdown)
+	prepareShutdownCh := evPS.Sub(events.PrepareShutdown)
 	shutdownCh := evPS.Sub(events.Shutdown)
 	cliInputCh := evPS.Sub(events.CliInput)
 	loggingCh := evPS.Sub(events.AppLog)
@@ -168,6 +177,9 @@ func runLocalGui(cmd *cobra.Command, args []string) {
 
 	for {
 		select {
+		case <-prepareShutdownCh:
+			evPS.Pub(true, events.Shutdown)
+
 		// shutdown the application gracefully
 		case <-shutdownCh:
 			//force exit after 1 sec
@@ -202,6 +214,22 @@ func runLocalGui(cmd *cobra.Command, args []string) {
 					continue
 				}
 				ui.SendCustomEvt("/radio/caps", caps)
+
+			case "meters":
+				if err := lGui.radio.DeserializeMeters(ioMsg.Data); err != nil {
+					ui.SendCustomEvt("/log/msg", err.Error())
+					continue
+				}
+				meters, _ := lGui.radio.GetMeters()
+				ui.SendCustomEvt("/radio/meters", meters)
+
+			case "rigstatus":
+				if err := lGui.radio.DeserializeRigStatus(ioMsg.Data); err != nil {
+					ui.SendCustomEvt("/log/msg", err.Error())
+					continue
+				}
+				rigStatus, _ := lGui.radio.GetRigStatus()
+				ui.SendCustomEvt("/radio/rigstatus", rigStatus)
 			}
 		case msg := <-toServerCh:
 			ioMsg := comms.IOMsg(msg)
@@ -10,13 +10,17 @@ import (
 	"time"
 
 	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/chat"
 	"github.com/dh1tw/gorigctl/cli"
 	"github.com/dh1tw/gorigctl/comms"
 	"github.com/dh1tw/gorigctl/events"
 	"github.com/dh1tw/gorigctl/gui"
 	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/presence"
 	"github.com/dh1tw/gorigctl/remoteradio"
 	sbLog "github.com/dh1tw/gorigctl/sb_log"
+	"github.com/dh1tw/gorigctl/serverstatus"
+	"github.com/dh1tw/gorigctl/station"
 	"github.com/dh1tw/gorigctl/utils"
 	ui "github.com/gizak/termui"
 	"github.com/olekukonko/tablewriter"
@@ -50,6 +54,8 @@ func init() {
 	guiMqttCmd.Flags().StringP("client-id", "C", "gorigctl-gui", "MQTT ClientID")
 	guiMqttCmd.Flags().StringP("station", "X", "mystation", "Your station callsign")
 	guiMqttCmd.Flags().StringP("radio", "Y", "myradio", "Radio ID")
+	guiMqttCmd.Flags().Int("rate-limit", 10, "Max. requests per second for frequency, RIT/XIT and level changes (0 = unlimited)")
+	guiMqttCmd.Flags().Bool("discover", false, "List the radios on the broker and pick one instead of using station and radio")
 }
 
 type remoteGui struct {
@@ -57,6 +63,7 @@ type remoteGui struct {
 	remoteCliCmds []remoteradio.RemoteCliCmd
 	radio         remoteradio.RemoteRadio
 	logger        *log.Logger
+	chat          *chat.Chat
 }
 
 func guiCliClient(cmd *cobra.Command, args []string) {
@@ -79,6 +86,14 @@ func guiCliClient(cmd *cobra.Command, args []string) {
 	viper.BindPFlag("mqtt.username", cmd.Flags().Lookup("username"))
 	viper.BindPFlag("mqtt.password", cmd.Flags().Lookup("password"))
 	viper.BindPFlag("mqtt.client-id", cmd.Flags().Lookup("client-id"))
+	viper.BindPFlag("mqtt.rate-limit", cmd.Flags().Lookup("rate-limit"))
+
+	if discover, _ := cmd.Flags().GetBool("discover"); discover {
+		if err := pickRadio(time.Second * 3); err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+	}
 
 	mqttBrokerURL := viper.GetString("mqtt.broker-url")
 	mqttBrokerPort := viper.GetInt("mqtt.broker-port")
@@ -100,25 +115,51 @@ func guiCliClient(cmd *cobra.Command, args []string) {
 	serverLogTopic := baseTopic + "/log"
 
 	// tx topics
-	serverCatResponseTopic := baseTopic + "/state"
+	serverStateDeltaTopic := baseTopic + "/statedelta"
+	serverStateReqTopic := baseTopic + "/statereq"
 	serverCapsTopic := baseTopic + "/caps"
 	serverCapsReqTopic := baseTopic + "/capsreq"
 	serverPongTopic := baseTopic + "/pong"
+	serverMetersTopic := baseTopic + "/meters"
+	serverRigStatusTopic := baseTopic + "/rigstatus"
+	presenceTopic := presence.Topic(baseTopic, mqttClientID)
+
+	me := presence.Presence{
+		UserID:     mqttClientID,
+		ClientType: presence.ClientGui,
+		Version:    version,
+		Since:      time.Now().UnixNano() / int64(time.Millisecond),
+	}
 
 	mqttRxTopics := []string{
-		serverCatResponseTopic,
+		serverStateDeltaTopic,
 		serverCapsTopic,
 		serverPongTopic,
 		serverStatusTopic,
+		serverstatus.Topic(baseTopic),
 		serverLogTopic,
+		serverMetersTopic,
+		serverRigStatusTopic,
+		ping.ClientPingTopic(baseTopic, mqttClientID),
 	}
 
 	toWireCh := make(chan comms.IOMsg, 20)
-	toDeserializeCatResponseCh := make(chan []byte, 50)
+	toDeserializeStateDeltaCh := make(chan []byte, 50)
 	toDeserializePingResponseCh := make(chan []byte, 50)
 	toDeserializeCapsCh := make(chan []byte, 5)
 	toDeserializeStatusCh := make(chan []byte, 5)
+	toDeserializeServerStatusCh := make(chan []byte, 5)
+	toDeserializeStationCh := make(chan []byte, 5)
 	toDeserializeLogCh := make(chan []byte, 10)
+	toDeserializeMetersCh := make(chan []byte, 50)
+	toDeserializeRigStatusCh := make(chan []byte, 5)
+	toDeserializeChatCh := make(chan []byte, 20)
+	toDeserializeClientPingCh := make(chan []byte, 10)
+
+	stationChat := chat.NewChat(viper.GetString("mqtt.station"), mqttClientID,
+		viper.GetInt("chat.history"), toWireCh)
+	mqttRxTopics = append(mqttRxTopics, stationChat.SubscriptionTopic(),
+		station.Topic(viper.GetString("mqtt.station")))
 
 	// Event PubSub
 	evPS := pubsub.New(10000)
@@ -127,16 +168,32 @@ func guiCliClient(cmd *cobra.Command, args []string) {
 	var wg sync.WaitGroup
 
 	pingSettings := ping.Settings{
+		ToWireCh:   toWireCh,
+		PingTopic:  serverPingTopic,
+		PongCh:     toDeserializePingResponseCh,
+		UserID:     mqttClientID,
+		WaitGroup:  &wg,
+		Events:     evPS,
+		Thresholds: pingThresholds(),
+	}
+
+	// the server measures our latency, too
+	echoSettings := ping.Settings{
 		ToWireCh:  toWireCh,
-		PingTopic: serverPingTopic,
-		PongCh:    toDeserializePingResponseCh,
-		UserID:    mqttClientID,
+		PongTopic: ping.ClientPongTopic(baseTopic),
+		PongCh:    toDeserializeClientPingCh,
 		WaitGroup: &wg,
 		Events:    evPS,
 	}
 
 	appLogger := utils.NewChLogger(evPS, events.AppLog, "")
 
+	// mqtt Last Will Message; tells the server that we went offline
+	lastWill, err := presence.NewLastWill(presenceTopic, mqttClientID)
+	if err != nil {
+		fmt.Println(err)
+	}
+
 	mqttSettings := comms.MqttSettings{
 		WaitGroup:  &wg,
 		Transport:  "tcp",
@@ -146,35 +203,50 @@ func guiCliClient(cmd *cobra.Command, args []string) {
 		Username:   mqttUsername,
 		Password:   mqttPassword,
 		Topics:     mqttRxTopics,
-		ToDeserializeCatResponseCh:  toDeserializeCatResponseCh,
+		ToDeserializeStateDeltaCh:   toDeserializeStateDeltaCh,
 		ToDeserializeCatRequestCh:   toDeserializePingResponseCh, //!!!!!!
 		ToDeserializeCapabilitiesCh: toDeserializeCapsCh,
 		ToDeserializeStatusCh:       toDeserializeStatusCh,
+		ToDeserializeServerStatusCh: toDeserializeServerStatusCh,
+		ToDeserializeStationCh:      toDeserializeStationCh,
 		ToDeserializePingResponseCh: toDeserializePingResponseCh,
 		ToDeserializeLogCh:          toDeserializeLogCh,
+		ToDeserializeMetersCh:       toDeserializeMetersCh,
+		ToDeserializeRigStatusCh:    toDeserializeRigStatusCh,
+		ToDeserializeChatCh:         toDeserializeChatCh,
+		ToDeserializeClientPingCh:   toDeserializeClientPingCh,
 		ToWire:                      toWireCh,
 		Events:                      evPS,
-		LastWill:                    nil,
+		LastWill:                    lastWill,
 		Logger:                      appLogger,
 	}
 
-	wg.Add(2) //MQTT + ping
+	wg.Add(3) //MQTT + ping + echo
 
 	rGui := remoteGui{}
 
+	connectionStatusCh := evPS.Sub(events.MqttConnStatus)
+	prepareShutdownCh := evPS.Sub(events.PrepareShutdown)
 	shutdownCh := evPS.Sub(events.Shutdown)
 	cliInputCh := evPS.Sub(events.CliInput)
 	pongCh := evPS.Sub(events.Pong)
 	radioOnlineCh := evPS.Sub(events.RadioOnline)
 	loggingCh := evPS.Sub(events.AppLog)
+	netStatsCh := evPS.Sub(events.NetStats)
+	cmdLatencyCh := evPS.Sub(events.CmdLatency)
 
 	logger := utils.NewChLogger(evPS, events.AppLog, "")
 	rGui.logger = logger
 
 	rGui.radio = remoteradio.NewRemoteRadio(serverCatRequestTopic, mqttClientID, toWireCh, logger, evPS)
+	rGui.radio.SetAlarmAckTopic(baseTopic + "/alarmack")
+	rGui.radio.SetPollingRequestTopic(baseTopic + "/setpolling")
+	rGui.radio.SetStateRequestTopic(serverStateReqTopic)
+	rGui.radio.SetRateLimit(viper.GetInt("mqtt.rate-limit"))
 	rGui.cliCmds = cli.PopulateCliCmds()
 	rGui.remoteCliCmds = remoteradio.GetRemoteCliCmds()
 	rGui.logger = logger
+	rGui.chat = stationChat
 
 	if err := ui.Init(); err != nil {
 		panic(err)
@@ -182,12 +254,22 @@ func guiCliClient(cmd *cobra.Command, args []string) {
 	defer ui.Close()
 
 	go ping.CheckLatency(pingSettings)
+	go ping.EchoPing(echoSettings)
 	time.Sleep(200 * time.Millisecond)
 	go comms.MqttClient(mqttSettings)
 	go gui.Loop(evPS)
 
 	for {
 		select {
+		case <-prepareShutdownCh:
+			// advice that we are going offline
+			me.Online = false
+			if err := presence.Send(toWireCh, presenceTopic, me); err != nil {
+				fmt.Println(err)
+			}
+			time.Sleep(time.Millisecond * 100)
+			evPS.Pub(true, events.Shutdown)
+
 		// shutdown the application gracefully
 		case <-shutdownCh:
 			//force exit after 1 sec
@@ -204,20 +286,64 @@ func guiCliClient(cmd *cobra.Command, args []string) {
 			caps, _ := rGui.radio.GetCaps()
 			ui.SendCustomEvt("/radio/caps", caps)
 
-		case msg := <-toDeserializeCatResponseCh:
-			// r.printRigUpdates = true
-			err := rGui.radio.DeserializeCatResponse(msg)
+		case msg := <-toDeserializeStateDeltaCh:
+			err := rGui.radio.DeserializeStateDelta(msg)
 			if err != nil {
 				ui.SendCustomEvt("/log/msg", err.Error())
 			}
 			state, _ := rGui.radio.GetState()
 			ui.SendCustomEvt("/radio/state", state)
+			powerLimit, _ := rGui.radio.GetPowerLimit()
+			ui.SendCustomEvt("/radio/powerlimit", powerLimit)
 
 		case msg := <-toDeserializeStatusCh:
 			rGui.radio.DeserializeRadioStatus(msg)
 
+		case msg := <-toDeserializeServerStatusCh:
+			rGui.radio.DeserializeServerStatus(msg)
+			operators, _ := rGui.radio.GetOperators()
+			ui.SendCustomEvt("/radio/operators", operators)
+			latency, _ := rGui.radio.GetOperatorLatency()
+			ui.SendCustomEvt("/radio/latency", latency)
+
+		case msg := <-toDeserializeMetersCh:
+			if err := rGui.radio.DeserializeMeters(msg); err != nil {
+				ui.SendCustomEvt("/log/msg", err.Error())
+			}
+			meters, _ := rGui.radio.GetMeters()
+			ui.SendCustomEvt("/radio/meters", meters)
+
+		case msg := <-toDeserializeRigStatusCh:
+			if err := rGui.radio.DeserializeRigStatus(msg); err != nil {
+				ui.SendCustomEvt("/log/msg", err.Error())
+			}
+			rigStatus, _ := rGui.radio.GetRigStatus()
+			ui.SendCustomEvt("/radio/rigstatus", rigStatus)
+
+		case msg := <-toDeserializeStationCh:
+			if err := rGui.radio.DeserializeStationStatus(viper.GetString("mqtt.radio"), msg); err != nil {
+				ui.SendCustomEvt("/log/msg", err.Error())
+			}
+
+		case msg := <-toDeserializeChatCh:
+			m, isNew, err := rGui.chat.Deserialize(msg)
+			if err != nil {
+				ui.SendCustomEvt("/log/msg", err.Error())
+			} else if isNew {
+				ui.SendCustomEvt("/chat/msg", m)
+			}
+
 		case msg := <-cliInputCh:
 			rGui.parseCli(msg.([]string))
+			// show debounced changes immediately
+			state, _ := rGui.radio.GetState()
+			ui.SendCustomEvt("/radio/state", state)
+
+		case <-rGui.radio.FlushCh():
+			if rGui.radio.Flush() {
+				state, _ := rGui.radio.GetState()
+				ui.SendCustomEvt("/radio/state", state)
+			}
 
 		case msg := <-toDeserializeLogCh:
 			deserializeRadioLogMsg(msg)
@@ -236,6 +362,9 @@ func guiCliClient(cmd *cobra.Command, args []string) {
 					Data:  []byte{'x'},
 				}
 				toWireCh <- reqCapsMsg
+				if err := rGui.radio.RequestState(); err != nil {
+					logger.Println(err)
+				}
 			} else {
 				logger.Println("radio is offline")
 			}
@@ -244,6 +373,21 @@ func guiCliClient(cmd *cobra.Command, args []string) {
 		case msg := <-pongCh:
 			ui.SendCustomEvt("/network/latency", msg)
 
+		case ev := <-netStatsCh:
+			rGui.radio.SetNetStats(ev.(ping.NetStats))
+			ui.SendCustomEvt("/network/stats", ev.(ping.NetStats))
+
+		case ev := <-cmdLatencyCh:
+			ui.SendCustomEvt("/network/cmdlatency", ev.(remoteradio.CmdSample))
+
+		case ev := <-connectionStatusCh:
+			if ev.(int) == comms.CONNECTED {
+				me.Online = true
+				if err := presence.Send(toWireCh, presenceTopic, me); err != nil {
+					logger.Println(err)
+				}
+			}
+
 		case <-shutdownCh:
 			log.Println("disconnecting from radio")
 			return
@@ -281,6 +425,13 @@ func (rGui *remoteGui) parseCli(cliInput []string) {
 		}
 	}
 
+	if cliInput[0] == "say" {
+		if err := rGui.chat.Say(strings.Join(cliInput[1:], " ")); err != nil {
+			rGui.logger.Println(err)
+		}
+		found = true
+	}
+
 	if cliInput[0] == "help" || cliInput[0] == "?" {
 		rGui.PrintHelp(rGui.logger)
 		found = true
@@ -310,6 +461,8 @@ func (rGui *remoteGui) PrintHelp(log *log.Logger) {
 		table.Append([]string{el.Name, el.Shortcut, el.Parameters})
 	}
 
+	table.Append([]string{"say", "", "Message"})
+
 	table.Render()
 
 	lines := strings.Split(buf.String(), "\n")
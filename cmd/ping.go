@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// pingCmd represents the ping command
+var pingCmd = &cobra.Command{
+	Use:   "ping",
+	Short: "Check if a radio server is reachable through the MQTT broker",
+	Long: `Check if a radio server is reachable through the MQTT broker
+
+Sends pings to <station>/radios/<radio>/cat/ping and prints the round trip
+time of each reply and a summary. The exit code is 0 if the packet loss is
+within --max-loss, 1 if not and 2 if the broker can't be reached, so that
+the command can be used in monitoring scripts.
+`,
+	Run: pingServer,
+}
+
+func init() {
+	RootCmd.AddCommand(pingCmd)
+	pingCmd.Flags().StringP("broker-url", "u", "test.mosquitto.org", "MQTT Broker URL")
+	pingCmd.Flags().IntP("broker-port", "p", 1883, "MQTT Broker Port")
+	pingCmd.Flags().StringP("username", "U", "", "MQTT Username")
+	pingCmd.Flags().StringP("password", "P", "", "MQTT Password")
+	pingCmd.Flags().StringP("station", "X", "mystation", "remote station callsign")
+	pingCmd.Flags().StringP("radio", "Y", "myradio", "Radio ID")
+	pingCmd.Flags().IntP("count", "c", 5, "Number of pings")
+	pingCmd.Flags().DurationP("interval", "i", time.Second, "Time between the pings")
+	pingCmd.Flags().DurationP("wait", "W", ping.LossTimeout, "Time to wait for the replies after the last ping")
+	pingCmd.Flags().Float64("max-loss", 99, "Max. packet loss [%] before the check fails")
+}
+
+func pingServer(cmd *cobra.Command, args []string) {
+
+	// If a config file is found, read it in.
+	if err := viper.ReadInConfig(); err == nil {
+		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	}
+
+	viper.BindPFlag("mqtt.broker-url", cmd.Flags().Lookup("broker-url"))
+	viper.BindPFlag("mqtt.broker-port", cmd.Flags().Lookup("broker-port"))
+	viper.BindPFlag("mqtt.username", cmd.Flags().Lookup("username"))
+	viper.BindPFlag("mqtt.password", cmd.Flags().Lookup("password"))
+	viper.BindPFlag("mqtt.station", cmd.Flags().Lookup("station"))
+	viper.BindPFlag("mqtt.radio", cmd.Flags().Lookup("radio"))
+
+	count, _ := cmd.Flags().GetInt("count")
+	interval, _ := cmd.Flags().GetDuration("interval")
+	wait, _ := cmd.Flags().GetDuration("wait")
+	maxLoss, _ := cmd.Flags().GetFloat64("max-loss")
+
+	if count < 1 {
+		fmt.Println("count must be at least 1")
+		os.Exit(2)
+	}
+
+	if interval <= 0 {
+		fmt.Println("interval must be positive")
+		os.Exit(2)
+	}
+
+	station := viper.GetString("mqtt.station")
+	radio := viper.GetString("mqtt.radio")
+
+	s := ping.ProbeSettings{
+		BrokerURL:  viper.GetString("mqtt.broker-url"),
+		BrokerPort: viper.GetInt("mqtt.broker-port"),
+		Username:   viper.GetString("mqtt.username"),
+		Password:   viper.GetString("mqtt.password"),
+		ClientID:   "gorigctl-ping-" + utils.RandStringRunes(5),
+		BaseTopic:  station + "/radios/" + radio + "/cat",
+		Count:      count,
+		Interval:   interval,
+		Wait:       wait,
+		Logger:     utils.NewNullLogger(),
+		OnReply: func(seq uint64, rtt time.Duration) {
+			fmt.Printf("reply from %s/%s: seq=%d time=%v\n", station, radio, seq,
+				rtt.Round(time.Millisecond/10))
+		},
+	}
+
+	fmt.Printf("PING %s/%s via %s:%d\n", station, radio, s.BrokerURL, s.BrokerPort)
+
+	stats, err := ping.Probe(s)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	fmt.Println()
+	fmt.Printf("--- %s/%s ping statistics ---\n", station, radio)
+	fmt.Println(stats)
+
+	if stats.Received == 0 || stats.Loss*100 > maxLoss {
+		os.Exit(1)
+	}
+}
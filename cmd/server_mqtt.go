@@ -5,14 +5,24 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/audit"
+	"github.com/dh1tw/gorigctl/bandplan"
 	"github.com/dh1tw/gorigctl/comms"
 	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/homeassistant"
+	"github.com/dh1tw/gorigctl/influx"
+	"github.com/dh1tw/gorigctl/metrics"
 	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/presence"
 	"github.com/dh1tw/gorigctl/server"
+	"github.com/dh1tw/gorigctl/serverstatus"
+	"github.com/dh1tw/gorigctl/station"
 	"github.com/dh1tw/gorigctl/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -36,6 +46,9 @@ Server and the Client.
 The parameters in "<>" can be set through flags or in the config file:
 <station>/radios/<radio>/cat
 
+Several radios can be served by one server through [[radio]] sections
+in the config file (see gorigctl.toml).
+
 	`,
 	Run: mqttRadioServer,
 }
@@ -50,7 +63,11 @@ func init() {
 	serverMqttCmd.Flags().StringP("station", "X", "mystation", "Your station callsign")
 	serverMqttCmd.Flags().StringP("radio", "Y", "myradio", "Radio ID")
 	serverMqttCmd.Flags().DurationP("polling-interval", "t", time.Duration(time.Millisecond*100), "Timer for polling the rig's meter values [ms] (0 = disabled)")
-	serverMqttCmd.Flags().DurationP("sync-interval", "k", time.Duration(time.Second*3), "Timer for syncing all values with the rig [s] (0 = disabled)")
+	serverMqttCmd.Flags().DurationP("sync-interval", "k", time.Duration(time.Second*3), "Maximum interval for syncing all values with the rig [s] (0 = disabled)")
+	serverMqttCmd.Flags().Duration("snapshot-interval", time.Duration(time.Second*30), "Interval for publishing the full state in between the state deltas [s]")
+	serverMqttCmd.Flags().Bool("legacy-full-state", false, "Publish the full state on cat/state with every change (for clients without delta support)")
+	serverMqttCmd.Flags().Duration("rig-timeout", server.DefaultRigTimeout, "Time after which the rig is reported as not responding")
+	serverMqttCmd.Flags().Duration("heartbeat-interval", time.Duration(time.Second*10), "Interval for republishing the server status with the rig's health [s] (0 = disabled)")
 	serverMqttCmd.Flags().IntP("rig-model", "m", 1, "Hamlib Rig Model ID")
 	serverMqttCmd.Flags().IntP("baudrate", "b", 38400, "Baudrate")
 	serverMqttCmd.Flags().StringP("portname", "o", "/dev/mhux/cat", "Portname / Device path")
@@ -59,10 +76,29 @@ func init() {
 	serverMqttCmd.Flags().StringP("parity", "r", "none", "Parity")
 	serverMqttCmd.Flags().StringP("handshake", "a", "none", "Handshake")
 	serverMqttCmd.Flags().IntP("hl-debug-level", "D", 0, "Hamlib Debug Level (0=ERROR,..., 5=TRACE)")
+	serverMqttCmd.Flags().Float32("swr-threshold", 0, "Release PTT if the SWR exceeds this value (0 = disabled)")
+	serverMqttCmd.Flags().Float32("alc-threshold", 0, "Release PTT if the ALC exceeds this value (0 = disabled)")
+	serverMqttCmd.Flags().Int("trip-count", 3, "Consecutive meter polls above the SWR/ALC threshold before releasing PTT")
+	serverMqttCmd.Flags().Float32("trip-rf-power", 0, "RFPOWER level (0..1) applied after an SWR/ALC alarm (0 = unchanged)")
+	serverMqttCmd.Flags().String("audit-file", "", "File to which the audit trail of all remote commands is written (empty = disabled)")
+	serverMqttCmd.Flags().Int64("audit-max-size", 10, "Size [MB] after which the audit file is rotated")
+	serverMqttCmd.Flags().Int("audit-max-backups", 5, "Number of rotated audit files to keep")
+	serverMqttCmd.Flags().String("metrics-listen", "", "Address on which Prometheus metrics are served on /metrics, e.g. ':9110' (empty = disabled)")
+	serverMqttCmd.Flags().Int("worker", -1, "Serve the n-th [[radio]] section through stdin/stdout (used internally)")
+	serverMqttCmd.Flags().MarkHidden("worker")
 }
 
 func mqttRadioServer(cmd *cobra.Command, args []string) {
 
+	// a worker process serves one radio of a multi-radio server; its
+	// stdout is the pipe to the server process
+	worker, _ := cmd.Flags().GetInt("worker")
+	var pipeOut *os.File
+	if worker >= 0 {
+		pipeOut = os.Stdout
+		os.Stdout = os.Stderr
+	}
+
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
@@ -85,7 +121,36 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 	viper.BindPFlag("radio.handshake", cmd.Flags().Lookup("handshake"))
 	viper.BindPFlag("radio.polling-interval", cmd.Flags().Lookup("polling-interval"))
 	viper.BindPFlag("radio.sync-interval", cmd.Flags().Lookup("sync-interval"))
+	viper.BindPFlag("radio.snapshot-interval", cmd.Flags().Lookup("snapshot-interval"))
+	viper.BindPFlag("radio.legacy-full-state", cmd.Flags().Lookup("legacy-full-state"))
+	viper.BindPFlag("radio.rig-timeout", cmd.Flags().Lookup("rig-timeout"))
+	viper.BindPFlag("mqtt.heartbeat-interval", cmd.Flags().Lookup("heartbeat-interval"))
+	viper.BindPFlag("radio.metrics-listen", cmd.Flags().Lookup("metrics-listen"))
 	viper.BindPFlag("radio.hl-debug-level", cmd.Flags().Lookup("hl-debug-level"))
+	viper.BindPFlag("protection.swr-threshold", cmd.Flags().Lookup("swr-threshold"))
+	viper.BindPFlag("protection.alc-threshold", cmd.Flags().Lookup("alc-threshold"))
+	viper.BindPFlag("protection.trip-count", cmd.Flags().Lookup("trip-count"))
+	viper.BindPFlag("protection.trip-rf-power", cmd.Flags().Lookup("trip-rf-power"))
+	viper.BindPFlag("audit.file", cmd.Flags().Lookup("audit-file"))
+	viper.BindPFlag("audit.max-size", cmd.Flags().Lookup("audit-max-size"))
+	viper.BindPFlag("audit.max-backups", cmd.Flags().Lookup("audit-max-backups"))
+
+	if worker >= 0 {
+		if err := applyRadioSection(cmd, worker); err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+	} else {
+		sections, err := radioSections()
+		if err != nil {
+			fmt.Println("invalid radio configuration:", err)
+			os.Exit(-1)
+		}
+		if len(sections) > 0 {
+			multiRadioServer(cmd, sections)
+			return
+		}
+	}
 
 	// profiling server can be enabled through a hidden pflag
 	// go func() {
@@ -112,24 +177,30 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 		"/radios/" + viper.GetString("mqtt.radio") +
 		"/cat"
 
-	serverCatRequestTopic := baseTopic + "/setstate"
 	serverStatusTopic := baseTopic + "/status"
-	serverPingTopic := baseTopic + "/ping"
 	logTopic := baseTopic + "/log"
 
 	// tx topics
 	serverCatResponseTopic := baseTopic + "/state"
+	serverStateDeltaTopic := baseTopic + "/statedelta"
 	serverCapsTopic := baseTopic + "/caps"
 	serverPongTopic := baseTopic + "/pong"
-	serverCapsReqTopic := baseTopic + "/capsreq"
+	serverMetersTopic := baseTopic + "/meters"
+	rigStatusTopic := baseTopic + "/rigstatus"
 
-	mqttRxTopics := []string{serverCatRequestTopic, serverPingTopic, serverCapsReqTopic}
+	mqttRxTopics := serverRxTopics(baseTopic)
 
 	toWireCh := make(chan comms.IOMsg, 20)
 	// toSerializeCatDataCh := make(chan comms.IOMsg, 20)
 	toDeserializeCatRequestCh := make(chan []byte, 10)
 	toDeserializePingRequestCh := make(chan []byte, 10)
 	toDeserializeCapsReqCh := make(chan []byte, 10)
+	toDeserializePresenceCh := make(chan []byte, 10)
+	toDeserializeAlarmAckCh := make(chan []byte, 10)
+	toDeserializePollingReqCh := make(chan []byte, 10)
+	toDeserializeStateReqCh := make(chan []byte, 10)
+	toDeserializeClientPongCh := make(chan []byte, 20)
+	toDeserializeHaCommandCh := make(chan comms.IOMsg, 10)
 
 	// Event PubSub
 	evPS := pubsub.New(100)
@@ -151,8 +222,80 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 	}
 
 	appLogger := utils.NewStdLogger("", log.Ltime)
+	if worker >= 0 {
+		appLogger = utils.NewStdLogger(viper.GetString("mqtt.radio")+": ", log.Ltime)
+	}
 	radioLogger := utils.NewChLogger(evPS, events.RadioLog, "")
 
+	var auditLogger *audit.Logger
+	if auditFile := viper.GetString("audit.file"); auditFile != "" {
+		auditLogger, err = audit.NewLogger(auditFile,
+			viper.GetInt64("audit.max-size")*1024*1024,
+			viper.GetInt("audit.max-backups"))
+		if err != nil {
+			fmt.Println("unable to open audit file:", err)
+			os.Exit(-1)
+		}
+		appLogger.Println("writing audit trail to", auditFile)
+	}
+
+	txGuard, err := txGuardFromConfig()
+	if err != nil {
+		fmt.Println("invalid tx-guard configuration:", err)
+		os.Exit(-1)
+	}
+	if txGuard != nil {
+		appLogger.Printf("tx guard enabled with %d band segment(s)\n", len(txGuard.Bands))
+	}
+
+	powerLimits, err := powerLimitsFromConfig()
+	if err != nil {
+		fmt.Println("invalid power-limit configuration:", err)
+		os.Exit(-1)
+	}
+	if len(powerLimits) > 0 {
+		appLogger.Printf("RFPOWER limited on %d band segment(s)\n", len(powerLimits))
+	}
+
+	// the radio is served even if the metrics can't be, e.g. if several
+	// radios are configured with the same address
+	var metricsRegistry *metrics.Registry
+	if addr := viper.GetString("radio.metrics-listen"); len(addr) > 0 {
+		metricsRegistry = metrics.NewRegistry()
+		if err := metrics.Listen(addr, metricsRegistry, appLogger); err != nil {
+			appLogger.Println("unable to serve the metrics:", err)
+			metricsRegistry = nil
+		}
+	}
+	if metricsRegistry != nil {
+		metricsRegistry.SetFunc(metrics.QueueLength, metrics.Labels{"queue": "to_wire"},
+			func() float64 { return float64(len(toWireCh)) })
+		metricsRegistry.SetFunc(metrics.QueueLength, metrics.Labels{"queue": "cat_request"},
+			func() float64 { return float64(len(toDeserializeCatRequestCh)) })
+		appLogger.Printf("serving metrics on http://%s/metrics\n",
+			viper.GetString("radio.metrics-listen"))
+	}
+
+	var influxSettings server.InfluxSettings
+	influxExport, meterInterval := influxFromConfig()
+	if influxExport != nil {
+		influxExport.PointsCh = make(chan influx.Point, 1000)
+		influxExport.WaitGroup = &wg
+		influxExport.Events = evPS
+		influxExport.Logger = appLogger
+		influxSettings.PointsCh = influxExport.PointsCh
+		influxSettings.MeterInterval = meterInterval
+		// the query might contain credentials
+		appLogger.Println("exporting the radio's state to",
+			strings.SplitN(influxExport.URL, "?", 2)[0])
+	}
+
+	polling, err := pollingFromConfig()
+	if err != nil {
+		fmt.Println("invalid radio.polling configuration:", err)
+		os.Exit(-1)
+	}
+
 	mqttSettings := comms.MqttSettings{
 		WaitGroup:  &wg,
 		Transport:  "tcp",
@@ -165,10 +308,17 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 		ToDeserializeCatRequestCh:  toDeserializeCatRequestCh,
 		ToDeserializePingRequestCh: toDeserializePingRequestCh,
 		ToDeserializeCapsReqCh:     toDeserializeCapsReqCh,
+		ToDeserializePresenceCh:    toDeserializePresenceCh,
+		ToDeserializeAlarmAckCh:    toDeserializeAlarmAckCh,
+		ToDeserializePollingReqCh:  toDeserializePollingReqCh,
+		ToDeserializeStateReqCh:    toDeserializeStateReqCh,
+		ToDeserializeClientPongCh:  toDeserializeClientPongCh,
+		ToDeserializeHaCommandCh:   toDeserializeHaCommandCh,
 		ToWire:                     toWireCh,
 		Events:                     evPS,
 		LastWill:                   &lastWill,
 		Logger:                     appLogger,
+		Metrics:                    metricsRegistry,
 	}
 
 	pongSettings := ping.Settings{
@@ -179,6 +329,14 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 		Events:    evPS,
 	}
 
+	clientPingSettings := ping.Settings{
+		PongCh:    toDeserializeClientPongCh,
+		ToWireCh:  toWireCh,
+		PingTopic: baseTopic,
+		WaitGroup: &wg,
+		Events:    evPS,
+	}
+
 	rigModel := viper.GetInt("radio.rig-model")
 
 	port := hl.Port{}
@@ -209,6 +367,15 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 
 	pollingInterval := viper.GetDuration("radio.polling-interval")
 	syncInterval := viper.GetDuration("radio.sync-interval")
+	snapshotInterval := viper.GetDuration("radio.snapshot-interval")
+	rigTimeout := viper.GetDuration("radio.rig-timeout")
+
+	protection := server.ProtectionSettings{
+		SwrThreshold: float32(viper.GetFloat64("protection.swr-threshold")),
+		AlcThreshold: float32(viper.GetFloat64("protection.alc-threshold")),
+		TripCount:    viper.GetInt("protection.trip-count"),
+		RfPower:      float32(viper.GetFloat64("protection.trip-rf-power")),
+	}
 
 	radioSettings := server.RadioSettings{
 		RigModel:         rigModel,
@@ -216,18 +383,41 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 		HlDebugLevel:     hlDebugLevel,
 		CatRequestCh:     toDeserializeCatRequestCh,
 		CapsReqCh:        toDeserializeCapsReqCh,
+		PresenceCh:       toDeserializePresenceCh,
+		AlarmAckCh:       toDeserializeAlarmAckCh,
+		PollingReqCh:     toDeserializePollingReqCh,
 		ToWireCh:         toWireCh,
 		CatResponseTopic: serverCatResponseTopic,
+		StateDeltaTopic:  serverStateDeltaTopic,
+		StateReqCh:       toDeserializeStateReqCh,
+		SnapshotInterval: snapshotInterval,
+		LegacyFullState:  viper.GetBool("radio.legacy-full-state"),
 		CapsTopic:        serverCapsTopic,
+		MetersTopic:      serverMetersTopic,
 		WaitGroup:        &wg,
 		Events:           evPS,
 		PollingInterval:  pollingInterval,
 		SyncInterval:     syncInterval,
+		Polling:          polling,
+		RigTimeout:       rigTimeout,
 		RadioLogger:      radioLogger,
 		AppLogger:        appLogger,
+		Audit:            auditLogger,
+		TxGuard:          txGuard,
+		Protection:       protection,
+		PowerLimits:      powerLimits,
+		RigStatusTopic:   rigStatusTopic,
+		BaseTopic:        baseTopic,
+		PttMaxLatency:    viper.GetDuration("network.ptt-max-latency"),
+		PttMaxLoss:       viper.GetFloat64("network.ptt-max-loss") / 100,
+		HealthInterval:   viper.GetDuration("mqtt.heartbeat-interval"),
+		Metrics:          metricsRegistry,
+		Influx:           influxSettings,
+		HomeAssistant:    homeAssistantFromConfig(baseTopic, worker >= 0),
+		HaCommandCh:      toDeserializeHaCommandCh,
 	}
 
-	wg.Add(4) //MQTT + Ping + Radio + Events
+	wg.Add(4) //MQTT + Ping + ClientPing + Radio
 
 	connectionStatusCh := evPS.Sub(events.MqttConnStatus)
 	shutdownCh := evPS.Sub(events.Shutdown)
@@ -235,18 +425,36 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 
 	appLoggingCh := evPS.Sub(events.AppLog)
 	radioLoggingCh := evPS.Sub(events.RadioLog)
-
-	go events.WatchSystemEvents(evPS, &wg)
-	go comms.MqttClient(mqttSettings)
+	operatorsCh := evPS.Sub(events.Operators)
+	clientLatencyCh := evPS.Sub(events.ClientLatency)
+	rigHealthCh := evPS.Sub(events.RigHealth)
+
+	if worker >= 0 {
+		// the server process initiates the shutdown by closing the pipe
+		signal.Ignore(os.Interrupt)
+		go comms.PipeClient(mqttSettings, os.Stdin, pipeOut)
+	} else {
+		wg.Add(1) // Events
+		go events.WatchSystemEvents(evPS, &wg)
+		go comms.MqttClient(mqttSettings)
+	}
 	go ping.EchoPing(pongSettings)
+	go ping.PingClients(clientPingSettings)
+	if influxExport != nil {
+		wg.Add(1)
+		go influx.Export(*influxExport)
+	}
 
 	time.Sleep(time.Millisecond * 500)
 	go server.StartRadioServer(radioSettings)
 
 	status := serverStatus{}
 	status.statusTopic = serverStatusTopic
+	status.detailsTopic = serverstatus.Topic(baseTopic)
 	status.logTopic = logTopic
 	status.toWireCh = toWireCh
+	status.version = version
+	status.started = time.Now()
 
 	for {
 		select {
@@ -257,6 +465,9 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 			time.Sleep(time.Microsecond * 200)
 			// publish that the server is going offline
 			status.online = false
+			if err := status.sendOnline(); err != nil {
+				fmt.Println(err)
+			}
 			if err := status.sendUpdate(); err != nil {
 				fmt.Println(err)
 			}
@@ -285,11 +496,44 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 				fmt.Println(err)
 			}
 
+		case ev := <-operatorsCh:
+			status.operators = ev.([]presence.Presence)
+			if status.online {
+				if err := status.sendUpdate(); err != nil {
+					fmt.Println(err)
+				}
+			}
+
+		case ev := <-clientLatencyCh:
+			status.latency = ev.(map[string]ping.Stats)
+			// the latency is published along with the regular
+			// status updates, but at least every ShortWindow
+			if status.online && time.Since(status.lastUpdate) >= ping.ShortWindow {
+				if err := status.sendUpdate(); err != nil {
+					fmt.Println(err)
+				}
+			}
+
+		case ev := <-rigHealthCh:
+			// the rig's health is published periodically and
+			// serves as the server's heartbeat
+			rig := ev.(serverstatus.Rig)
+			status.rig = &rig
+			if status.online {
+				if err := status.sendUpdate(); err != nil {
+					fmt.Println(err)
+				}
+			}
+
 		case ev := <-connectionStatusCh:
 			connStatus := ev.(int)
 			fmt.Println("connstatus:", connStatus)
+			metricsRegistry.Set(metrics.MqttConnected, nil, float64(connStatus))
 			if connStatus == comms.CONNECTED {
 				status.online = true
+				if err := status.sendOnline(); err != nil {
+					fmt.Println(err)
+				}
 				if err := status.sendUpdate(); err != nil {
 					fmt.Println(err)
 				}
@@ -300,14 +544,42 @@ func mqttRadioServer(cmd *cobra.Command, args []string) {
 	}
 }
 
+// serverRxTopics returns the topics to which the server of a radio
+// subscribes
+func serverRxTopics(baseTopic string) []string {
+	topics := []string{
+		baseTopic + "/setstate",
+		baseTopic + "/ping",
+		baseTopic + "/capsreq",
+		baseTopic + "/presence/+",
+		baseTopic + "/alarmack",
+		baseTopic + "/setpolling",
+		baseTopic + "/statereq",
+		ping.ClientPongTopic(baseTopic),
+	}
+	if viper.GetBool("homeassistant.enabled") {
+		topics = append(topics, homeassistant.CommandTopic(baseTopic, "+"))
+	}
+	return topics
+}
+
 type serverStatus struct {
-	online      bool
-	statusTopic string
-	logTopic    string
-	toWireCh    chan comms.IOMsg
+	online       bool
+	version      string
+	operators    []presence.Presence
+	latency      map[string]ping.Stats
+	rig          *serverstatus.Rig
+	started      time.Time
+	lastUpdate   time.Time
+	statusTopic  string // sbStatus of the ICD
+	detailsTopic string // serverstatus
+	logTopic     string
+	toWireCh     chan comms.IOMsg
 }
 
-func (s *serverStatus) sendUpdate() error {
+// sendOnline publishes whether the server is online in the format of
+// the ICD, which all clients understand
+func (s *serverStatus) sendOnline() error {
 
 	msg := sbStatus.Status{}
 	msg.Online = s.online
@@ -326,6 +598,154 @@ func (s *serverStatus) sendUpdate() error {
 	return nil
 }
 
+// sendUpdate publishes the details of the server's status
+func (s *serverStatus) sendUpdate() error {
+
+	msg := serverstatus.Status{}
+	msg.Online = s.online
+	msg.Version = s.version
+	msg.Operators = s.operators
+	msg.Latency = s.latency
+	msg.Rig = s.rig
+	msg.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	msg.Started = s.started.UnixNano() / int64(time.Millisecond)
+	msg.Uptime = int64(time.Since(s.started).Seconds())
+	s.lastUpdate = time.Now()
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+
+	m := comms.IOMsg{}
+	m.Data = data
+	m.Topic = s.detailsTopic
+	m.Retain = true
+
+	s.toWireCh <- m
+
+	return nil
+}
+
+// txGuardFromConfig reads the band plan from the config file. If the
+// tx guard is disabled, nil is returned.
+func txGuardFromConfig() (*bandplan.Guard, error) {
+
+	if !viper.GetBool("tx-guard.enabled") {
+		return nil, nil
+	}
+
+	bands := []bandplan.Band{}
+	if err := viper.UnmarshalKey("tx-guard.band", &bands); err != nil {
+		return nil, err
+	}
+
+	if len(bands) == 0 {
+		return nil, errors.New("no band segments defined")
+	}
+
+	licenses := viper.GetStringMapString("tx-guard.licenses")
+	defaultLicense := viper.GetString("tx-guard.default-license")
+
+	return bandplan.NewGuard(bands, licenses, defaultLicense)
+}
+
+// powerLimitsFromConfig reads the per band RFPOWER limits from the
+// config file.
+func powerLimitsFromConfig() (bandplan.PowerLimits, error) {
+
+	limits := []bandplan.PowerLimit{}
+	if err := viper.UnmarshalKey("power-limit", &limits); err != nil {
+		return nil, err
+	}
+
+	return bandplan.NewPowerLimits(limits)
+}
+
+// pollingFromConfig reads the settings of the polled field groups
+// from the config file. Missing values are set to their defaults
+// by the server.
+func pollingFromConfig() (map[string]server.PollGroup, error) {
+
+	polling := map[string]server.PollGroup{}
+	if err := viper.UnmarshalKey("radio.polling", &polling); err != nil {
+		return nil, err
+	}
+
+	return polling, nil
+}
+
+// influxFromConfig reads the settings of the InfluxDB export from the
+// config file. If no url is configured, the export is disabled and nil
+// is returned.
+func influxFromConfig() (*influx.Settings, time.Duration) {
+
+	if len(viper.GetString("influx.url")) == 0 {
+		return nil, 0
+	}
+
+	s := &influx.Settings{
+		URL:           viper.GetString("influx.url"),
+		Token:         viper.GetString("influx.token"),
+		BatchSize:     viper.GetInt("influx.batch-size"),
+		FlushInterval: viper.GetDuration("influx.flush-interval"),
+		BufferSize:    viper.GetInt("influx.buffer-size"),
+		Tags: map[string]string{
+			"station": viper.GetString("mqtt.station"),
+			"radio":   viper.GetString("mqtt.radio"),
+		},
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+	}
+	if s.FlushInterval <= 0 {
+		s.FlushInterval = time.Second
+	}
+	if s.BufferSize < s.BatchSize {
+		s.BufferSize = 10000
+	}
+
+	meterInterval := time.Second
+	if viper.IsSet("influx.meter-interval") {
+		meterInterval = viper.GetDuration("influx.meter-interval")
+	}
+
+	return s, meterInterval
+}
+
+// homeAssistantFromConfig reads the settings of the Home Assistant
+// integration from the config file. If the integration is disabled,
+// nil is returned.
+func homeAssistantFromConfig(baseTopic string, worker bool) *homeassistant.Settings {
+
+	if !viper.GetBool("homeassistant.enabled") {
+		return nil
+	}
+
+	s := &homeassistant.Settings{
+		Prefix:     viper.GetString("homeassistant.prefix"),
+		BaseTopic:  baseTopic,
+		Functions:  viper.GetStringSlice("homeassistant.functions"),
+		PttSwitch:  viper.GetBool("homeassistant.ptt-switch"),
+		PttTimeout: viper.GetDuration("homeassistant.ptt-timeout"),
+		Version:    version,
+	}
+
+	if len(s.Prefix) == 0 {
+		s.Prefix = homeassistant.DefaultPrefix
+	}
+
+	if s.PttTimeout <= 0 {
+		s.PttTimeout = homeassistant.DefaultPttTimeout
+	}
+
+	if worker {
+		s.Station = station.Topic(viper.GetString("mqtt.station"))
+	}
+
+	return s
+}
+
 func createLastWillMsg() ([]byte, error) {
 
 	willMsg := sbStatus.Status{}
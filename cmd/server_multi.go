@@ -0,0 +1,473 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/serverstatus"
+	"github.com/dh1tw/gorigctl/station"
+	"github.com/dh1tw/gorigctl/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// radioFlags are the settings of the radio server which can be set
+// in each [[radio]] section of the config file
+var radioFlags = []string{
+	"rig-model",
+	"baudrate",
+	"portname",
+	"databits",
+	"stopbits",
+	"parity",
+	"handshake",
+	"hl-debug-level",
+	"polling-interval",
+	"sync-interval",
+	"snapshot-interval",
+	"rig-timeout",
+	"metrics-listen",
+}
+
+// workerRestartDelay is the time after which a worker process which
+// has exited unexpectedly is restarted
+const workerRestartDelay = time.Second * 5
+
+// radioSections returns the [[radio]] sections of the config file.
+// If the config file contains a single [radio] table, nil is returned.
+func radioSections() ([]map[string]interface{}, error) {
+
+	list, ok := viper.Get("radio").([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	sections := []map[string]interface{}{}
+	names := map[string]bool{}
+
+	for i, el := range list {
+		section, ok := el.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("[[radio]] section %d is not a table", i+1)
+		}
+		name, _ := section["name"].(string)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("[[radio]] section %d has no name", i+1)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("radio %s is defined twice", name)
+		}
+		names[name] = true
+		sections = append(sections, section)
+	}
+
+	return sections, nil
+}
+
+// applyRadioSection turns the settings of the n-th [[radio]] section
+// into the radio settings of a worker process. Settings which are not
+// contained in the section are taken from the flags.
+func applyRadioSection(cmd *cobra.Command, n int) error {
+
+	sections, err := radioSections()
+	if err != nil {
+		return err
+	}
+
+	if n >= len(sections) {
+		return fmt.Errorf("[[radio]] section %d not found", n+1)
+	}
+
+	settings := map[string]interface{}{}
+	for _, flag := range radioFlags {
+		settings[flag] = cmd.Flags().Lookup(flag).Value.String()
+	}
+	for key, value := range sections[n] {
+		settings[key] = value
+	}
+
+	name := settings["name"].(string)
+
+	viper.Set("radio", settings)
+	viper.Set("mqtt.radio", name)
+
+	// each radio writes its own audit trail
+	if file := viper.GetString("audit.file"); len(file) > 0 {
+		ext := filepath.Ext(file)
+		viper.Set("audit.file", strings.TrimSuffix(file, ext)+"-"+name+ext)
+	}
+
+	return nil
+}
+
+// radioWorker is a process which serves one radio of a multi-radio
+// server. Since hamlib can only handle one rig per process, each radio
+// is served by a separate process. The MQTT connection is shared; the
+// messages are exchanged through the worker's stdin and stdout.
+type radioWorker struct {
+	index     int
+	name      string
+	rigModel  int
+	baseTopic string
+	process   *os.Process
+	in        chan comms.PipeMsg
+	running   bool
+}
+
+type workerExit struct {
+	worker *radioWorker
+	err    error
+}
+
+// start launches the worker process with the same command line as
+// the server process
+func (w *radioWorker) start(logger *log.Logger, toWireCh chan comms.IOMsg, exitCh chan workerExit) error {
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{}, os.Args[1:]...)
+	args = append(args, "--worker", strconv.Itoa(w.index))
+	c := exec.Command(exe, args...)
+	c.Stderr = os.Stderr
+
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	w.process = c.Process
+	w.running = true
+	w.in = make(chan comms.PipeMsg, 50)
+
+	go func(in chan comms.PipeMsg) {
+		enc := json.NewEncoder(stdin)
+		for msg := range in {
+			if err := enc.Encode(msg); err != nil {
+				logger.Println(w.name+":", err)
+			}
+		}
+		stdin.Close()
+	}(w.in)
+
+	go func() {
+		scanner := comms.NewPipeScanner(stdout)
+		for scanner.Scan() {
+			msg := comms.PipeMsg{}
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				logger.Println(w.name+":", err)
+				continue
+			}
+			toWireCh <- msg.IOMsg()
+		}
+		exitCh <- workerExit{w, c.Wait()}
+	}()
+
+	return nil
+}
+
+// send passes a message to the worker. If the worker doesn't keep up,
+// the message is dropped and false is returned.
+func (w *radioWorker) send(msg comms.PipeMsg) bool {
+
+	if w.in == nil {
+		return false
+	}
+
+	select {
+	case w.in <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop closes the worker's stdin, which makes the worker shut down
+func (w *radioWorker) stop() {
+	if w.in != nil {
+		close(w.in)
+		w.in = nil
+	}
+}
+
+// multiRadioServer starts a worker process for each [[radio]] section
+// and connects them to the MQTT broker
+func multiRadioServer(cmd *cobra.Command, sections []map[string]interface{}) {
+
+	mqttBrokerURL := viper.GetString("mqtt.broker-url")
+	mqttBrokerPort := viper.GetInt("mqtt.broker-port")
+	mqttUsername := viper.GetString("mqtt.username")
+	mqttPassword := viper.GetString("mqtt.password")
+	mqttClientID := viper.GetString("mqtt.client-id")
+
+	if mqttClientID == "gorigctl-svr" {
+		mqttClientID = mqttClientID + "-" + utils.RandStringRunes(5)
+	}
+
+	stationName := viper.GetString("mqtt.station")
+	stationTopic := station.Topic(stationName)
+
+	defaultRigModel, _ := cmd.Flags().GetInt("rig-model")
+
+	workers := []*radioWorker{}
+	mqttRxTopics := []string{}
+
+	for i, section := range sections {
+		w := &radioWorker{
+			index:     i,
+			name:      section["name"].(string),
+			rigModel:  defaultRigModel,
+			baseTopic: stationName + "/radios/" + section["name"].(string) + "/cat",
+		}
+		if rigModel, ok := section["rig-model"].(int64); ok {
+			w.rigModel = int(rigModel)
+		}
+		workers = append(workers, w)
+		mqttRxTopics = append(mqttRxTopics, serverRxTopics(w.baseTopic)...)
+	}
+
+	stationStatus := func(online bool) ([]byte, error) {
+		s := station.Status{Online: online}
+		for _, w := range workers {
+			s.Radios = append(s.Radios, station.Radio{
+				Name:     w.name,
+				RigModel: w.rigModel,
+				Running:  w.running,
+			})
+		}
+		return s.Marshal()
+	}
+
+	toWireCh := make(chan comms.IOMsg, 20)
+	forwardCh := make(chan comms.IOMsg, 50)
+
+	// Event PubSub
+	evPS := pubsub.New(100)
+
+	// WaitGroup to coordinate a graceful shutdown
+	var wg sync.WaitGroup
+
+	willMsg, err := stationStatus(false)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	lastWill := comms.LastWill{
+		Topic:  stationTopic,
+		Data:   willMsg,
+		Qos:    0,
+		Retain: true,
+	}
+
+	appLogger := utils.NewStdLogger("", log.Ltime)
+
+	mqttSettings := comms.MqttSettings{
+		WaitGroup:  &wg,
+		Transport:  "tcp",
+		BrokerURL:  mqttBrokerURL,
+		BrokerPort: mqttBrokerPort,
+		ClientID:   mqttClientID,
+		Username:   mqttUsername,
+		Password:   mqttPassword,
+		Topics:     mqttRxTopics,
+		ForwardCh:  forwardCh,
+		ToWire:     toWireCh,
+		Events:     evPS,
+		LastWill:   &lastWill,
+		Logger:     appLogger,
+	}
+
+	sendStationStatus := func(online bool) {
+		data, err := stationStatus(online)
+		if err != nil {
+			appLogger.Println(err)
+			return
+		}
+		toWireCh <- comms.IOMsg{
+			Topic:  stationTopic,
+			Data:   data,
+			Retain: true,
+		}
+	}
+
+	wg.Add(2) //MQTT + Events
+
+	connectionStatusCh := evPS.Sub(events.MqttConnStatus)
+	shutdownCh := evPS.Sub(events.Shutdown)
+	prepareShutdownCh := evPS.Sub(events.PrepareShutdown)
+	appLoggingCh := evPS.Sub(events.AppLog)
+
+	go events.WatchSystemEvents(evPS, &wg)
+	go comms.MqttClient(mqttSettings)
+
+	exitCh := make(chan workerExit, len(workers))
+	restartCh := make(chan *radioWorker, len(workers))
+	connStatus := comms.DISCONNECTED
+	shuttingDown := false
+	finished := false
+	var shutdownTimeout <-chan time.Time
+
+	restartLater := func(w *radioWorker) {
+		time.AfterFunc(workerRestartDelay, func() {
+			restartCh <- w
+		})
+	}
+
+	start := func(w *radioWorker) {
+		if err := w.start(appLogger, toWireCh, exitCh); err != nil {
+			appLogger.Printf("%s: unable to start worker: %v\n", w.name, err)
+			restartLater(w)
+			return
+		}
+		status := connStatus
+		w.send(comms.PipeMsg{ConnStatus: &status})
+		if connStatus == comms.CONNECTED {
+			sendStationStatus(true)
+		}
+	}
+
+	running := func() bool {
+		for _, w := range workers {
+			if w.running {
+				return true
+			}
+		}
+		return false
+	}
+
+	finish := func() {
+		if finished {
+			return
+		}
+		finished = true
+		sendStationStatus(false)
+		time.Sleep(time.Millisecond * 100)
+		// inform the other goroutines to shut down
+		evPS.Pub(true, events.Shutdown)
+	}
+
+	for _, w := range workers {
+		appLogger.Printf("starting worker for radio %s (%s)\n", w.name, w.baseTopic)
+		start(w)
+	}
+
+	for {
+		select {
+		case <-prepareShutdownCh:
+			// closing the pipes makes the workers shut down
+			shuttingDown = true
+			for _, w := range workers {
+				w.stop()
+			}
+			if !running() {
+				finish()
+			}
+			shutdownTimeout = time.After(time.Second * 2)
+
+		case <-shutdownTimeout:
+			for _, w := range workers {
+				if w.running {
+					appLogger.Printf("%s: worker didn't stop; killing it\n", w.name)
+					w.process.Kill()
+				}
+			}
+			finish()
+
+		// shutdown the application gracefully
+		case <-shutdownCh:
+			//force exit after 1 sec
+			exitTimeout := time.NewTimer(time.Second)
+			go func() {
+				<-exitTimeout.C
+				fmt.Println("quitting forcefully")
+				os.Exit(0)
+			}()
+
+			wg.Wait()
+			os.Exit(0)
+
+		case msg := <-appLoggingCh:
+			fmt.Println(msg.(string))
+
+		case msg := <-forwardCh:
+			for _, w := range workers {
+				if !strings.HasPrefix(msg.Topic, w.baseTopic+"/") {
+					continue
+				}
+				if !w.send(comms.NewPipeMsg(msg)) && w.running {
+					appLogger.Printf("%s: worker busy; dropped message on %s\n", w.name, msg.Topic)
+				}
+			}
+
+		case ev := <-connectionStatusCh:
+			connStatus = ev.(int)
+			for _, w := range workers {
+				status := connStatus
+				w.send(comms.PipeMsg{ConnStatus: &status})
+			}
+			if connStatus == comms.CONNECTED {
+				sendStationStatus(true)
+			}
+
+		case ex := <-exitCh:
+			w := ex.worker
+			w.running = false
+			w.stop()
+
+			if shuttingDown {
+				if !running() {
+					finish()
+				}
+				continue
+			}
+
+			appLogger.Printf("%s: worker exited (%v); restarting in %v\n", w.name, ex.err, workerRestartDelay)
+
+			// the worker had no chance to announce that it is offline
+			if data, err := createLastWillMsg(); err == nil {
+				toWireCh <- comms.IOMsg{
+					Topic:  w.baseTopic + "/status",
+					Data:   data,
+					Retain: true,
+				}
+			}
+			offline := serverstatus.Status{Online: false}
+			if data, err := offline.Marshal(); err == nil {
+				toWireCh <- comms.IOMsg{
+					Topic:  serverstatus.Topic(w.baseTopic),
+					Data:   data,
+					Retain: true,
+				}
+			}
+			sendStationStatus(connStatus == comms.CONNECTED)
+			restartLater(w)
+
+		case w := <-restartCh:
+			if !shuttingDown {
+				start(w)
+			}
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/cskr/pubsub"
 	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/metrics"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
@@ -26,13 +27,28 @@ type MqttSettings struct {
 	ToDeserializeCapabilitiesCh chan []byte
 	ToDeserializeCapsReqCh      chan []byte
 	ToDeserializeStatusCh       chan []byte
+	ToDeserializeServerStatusCh chan []byte
+	ToDeserializeStationCh      chan []byte // status of a multi-radio server
 	ToDeserializePingRequestCh  chan []byte
 	ToDeserializePingResponseCh chan []byte
 	ToDeserializeLogCh          chan []byte
+	ToDeserializePresenceCh     chan []byte
+	ToDeserializeAlarmAckCh     chan []byte
+	ToDeserializePollingReqCh   chan []byte
+	ToDeserializeStateDeltaCh   chan []byte
+	ToDeserializeStateReqCh     chan []byte
+	ToDeserializeMetersCh       chan []byte
+	ToDeserializeRigStatusCh    chan []byte
+	ToDeserializeChatCh         chan []byte
+	ToDeserializeClientPingCh   chan []byte
+	ToDeserializeClientPongCh   chan []byte
+	ToDeserializeHaCommandCh    chan IOMsg // commands of Home Assistant; the topic identifies the switch
+	ForwardCh                   chan IOMsg // if set, received messages are not routed
 	ToWire                      chan IOMsg
 	Events                      *pubsub.PubSub
 	LastWill                    *LastWill
 	Logger                      *log.Logger
+	Metrics                     *metrics.Registry // counts the messages per topic (optional)
 }
 
 // LastWill defines the LastWill for MQTT. The LastWill will be
@@ -75,39 +91,17 @@ func MqttClient(s MqttSettings) {
 
 	var msgHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 
-		if strings.Contains(msg.Topic(), "cat/setstate") {
-
-			s.ToDeserializeCatRequestCh <- msg.Payload()[:len(msg.Payload())]
-
-		} else if strings.Contains(msg.Topic(), "cat/state") {
-
-			s.ToDeserializeCatResponseCh <- msg.Payload()[:len(msg.Payload())]
-
-		} else if strings.HasSuffix(msg.Topic(), "cat/caps") {
-
-			s.ToDeserializeCapabilitiesCh <- msg.Payload()[:len(msg.Payload())]
-
-		} else if strings.HasSuffix(msg.Topic(), "cat/capsreq") {
-
-			s.ToDeserializeCapsReqCh <- msg.Payload()[:len(msg.Payload())]
-
-		} else if strings.Contains(msg.Topic(), "cat/status") {
-
-			s.ToDeserializeStatusCh <- msg.Payload()[:len(msg.Payload())]
-
-		} else if strings.Contains(msg.Topic(), "cat/ping") {
-
-			s.ToDeserializePingRequestCh <- msg.Payload()[:len(msg.Payload())]
-
-		} else if strings.Contains(msg.Topic(), "cat/pong") {
-
-			s.ToDeserializePingResponseCh <- msg.Payload()[:len(msg.Payload())]
-
-		} else if strings.Contains(msg.Topic(), "cat/log") {
-
-			s.ToDeserializeLogCh <- msg.Payload()[:len(msg.Payload())]
+		if s.ForwardCh != nil {
+			s.ForwardCh <- IOMsg{
+				Topic:  msg.Topic(),
+				Data:   msg.Payload(),
+				Retain: msg.Retained(),
+				Qos:    msg.Qos(),
+			}
+			return
 		}
 
+		s.route(msg.Topic(), msg.Payload())
 	}
 
 	var connectionLostHandler = func(client mqtt.Client, err error) {
@@ -162,6 +156,7 @@ func MqttClient(s MqttSettings) {
 			}
 			return
 		case msg := <-s.ToWire:
+			s.Metrics.Inc(metrics.MqttSent, metrics.Labels{"topic": metrics.TopicLabel(msg.Topic)})
 			token := client.Publish(msg.Topic, msg.Qos, msg.Retain, msg.Data)
 			token.WaitTimeout(time.Millisecond * 100)
 			token.Wait()
@@ -172,3 +167,95 @@ func MqttClient(s MqttSettings) {
 		}
 	}
 }
+
+// route hands a received message over to the deserialization channel
+// which corresponds to its topic
+func (s *MqttSettings) route(topic string, payload []byte) {
+
+	s.Metrics.Inc(metrics.MqttReceived, metrics.Labels{"topic": metrics.TopicLabel(topic)})
+
+	if strings.Contains(topic, "cat/ha/set/") {
+
+		s.ToDeserializeHaCommandCh <- IOMsg{Topic: topic, Data: payload}
+
+	} else if strings.Contains(topic, "cat/setstate") {
+
+		s.ToDeserializeCatRequestCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/statedelta") {
+
+		s.ToDeserializeStateDeltaCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/statereq") {
+
+		s.ToDeserializeStateReqCh <- payload
+
+	} else if strings.Contains(topic, "cat/state") {
+
+		s.ToDeserializeCatResponseCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/caps") {
+
+		s.ToDeserializeCapabilitiesCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/capsreq") {
+
+		s.ToDeserializeCapsReqCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/serverstatus") {
+
+		s.ToDeserializeServerStatusCh <- payload
+
+	} else if strings.Contains(topic, "cat/status") {
+
+		s.ToDeserializeStatusCh <- payload
+
+	} else if strings.Contains(topic, "cat/ping") {
+
+		s.ToDeserializePingRequestCh <- payload
+
+	} else if strings.Contains(topic, "cat/pong") {
+
+		s.ToDeserializePingResponseCh <- payload
+
+	} else if strings.Contains(topic, "cat/log") {
+
+		s.ToDeserializeLogCh <- payload
+
+	} else if strings.Contains(topic, "cat/presence") {
+
+		s.ToDeserializePresenceCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/setpolling") {
+
+		s.ToDeserializePollingReqCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/alarmack") {
+
+		s.ToDeserializeAlarmAckCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/meters") {
+
+		s.ToDeserializeMetersCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/rigstatus") {
+
+		s.ToDeserializeRigStatusCh <- payload
+
+	} else if strings.Contains(topic, "cat/clientping/") {
+
+		s.ToDeserializeClientPingCh <- payload
+
+	} else if strings.HasSuffix(topic, "cat/clientpong") {
+
+		s.ToDeserializeClientPongCh <- payload
+
+	} else if strings.HasSuffix(topic, "/radios/status") {
+
+		s.ToDeserializeStationCh <- payload
+
+	} else if strings.Contains(topic, "/chat/") {
+
+		s.ToDeserializeChatCh <- payload
+	}
+}
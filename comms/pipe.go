@@ -0,0 +1,99 @@
+package comms
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/metrics"
+)
+
+// maxPipeMsgSize is the maximum size of an encoded PipeMsg. The
+// capabilities of a radio are the largest messages.
+const maxPipeMsgSize = 4 * 1024 * 1024
+
+// PipeMsg is exchanged between a server process which owns the MQTT
+// connection and its radio worker processes. Each message is encoded
+// as one line of JSON. It either carries an IOMsg or, if ConnStatus is
+// set, the status of the connection to the broker.
+type PipeMsg struct {
+	Topic      string `json:"topic,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+	Retain     bool   `json:"retain,omitempty"`
+	Qos        byte   `json:"qos,omitempty"`
+	ConnStatus *int   `json:"conn_status,omitempty"`
+}
+
+// NewPipeMsg wraps an IOMsg for the pipe
+func NewPipeMsg(msg IOMsg) PipeMsg {
+	return PipeMsg{
+		Topic:  msg.Topic,
+		Data:   msg.Data,
+		Retain: msg.Retain,
+		Qos:    msg.Qos,
+	}
+}
+
+// IOMsg returns the IOMsg carried by the PipeMsg
+func (p *PipeMsg) IOMsg() IOMsg {
+	return IOMsg{
+		Topic:  p.Topic,
+		Data:   p.Data,
+		Retain: p.Retain,
+		Qos:    p.Qos,
+	}
+}
+
+// NewPipeScanner returns a scanner which splits the pipe into
+// encoded PipeMsgs
+func NewPipeScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxPipeMsgSize)
+	return scanner
+}
+
+// PipeClient replaces MqttClient in a radio worker process. Messages
+// which the server process received from the broker are read from in
+// and routed like in MqttClient. Messages for the broker are written
+// to out. When in is closed, a shutdown is initiated.
+func PipeClient(s MqttSettings, in io.Reader, out io.Writer) {
+
+	defer s.WaitGroup.Done()
+
+	shutdownCh := s.Events.Sub(events.Shutdown)
+
+	go func() {
+		scanner := NewPipeScanner(in)
+		for scanner.Scan() {
+			msg := PipeMsg{}
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				s.Logger.Println("pipe:", err)
+				continue
+			}
+			if msg.ConnStatus != nil {
+				s.Events.Pub(*msg.ConnStatus, events.MqttConnStatus)
+				continue
+			}
+			s.route(msg.Topic, msg.Data)
+		}
+		if err := scanner.Err(); err != nil {
+			s.Logger.Println("pipe:", err)
+		}
+		s.Events.Pub(true, events.PrepareShutdown)
+	}()
+
+	enc := json.NewEncoder(out)
+
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case msg := <-s.ToWire:
+			s.Metrics.Inc(metrics.MqttSent, metrics.Labels{"topic": metrics.TopicLabel(msg.Topic)})
+			if err := enc.Encode(NewPipeMsg(msg)); err != nil {
+				s.Logger.Println("pipe:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package delta
+
+import (
+	"encoding/json"
+	"hash/fnv"
+
+	"github.com/dh1tw/gorigctl/bandplan"
+	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+)
+
+// Delta contains only the fields of the radio's state which have changed
+// since the previous message. Each message carries a sequence number so
+// that clients can detect lost messages and request a full snapshot.
+// A snapshot is a Delta with Full set and all fields populated.
+type Delta struct {
+	Seq             uint64             `json:"seq"`
+	Full            bool               `json:"full,omitempty"`
+	CurrentVfo      *string            `json:"current_vfo,omitempty"`
+	Frequency       *float64           `json:"frequency,omitempty"`
+	Mode            *string            `json:"mode,omitempty"`
+	PbWidth         *int32             `json:"pb_width,omitempty"`
+	Ant             *int32             `json:"ant,omitempty"`
+	Rit             *int32             `json:"rit,omitempty"`
+	Xit             *int32             `json:"xit,omitempty"`
+	Split           *sbRadio.Split     `json:"split,omitempty"`
+	TuningStep      *int32             `json:"tuning_step,omitempty"`
+	Functions       map[string]bool    `json:"functions,omitempty"`
+	Levels          map[string]float32 `json:"levels,omitempty"`
+	Parameters      map[string]float32 `json:"parameters,omitempty"`
+	RadioOn         *bool              `json:"radio_on,omitempty"`
+	Ptt             *bool              `json:"ptt,omitempty"`
+	PollingInterval *int32             `json:"polling_interval,omitempty"`
+	SyncInterval    *int32             `json:"sync_interval,omitempty"`
+	// RFPOWER limit for the current transmit frequency (if the server
+	// has power limits configured)
+	PowerLimit *bandplan.ActivePowerLimit `json:"power_limit,omitempty"`
+	Ack        *Ack                       `json:"ack,omitempty"` // request which has been executed before this update
+}
+
+// Ack confirms that a request (sbRadio.SetState) has been executed by
+// the server. Together with the time when the request was sent, clients
+// can determine the end-to-end latency of commands.
+type Ack struct {
+	UserID    string `json:"user_id"`
+	RequestID uint64 `json:"request_id"` // see RequestID
+	Queued    int64  `json:"queued"`     // [µs] time the request waited for the rig
+	Applied   int64  `json:"applied"`    // [µs] time the rig needed to execute the request
+	// fields of the request which have been rejected (e.g. by the band
+	// plan) or failed, as "<field>: <reason>"
+	Errors []string `json:"errors,omitempty"`
+}
+
+// RequestID identifies a request in an Ack. SetState (defined in the
+// ICD) doesn't carry an ID; instead the FNV-1a hash of the request as
+// sent on the wire is used. Identical requests have the same ID.
+func RequestID(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// Marshal encodes the delta for the wire
+func (d *Delta) Marshal() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+// Unmarshal decodes a delta received from the wire
+func (d *Delta) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, d)
+}
+
+// Empty returns true if the delta doesn't contain any changes
+func (d *Delta) Empty() bool {
+	return !d.Full &&
+		d.CurrentVfo == nil &&
+		d.Frequency == nil &&
+		d.Mode == nil &&
+		d.PbWidth == nil &&
+		d.Ant == nil &&
+		d.Rit == nil &&
+		d.Xit == nil &&
+		d.Split == nil &&
+		d.TuningStep == nil &&
+		len(d.Functions) == 0 &&
+		len(d.Levels) == 0 &&
+		len(d.Parameters) == 0 &&
+		d.RadioOn == nil &&
+		d.Ptt == nil &&
+		d.PollingInterval == nil &&
+		d.SyncInterval == nil &&
+		d.PowerLimit == nil &&
+		d.Ack == nil
+}
+
+// Snapshot returns a delta containing the complete state
+func Snapshot(s *sbRadio.State) Delta {
+
+	c := Copy(s)
+
+	d := Delta{
+		Full:            true,
+		CurrentVfo:      &c.CurrentVfo,
+		Frequency:       &c.Vfo.Frequency,
+		Mode:            &c.Vfo.Mode,
+		PbWidth:         &c.Vfo.PbWidth,
+		Ant:             &c.Vfo.Ant,
+		Rit:             &c.Vfo.Rit,
+		Xit:             &c.Vfo.Xit,
+		Split:           c.Vfo.Split,
+		TuningStep:      &c.Vfo.TuningStep,
+		Functions:       c.Vfo.Functions,
+		Levels:          c.Vfo.Levels,
+		Parameters:      c.Vfo.Parameters,
+		RadioOn:         &c.RadioOn,
+		Ptt:             &c.Ptt,
+		PollingInterval: &c.PollingInterval,
+		SyncInterval:    &c.SyncInterval,
+	}
+
+	return d
+}
+
+// Diff returns the changes from the old to the new state. Removed functions,
+// levels or parameters can not be expressed as a delta; in this case
+// ok is false and a snapshot has to be sent instead.
+func Diff(old, new *sbRadio.State) (d Delta, ok bool) {
+
+	o := Copy(old)
+	n := Copy(new)
+
+	if n.CurrentVfo != o.CurrentVfo {
+		d.CurrentVfo = &n.CurrentVfo
+	}
+	if n.Vfo.Frequency != o.Vfo.Frequency {
+		d.Frequency = &n.Vfo.Frequency
+	}
+	if n.Vfo.Mode != o.Vfo.Mode {
+		d.Mode = &n.Vfo.Mode
+	}
+	if n.Vfo.PbWidth != o.Vfo.PbWidth {
+		d.PbWidth = &n.Vfo.PbWidth
+	}
+	if n.Vfo.Ant != o.Vfo.Ant {
+		d.Ant = &n.Vfo.Ant
+	}
+	if n.Vfo.Rit != o.Vfo.Rit {
+		d.Rit = &n.Vfo.Rit
+	}
+	if n.Vfo.Xit != o.Vfo.Xit {
+		d.Xit = &n.Vfo.Xit
+	}
+	if !splitEqual(n.Vfo.Split, o.Vfo.Split) {
+		d.Split = n.Vfo.Split
+	}
+	if n.Vfo.TuningStep != o.Vfo.TuningStep {
+		d.TuningStep = &n.Vfo.TuningStep
+	}
+	if n.RadioOn != o.RadioOn {
+		d.RadioOn = &n.RadioOn
+	}
+	if n.Ptt != o.Ptt {
+		d.Ptt = &n.Ptt
+	}
+	if n.PollingInterval != o.PollingInterval {
+		d.PollingInterval = &n.PollingInterval
+	}
+	if n.SyncInterval != o.SyncInterval {
+		d.SyncInterval = &n.SyncInterval
+	}
+
+	for name := range o.Vfo.Functions {
+		if _, found := n.Vfo.Functions[name]; !found {
+			return d, false
+		}
+	}
+	for name, value := range n.Vfo.Functions {
+		if oldValue, found := o.Vfo.Functions[name]; !found || oldValue != value {
+			if d.Functions == nil {
+				d.Functions = make(map[string]bool)
+			}
+			d.Functions[name] = value
+		}
+	}
+
+	for name := range o.Vfo.Levels {
+		if _, found := n.Vfo.Levels[name]; !found {
+			return d, false
+		}
+	}
+	for name, value := range n.Vfo.Levels {
+		if oldValue, found := o.Vfo.Levels[name]; !found || oldValue != value {
+			if d.Levels == nil {
+				d.Levels = make(map[string]float32)
+			}
+			d.Levels[name] = value
+		}
+	}
+
+	for name := range o.Vfo.Parameters {
+		if _, found := n.Vfo.Parameters[name]; !found {
+			return d, false
+		}
+	}
+	for name, value := range n.Vfo.Parameters {
+		if oldValue, found := o.Vfo.Parameters[name]; !found || oldValue != value {
+			if d.Parameters == nil {
+				d.Parameters = make(map[string]float32)
+			}
+			d.Parameters[name] = value
+		}
+	}
+
+	return d, true
+}
+
+// Apply writes the fields contained in the delta to the state. A full
+// snapshot replaces the state entirely.
+func (d *Delta) Apply(s *sbRadio.State) {
+
+	if d.Full {
+		*s = Copy(&sbRadio.State{})
+	} else {
+		*s = Copy(s)
+	}
+
+	if d.CurrentVfo != nil {
+		s.CurrentVfo = *d.CurrentVfo
+	}
+	if d.Frequency != nil {
+		s.Vfo.Frequency = *d.Frequency
+	}
+	if d.Mode != nil {
+		s.Vfo.Mode = *d.Mode
+	}
+	if d.PbWidth != nil {
+		s.Vfo.PbWidth = *d.PbWidth
+	}
+	if d.Ant != nil {
+		s.Vfo.Ant = *d.Ant
+	}
+	if d.Rit != nil {
+		s.Vfo.Rit = *d.Rit
+	}
+	if d.Xit != nil {
+		s.Vfo.Xit = *d.Xit
+	}
+	if d.Split != nil {
+		split := *d.Split
+		s.Vfo.Split = &split
+	}
+	if d.TuningStep != nil {
+		s.Vfo.TuningStep = *d.TuningStep
+	}
+	for name, value := range d.Functions {
+		s.Vfo.Functions[name] = value
+	}
+	for name, value := range d.Levels {
+		s.Vfo.Levels[name] = value
+	}
+	for name, value := range d.Parameters {
+		s.Vfo.Parameters[name] = value
+	}
+	if d.RadioOn != nil {
+		s.RadioOn = *d.RadioOn
+	}
+	if d.Ptt != nil {
+		s.Ptt = *d.Ptt
+	}
+	if d.PollingInterval != nil {
+		s.PollingInterval = *d.PollingInterval
+	}
+	if d.SyncInterval != nil {
+		s.SyncInterval = *d.SyncInterval
+	}
+}
+
+func splitEqual(a, b *sbRadio.Split) bool {
+	return a.Enabled == b.Enabled &&
+		a.Vfo == b.Vfo &&
+		a.Frequency == b.Frequency &&
+		a.Mode == b.Mode &&
+		a.PbWidth == b.PbWidth
+}
+
+// Copy returns a deep copy of the state. Nil members are initialized.
+func Copy(s *sbRadio.State) sbRadio.State {
+
+	c := sbRadio.State{
+		CurrentVfo:      s.CurrentVfo,
+		RadioOn:         s.RadioOn,
+		Ptt:             s.Ptt,
+		PollingInterval: s.PollingInterval,
+		SyncInterval:    s.SyncInterval,
+		Channel:         &sbRadio.Channel{},
+		Vfo:             &sbRadio.Vfo{},
+	}
+
+	if s.Channel != nil {
+		*c.Channel = *s.Channel
+	}
+
+	if s.Vfo != nil {
+		*c.Vfo = *s.Vfo
+	}
+
+	c.Vfo.Split = &sbRadio.Split{}
+	if s.Vfo != nil && s.Vfo.Split != nil {
+		*c.Vfo.Split = *s.Vfo.Split
+	}
+
+	c.Vfo.Functions = make(map[string]bool)
+	c.Vfo.Levels = make(map[string]float32)
+	c.Vfo.Parameters = make(map[string]float32)
+
+	if s.Vfo != nil {
+		for name, value := range s.Vfo.Functions {
+			c.Vfo.Functions[name] = value
+		}
+		for name, value := range s.Vfo.Levels {
+			c.Vfo.Levels[name] = value
+		}
+		for name, value := range s.Vfo.Parameters {
+			c.Vfo.Parameters[name] = value
+		}
+	}
+
+	return c
+}
@@ -0,0 +1,232 @@
+package discovery
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/events"
+	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+	sbStatus "github.com/dh1tw/gorigctl/sb_status"
+	"github.com/dh1tw/gorigctl/serverstatus"
+	"github.com/dh1tw/gorigctl/station"
+)
+
+// Topics to which Discover subscribes
+const (
+	StatusTopic       = "+/radios/+/cat/status"
+	ServerStatusTopic = "+/radios/+/cat/serverstatus"
+	CapsTopic         = "+/radios/+/cat/caps"
+	StationTopic      = "+/radios/status" // multi-radio servers
+)
+
+// Radio is a radio which has been found on the broker. Servers of
+// older versions don't publish their server status; their version and
+// the time when they were last seen are unknown.
+type Radio struct {
+	Station      string
+	Radio        string
+	Online       bool
+	Version      string // version of the radio server
+	Manufacturer string
+	Model        string
+	LastSeen     time.Time
+}
+
+// BaseTopic returns the topic under which the radio is available
+func (r *Radio) BaseTopic() string {
+	return r.Station + "/radios/" + r.Radio + "/cat"
+}
+
+// Settings of the MQTT connection used for the discovery
+type Settings struct {
+	BrokerURL  string
+	BrokerPort int
+	Username   string
+	Password   string
+	ClientID   string
+	Duration   time.Duration // time to listen after the connection has been established
+	Logger     *log.Logger
+}
+
+// Discover listens for the status and the capabilities of the radio
+// servers on the broker and returns the radios which are online,
+// sorted by station and radio. The capabilities are requested from
+// each radio which announces that it is online.
+func Discover(s Settings) ([]Radio, error) {
+
+	toWireCh := make(chan comms.IOMsg, 20)
+	forwardCh := make(chan comms.IOMsg, 100)
+
+	evPS := pubsub.New(10)
+	var wg sync.WaitGroup
+
+	mqttSettings := comms.MqttSettings{
+		WaitGroup:  &wg,
+		Transport:  "tcp",
+		BrokerURL:  s.BrokerURL,
+		BrokerPort: s.BrokerPort,
+		ClientID:   s.ClientID,
+		Username:   s.Username,
+		Password:   s.Password,
+		Topics:     []string{StatusTopic, ServerStatusTopic, CapsTopic, StationTopic},
+		ForwardCh:  forwardCh,
+		ToWire:     toWireCh,
+		Events:     evPS,
+		Logger:     s.Logger,
+	}
+
+	connectionStatusCh := evPS.Sub(events.MqttConnStatus)
+	prepareShutdownCh := evPS.Sub(events.PrepareShutdown)
+
+	wg.Add(1)
+	go comms.MqttClient(mqttSettings)
+
+	defer func() {
+		// keep on draining the received messages, otherwise the MQTT
+		// client might block while disconnecting
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-forwardCh:
+				case <-stop:
+					return
+				}
+			}
+		}()
+		evPS.Pub(true, events.Shutdown)
+		wg.Wait()
+		close(stop)
+	}()
+
+	radios := map[string]*Radio{}
+	stations := map[string]station.Status{}
+	var done <-chan time.Time
+
+	for {
+		select {
+		case <-prepareShutdownCh:
+			return nil, errors.New("unable to connect to the MQTT broker")
+
+		case ev := <-connectionStatusCh:
+			if ev.(int) == comms.CONNECTED && done == nil {
+				done = time.After(s.Duration)
+			}
+
+		case msg := <-forwardCh:
+			if name, ok := stationFromTopic(msg.Topic); ok {
+				if len(msg.Data) == 0 {
+					delete(stations, name)
+					continue
+				}
+				status := station.Status{}
+				if err := status.Unmarshal(msg.Data); err != nil {
+					s.Logger.Println(msg.Topic+":", err)
+					continue
+				}
+				stations[name] = status
+				continue
+			}
+			r, kind := radioFromTopic(radios, msg.Topic)
+			if r == nil || len(msg.Data) == 0 {
+				continue
+			}
+			if !msg.Retain {
+				r.LastSeen = time.Now()
+			}
+			switch kind {
+			case "status":
+				status := sbStatus.Status{}
+				if err := status.Unmarshal(msg.Data); err != nil {
+					s.Logger.Println(msg.Topic+":", err)
+					continue
+				}
+				wasOnline := r.Online
+				r.Online = status.Online
+				if r.Online && !wasOnline {
+					toWireCh <- comms.IOMsg{
+						Topic: r.BaseTopic() + "/capsreq",
+						Data:  []byte{'x'},
+					}
+				}
+			case "serverstatus":
+				status := serverstatus.Status{}
+				if err := status.Unmarshal(msg.Data); err != nil {
+					s.Logger.Println(msg.Topic+":", err)
+					continue
+				}
+				r.Version = status.Version
+				if status.Timestamp > 0 && status.Time().After(r.LastSeen) {
+					r.LastSeen = status.Time()
+				}
+			case "caps":
+				caps := sbRadio.Capabilities{}
+				if err := caps.Unmarshal(msg.Data); err != nil {
+					s.Logger.Println(msg.Topic+":", err)
+					continue
+				}
+				r.Manufacturer = caps.MfgName
+				r.Model = caps.ModelName
+			}
+
+		case <-done:
+			online := []Radio{}
+			for _, r := range radios {
+				// the status of a radio of a multi-radio server is
+				// not cleared if the server crashes
+				if st, ok := stations[r.Station]; ok && !st.RadioOnline(r.Radio) {
+					r.Online = false
+				}
+				if r.Online {
+					online = append(online, *r)
+				}
+			}
+			sort.Slice(online, func(i, j int) bool {
+				if online[i].Station != online[j].Station {
+					return online[i].Station < online[j].Station
+				}
+				return online[i].Radio < online[j].Radio
+			})
+			return online, nil
+		}
+	}
+}
+
+// stationFromTopic returns the station if the topic is the status
+// topic of a multi-radio server
+func stationFromTopic(topic string) (string, bool) {
+
+	// <station>/radios/status
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[1] != "radios" || parts[2] != "status" {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// radioFromTopic returns the radio to which a message belongs and
+// the kind of the message ("status" or "caps")
+func radioFromTopic(radios map[string]*Radio, topic string) (*Radio, string) {
+
+	// <station>/radios/<radio>/cat/<kind>
+	parts := strings.Split(topic, "/")
+	if len(parts) != 5 || parts[1] != "radios" || parts[3] != "cat" {
+		return nil, ""
+	}
+
+	key := parts[0] + "/" + parts[2]
+	r, ok := radios[key]
+	if !ok {
+		r = &Radio{Station: parts[0], Radio: parts[2]}
+		radios[key] = r
+	}
+
+	return r, parts[4]
+}
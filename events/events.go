@@ -23,6 +23,11 @@ const (
 	RadioLog        = "radiolog"       // string
 	RadioOnline     = "radioOnline"    //bool
 	Pong            = "pong"           // int64
+	Operators       = "operators"      // []presence.Presence
+	NetStats        = "netStats"       // ping.NetStats
+	ClientLatency   = "clientLatency"  // map[string]ping.Stats
+	CmdLatency      = "cmdLatency"     // remoteradio.CmdSample
+	RigHealth       = "rigHealth"      // serverstatus.Rig
 )
 
 func WatchSystemEvents(evPS *pubsub.PubSub, wg *sync.WaitGroup) {
@@ -7,7 +7,14 @@ import (
 	"time"
 
 	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/bandplan"
+	"github.com/dh1tw/gorigctl/chat"
 	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/meter"
+	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/presence"
+	"github.com/dh1tw/gorigctl/remoteradio"
+	"github.com/dh1tw/gorigctl/rigstatus"
 	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
 	"github.com/dh1tw/gorigctl/utils"
 	ui "github.com/gizak/termui"
@@ -43,7 +50,16 @@ type radioGui struct {
 	txFrequency          *ui.Par
 	txMode               *ui.Par
 	txFilter             *ui.Par
+	powerLimit           *ui.Par
+	rigStatus            *ui.Par
 	operations           *ui.List
+	operators            *ui.List
+	operatorItems        []string
+	operatorList         []presence.Presence
+	operatorLatency      map[string]ping.Stats
+	cmdLatency           string
+	chat                 *ui.List
+	chatItems            []string
 	log                  *ui.List
 	cli                  *Input
 	state                sbRadio.State
@@ -176,15 +192,32 @@ func (rg *radioGui) init() {
 	rg.txFilter.Height = 3
 	rg.txFilter.BorderLabel = "TX Filter"
 
+	rg.powerLimit = ui.NewPar("")
+	rg.powerLimit.Height = 3
+	rg.powerLimit.BorderLabel = "Power Limit"
+
+	rg.rigStatus = ui.NewPar("")
+	rg.rigStatus.Height = 3
+	rg.rigStatus.BorderLabel = "Rig"
+
 	rg.operations = ui.NewList()
 	rg.operations.Items = []string{}
 	rg.operations.BorderLabel = "Operations"
 	rg.operations.Height = 10
 
+	rg.operators = ui.NewList()
+	rg.operators.Items = rg.operatorItems
+	rg.operators.BorderLabel = "Operators"
+	rg.operators.Height = 2 + len(rg.operatorItems)
+
 	rg.log = ui.NewList()
 	rg.log.Items = []string{}
 	rg.log.BorderLabel = "Logging"
-	rg.log.Height = rg.calcLogWindowHeight()
+
+	rg.chat = ui.NewList()
+	rg.chat.BorderLabel = "Chat"
+
+	rg.setLogHeight(rg.calcLogWindowHeight())
 
 	if rg.cli != nil {
 		if rg.cli.IsCapturing {
@@ -221,10 +254,13 @@ func (rg *radioGui) init() {
 			ui.NewCol(1, 0, rg.split),
 			ui.NewCol(2, 0, rg.txFrequency),
 			ui.NewCol(1, 0, rg.txMode),
-			ui.NewCol(2, 0, rg.txFilter)),
+			ui.NewCol(2, 0, rg.txFilter),
+			ui.NewCol(2, 0, rg.powerLimit),
+			ui.NewCol(2, 0, rg.rigStatus)),
 		ui.NewRow(
-			ui.NewCol(2, 0, rg.functions, rg.operations),
-			ui.NewCol(8, 0, rg.log),
+			ui.NewCol(2, 0, rg.functions, rg.operations, rg.operators),
+			ui.NewCol(5, 0, rg.log),
+			ui.NewCol(3, 0, rg.chat),
 			ui.NewCol(2, 0, rg.levels, rg.parameters)),
 		ui.NewRow(
 			ui.NewCol(12, 0, rg.cli)),
@@ -241,7 +277,7 @@ func (rg *radioGui) calcLogWindowHeight() int {
 
 	height := 0
 
-	leftColumn := rg.functions.Height + rg.operations.Height
+	leftColumn := rg.functions.Height + rg.operations.Height + rg.operators.Height
 	rightColumn := rg.levels.Height + rg.parameters.Height
 	if leftColumn > rightColumn {
 		height = leftColumn
@@ -295,6 +331,10 @@ func (rg *radioGui) updateCaps(ev ui.Event) {
 	rg.functions.Items = SprintFunctions(rg.functionsData)
 
 	for _, level := range rg.caps.GetLevels {
+		// meters are shown in the gauges
+		if meter.IsMeter(level.Name) {
+			continue
+		}
 		lData := GuiLevel{Label: level.Name}
 		rg.levelsData = append(rg.levelsData, lData)
 	}
@@ -318,7 +358,7 @@ func (rg *radioGui) updateCaps(ev ui.Event) {
 
 	rg.operations.Items = rg.caps.VfoOps
 
-	rg.log.Height = rg.calcLogWindowHeight()
+	rg.setLogHeight(rg.calcLogWindowHeight())
 
 	if !rg.caps.HasPowerstat {
 		rg.powerOn.Text = "n/a"
@@ -339,6 +379,36 @@ func (rg *radioGui) addLogEntry(ev ui.Event) {
 	ui.Render(rg.log)
 }
 
+// maxChatItems is the number of chat messages kept by the GUI
+const maxChatItems = 100
+
+func (rg *radioGui) addChatEntry(ev ui.Event) {
+	msg := ev.Data.(chat.Message)
+	rg.chatItems = append(rg.chatItems, msg.String())
+	if len(rg.chatItems) > maxChatItems {
+		rg.chatItems = rg.chatItems[1:]
+	}
+	rg.showChatItems()
+	ui.Render(rg.chat)
+}
+
+// showChatItems shows the latest chat messages which fit into the
+// chat window
+func (rg *radioGui) showChatItems() {
+	items := rg.chatItems
+	if n := rg.chat.Height - 2; n >= 0 && len(items) > n {
+		items = items[len(items)-n:]
+	}
+	rg.chat.Items = items
+}
+
+// setLogHeight sets the height of the log and the chat window
+func (rg *radioGui) setLogHeight(height int) {
+	rg.log.Height = height
+	rg.chat.Height = height
+	rg.showChatItems()
+}
+
 func (rg *radioGui) updateState(ev ui.Event) {
 
 	rg.state = ev.Data.(sbRadio.State)
@@ -385,16 +455,6 @@ func (rg *radioGui) updateGUI() {
 	rg.setPowerOn(rg.caps.HasPowerstat, rg.state.RadioOn)
 	rg.setTuningStep(rg.caps.HasTs, powerOn, rg.state.Vfo.TuningStep)
 
-	ptt := rg.state.Ptt
-
-	if swrValue, ok := rg.state.Vfo.Levels["SWR"]; ok {
-		rg.setSwrMeter(ptt, swrValue)
-	}
-
-	if sMeterValue, ok := rg.state.Vfo.Levels["STRENGTH"]; ok {
-		rg.setSMeter(ptt, sMeterValue)
-	}
-
 	if attValue, ok := rg.state.Vfo.Levels["ATT"]; ok {
 		rg.setAttenuator(true, powerOn, attValue)
 	} else {
@@ -733,6 +793,52 @@ func (rg *radioGui) setParameters(parameters map[string]float32) {
 	ui.Render(rg.parameters)
 }
 
+// updateMeters updates the gauges with the values of the meter stream
+func (rg *radioGui) updateMeters(ev ui.Event) {
+
+	reading := ev.Data.(meter.Reading)
+
+	if !rg.radioOnline {
+		return
+	}
+
+	if swrValue, ok := reading.Values["SWR"]; ok || !reading.Tx {
+		rg.setSwrMeter(reading.Tx, swrValue)
+	}
+
+	if sMeterValue, ok := reading.Values["STRENGTH"]; ok || reading.Tx {
+		rg.setSMeter(reading.Tx, sMeterValue)
+	}
+}
+
+// updatePowerLimit shows the maximum RFPOWER level permitted
+// on the current band
+func (rg *radioGui) updatePowerLimit(ev ui.Event) {
+	pl := ev.Data.(bandplan.ActivePowerLimit)
+	if pl.Active {
+		rg.powerLimit.Text = fmt.Sprintf("%s: %.0f%%", pl.Band, pl.RfPower*100)
+	} else {
+		rg.powerLimit.Text = ""
+	}
+	ui.Render(rg.powerLimit)
+}
+
+// updateRigStatus shows the status of the connection between
+// the server and the rig
+func (rg *radioGui) updateRigStatus(ev ui.Event) {
+	s := ev.Data.(rigstatus.Status)
+	rg.rigStatus.Text = s.State
+	switch s.State {
+	case rigstatus.Connected, "":
+		rg.rigStatus.TextBgColor = ui.ColorDefault
+		rg.rigStatus.Bg = ui.ColorDefault
+	default:
+		rg.rigStatus.TextBgColor = ui.ColorRed
+		rg.rigStatus.Bg = ui.ColorRed
+	}
+	ui.Render(rg.rigStatus)
+}
+
 // updateLatency updates the Latency chart (2 way ping)
 func (rg *radioGui) updateLatency(ev ui.Event) {
 	latency := ev.Data.(int64) / 1000000 // milli seconds
@@ -740,10 +846,78 @@ func (rg *radioGui) updateLatency(ev ui.Event) {
 		rg.latency.Lines[0].Data = rg.latency.Lines[0].Data[2:]
 	}
 	rg.latency.Lines[0].Data = append(rg.latency.Lines[0].Data, int(latency))
-	rg.latency.Lines[0].Title = fmt.Sprintf("%dms", latency)
+	rg.latency.Lines[0].Title = fmt.Sprintf("%dms%s", latency, rg.cmdLatency)
+	ui.Render(rg.latency)
+}
+
+// updateCmdLatency shows the time the last command needed until it
+// was applied by the rig and reported back
+func (rg *radioGui) updateCmdLatency(ev ui.Event) {
+	s := ev.Data.(remoteradio.CmdSample)
+	rg.cmdLatency = fmt.Sprintf(" (%s %dms)", s.Field, s.Total/time.Millisecond)
+}
+
+// updateNetStats shows the jitter and the packet loss of the last
+// seconds and highlights the latency chart when PTT is unsafe
+func (rg *radioGui) updateNetStats(ev ui.Event) {
+	s := ev.Data.(ping.NetStats)
+	if !s.Connected {
+		return
+	}
+	rg.latency.BorderLabel = fmt.Sprintf("Latency ±%dms %.0f%%",
+		s.Short.Jitter/time.Millisecond, s.Short.Loss*100)
+	if s.PttUnsafe {
+		rg.latency.BorderLabel = "Latency: PTT unsafe"
+		rg.latency.BorderFg = ui.ColorRed
+		rg.latency.Lines[0].LineColor = ui.ColorRed | ui.AttrBold
+	} else {
+		rg.latency.BorderFg = ui.ColorWhite
+		rg.latency.Lines[0].LineColor = ui.ColorYellow | ui.AttrBold
+	}
 	ui.Render(rg.latency)
 }
 
+// updateOperators shows the clients which are connected to the radio
+func (rg *radioGui) updateOperators(ev ui.Event) {
+	rg.operatorList = ev.Data.([]presence.Presence)
+	rg.showOperators()
+}
+
+// updateOperatorLatency shows the latency of the operators' links,
+// as measured by the server
+func (rg *radioGui) updateOperatorLatency(ev ui.Event) {
+	rg.operatorLatency = ev.Data.(map[string]ping.Stats)
+	rg.showOperators()
+}
+
+func (rg *radioGui) showOperators() {
+
+	rg.operatorItems = []string{}
+	for _, p := range rg.operatorList {
+		item := fmt.Sprintf("%s (%s)", p.UserID, p.ClientType)
+		if l, ok := rg.operatorLatency[p.UserID]; ok && l.Received > 0 {
+			item = fmt.Sprintf("%s (%s, %dms)", p.UserID, p.ClientType, l.P95/time.Millisecond)
+		}
+		rg.operatorItems = append(rg.operatorItems, item)
+	}
+
+	rg.operators.Items = rg.operatorItems
+
+	// only redraw the list, unless its height changes; a re-layout of
+	// the whole screen with each latency update makes the gui flicker
+	if rg.operators.Height == 2+len(rg.operatorItems) {
+		ui.Render(rg.operators)
+		return
+	}
+
+	rg.operators.Height = 2 + len(rg.operatorItems)
+	rg.setLogHeight(rg.calcLogWindowHeight())
+
+	ui.Clear()
+	ui.Body.Align()
+	ui.Render(ui.Body)
+}
+
 // updateRadioStatus handle the events in case the radio
 // goes offline or becomes online
 func (rg *radioGui) updateRadioStatus(ev ui.Event) {
@@ -756,8 +930,8 @@ func (rg *radioGui) updateRadioStatus(ev ui.Event) {
 		// this is a hack to remove artifacts from the
 		// log widget when the canvas shrinks after
 		// reinitalization
-		rg.log.Height = 10
-		ui.Render(rg.log)
+		rg.setLogHeight(10)
+		ui.Render(rg.log, rg.chat)
 		//reinit canvas
 		rg.init()
 	}
@@ -791,7 +965,15 @@ func Loop(evPS *pubsub.PubSub) {
 	ui.Handle("/radio/state", rg.updateState)
 	ui.Handle("/log/msg", rg.addLogEntry)
 	ui.Handle("/network/latency", rg.updateLatency)
+	ui.Handle("/network/stats", rg.updateNetStats)
+	ui.Handle("/network/cmdlatency", rg.updateCmdLatency)
 	ui.Handle("/radio/status", rg.updateRadioStatus)
+	ui.Handle("/radio/powerlimit", rg.updatePowerLimit)
+	ui.Handle("/radio/rigstatus", rg.updateRigStatus)
+	ui.Handle("/radio/operators", rg.updateOperators)
+	ui.Handle("/radio/latency", rg.updateOperatorLatency)
+	ui.Handle("/chat/msg", rg.addChatEntry)
+	ui.Handle("/radio/meters", rg.updateMeters)
 	ui.Handle("/timer/1s", rg.syncFrequency)
 
 	ui.Handle("/sys/kbd/<up>", func(ui.Event) {
@@ -832,7 +1014,7 @@ func Loop(evPS *pubsub.PubSub) {
 
 	ui.Handle("/sys/kbd/C-c", func(ui.Event) {
 		ui.StopLoop()
-		evPS.Pub(true, events.Shutdown)
+		evPS.Pub(true, events.PrepareShutdown)
 	})
 
 	ui.Handle("/input/kbd", func(ev ui.Event) {
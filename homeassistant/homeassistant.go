@@ -0,0 +1,340 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+	"github.com/dh1tw/gorigctl/serverstatus"
+)
+
+// UserID identifies the requests of Home Assistant (e.g. in the audit
+// trail and the band plan)
+const UserID = "homeassistant"
+
+// DefaultPrefix is Home Assistant's default discovery prefix
+const DefaultPrefix = "homeassistant"
+
+// DefaultPttTimeout is the time after which the PTT is released if it
+// has been keyed from Home Assistant
+const DefaultPttTimeout = time.Minute * 3
+
+const (
+	payloadOn  = "ON"
+	payloadOff = "OFF"
+
+	functionPrefix = "function_"
+)
+
+// Settings of the Home Assistant integration. The server publishes the
+// configs of the entities (retained) on
+// <prefix>/<component>/<node>/<object>/config, its state as JSON on
+// <base>/ha/state and <base>/ha/meters and receives the plain text
+// commands of the switches on <base>/ha/set/<object>.
+type Settings struct {
+	Prefix     string        // discovery prefix
+	BaseTopic  string        // <station>/radios/<radio>/cat
+	Station    string        // status topic of a multi-radio server (optional)
+	Functions  []string      // hamlib functions offered as switches, if the rig supports them
+	PttSwitch  bool          // offer a switch for keying the transmitter
+	PttTimeout time.Duration // release the PTT keyed through the switch (no last will)
+	Version    string        // of gorigctl
+}
+
+// StateTopic is the topic of the radio's state
+func StateTopic(base string) string {
+	return base + "/ha/state"
+}
+
+// MetersTopic is the topic of the meter readings
+func MetersTopic(base string) string {
+	return base + "/ha/meters"
+}
+
+// CommandTopic is the topic on which Home Assistant sends the
+// commands of a switch
+func CommandTopic(base, object string) string {
+	return base + "/ha/set/" + object
+}
+
+// State is published on the StateTopic
+type State struct {
+	RadioOn   bool            `json:"radio_on"`
+	Ptt       bool            `json:"ptt"`
+	Frequency float64         `json:"frequency"` // [Hz]
+	Mode      string          `json:"mode"`
+	RfPower   *float32        `json:"rf_power,omitempty"` // RFPOWER level [0...1]
+	Functions map[string]bool `json:"functions"`
+}
+
+// Marshal encodes the state for the wire
+func (s *State) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// Config is the discovery config of an entity
+type Config struct {
+	Name              string         `json:"name"`
+	UniqueID          string         `json:"unique_id"`
+	ObjectID          string         `json:"object_id"`
+	StateTopic        string         `json:"state_topic"`
+	ValueTemplate     string         `json:"value_template"`
+	CommandTopic      string         `json:"command_topic,omitempty"`
+	PayloadOn         string         `json:"payload_on,omitempty"`
+	PayloadOff        string         `json:"payload_off,omitempty"`
+	UnitOfMeasurement string         `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string         `json:"device_class,omitempty"`
+	StateClass        string         `json:"state_class,omitempty"`
+	Icon              string         `json:"icon,omitempty"`
+	Availability      []Availability `json:"availability"`
+	AvailabilityMode  string         `json:"availability_mode,omitempty"`
+	Device            Device         `json:"device"`
+}
+
+// Availability is a topic which tells whether an entity is available
+type Availability struct {
+	Topic         string `json:"topic"`
+	ValueTemplate string `json:"value_template"`
+}
+
+// Device groups the entities of a radio in Home Assistant
+type Device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SwVersion    string   `json:"sw_version,omitempty"`
+}
+
+// Discovery is the config of an entity together with its topic
+type Discovery struct {
+	Topic  string
+	Config Config
+}
+
+// meters which are offered as sensors: hamlib level, object, name, unit
+// and template. The RF power is taken from the RFPOWER setting (see
+// Configs) since goHamlib doesn't support the RFPOWER_METER level.
+var meters = []struct {
+	level, object, name, unit, template string
+}{
+	{"STRENGTH", "s_meter", "S-Meter", "dB", "{{ value_json.strength }}"},
+	{"SWR", "swr", "SWR", "", "{{ value_json.swr }}"},
+}
+
+// MeterLevels are the hamlib levels published on the MetersTopic
+func MeterLevels() []string {
+	levels := make([]string, 0, len(meters))
+	for _, m := range meters {
+		levels = append(levels, m.level)
+	}
+	return levels
+}
+
+var invalidID = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Configs returns the discovery configs of the entities which are
+// supported by the radio
+func Configs(s Settings, caps *sbRadio.Capabilities) []Discovery {
+
+	// <station>/radios/<radio>/cat
+	parts := strings.Split(s.BaseTopic, "/")
+	name := s.BaseTopic
+	if len(parts) >= 3 {
+		name = parts[0] + " " + parts[2]
+	}
+	node := strings.ToLower(invalidID.ReplaceAllString(name, "_"))
+
+	device := Device{
+		Identifiers:  []string{"gorigctl_" + node},
+		Name:         name,
+		Manufacturer: caps.MfgName,
+		Model:        caps.ModelName,
+		SwVersion:    s.Version,
+	}
+
+	stateTopic := StateTopic(s.BaseTopic)
+	metersTopic := MetersTopic(s.BaseTopic)
+
+	onlineTemplate := "{{ 'online' if value_json.online else 'offline' }}"
+	availability := []Availability{{serverstatus.Topic(s.BaseTopic), onlineTemplate}}
+	availabilityMode := ""
+	if len(s.Station) > 0 {
+		// the status of the radio is not cleared if the server crashes
+		availability = append(availability, Availability{s.Station, onlineTemplate})
+		availabilityMode = "all"
+	}
+
+	entity := func(component, object, name string) Discovery {
+		return Discovery{
+			Topic: fmt.Sprintf("%s/%s/%s/%s/config", s.Prefix, component, node, object),
+			Config: Config{
+				Name:             name,
+				UniqueID:         node + "_" + object,
+				ObjectID:         node + "_" + object,
+				StateTopic:       stateTopic,
+				Availability:     availability,
+				AvailabilityMode: availabilityMode,
+				Device:           device,
+			},
+		}
+	}
+
+	onOff := func(field string) string {
+		return fmt.Sprintf("{{ 'ON' if value_json.%s else 'OFF' }}", field)
+	}
+
+	switchEntity := func(object, name, template string) Discovery {
+		d := entity("switch", object, name)
+		d.Config.ValueTemplate = template
+		d.Config.CommandTopic = CommandTopic(s.BaseTopic, object)
+		d.Config.PayloadOn = payloadOn
+		d.Config.PayloadOff = payloadOff
+		return d
+	}
+
+	configs := []Discovery{}
+
+	freq := entity("sensor", "frequency", "Frequency")
+	freq.Config.ValueTemplate = "{{ value_json.frequency }}"
+	freq.Config.UnitOfMeasurement = "Hz"
+	freq.Config.DeviceClass = "frequency"
+	freq.Config.StateClass = "measurement"
+	configs = append(configs, freq)
+
+	mode := entity("sensor", "mode", "Mode")
+	mode.Config.ValueTemplate = "{{ value_json.mode }}"
+	mode.Config.Icon = "mdi:sine-wave"
+	configs = append(configs, mode)
+
+	ptt := entity("binary_sensor", "transmitting", "Transmitting")
+	ptt.Config.ValueTemplate = onOff("ptt")
+	ptt.Config.Icon = "mdi:radio-tower"
+	configs = append(configs, ptt)
+
+	for _, m := range meters {
+		if !hasValue(caps.GetLevels, m.level) {
+			continue
+		}
+		d := entity("sensor", m.object, m.name)
+		d.Config.StateTopic = metersTopic
+		d.Config.ValueTemplate = m.template
+		d.Config.UnitOfMeasurement = m.unit
+		d.Config.StateClass = "measurement"
+		if m.level == "STRENGTH" {
+			d.Config.DeviceClass = "signal_strength"
+		}
+		configs = append(configs, d)
+	}
+
+	if hasValue(caps.GetLevels, "RFPOWER") {
+		d := entity("sensor", "rf_power", "RF Power")
+		d.Config.ValueTemplate = "{{ (value_json.rf_power * 100) | round(0) }}"
+		d.Config.UnitOfMeasurement = "%"
+		d.Config.StateClass = "measurement"
+		d.Config.Icon = "mdi:flash"
+		configs = append(configs, d)
+	}
+
+	if caps.HasPowerstat {
+		d := switchEntity("power", "Power", onOff("radio_on"))
+		d.Config.Icon = "mdi:power"
+		configs = append(configs, d)
+	}
+
+	if s.PttSwitch {
+		d := switchEntity("ptt", "PTT", onOff("ptt"))
+		d.Config.Icon = "mdi:microphone"
+		configs = append(configs, d)
+	}
+
+	for _, f := range s.Functions {
+		f = strings.ToUpper(f)
+		if !contains(caps.SetFunctions, f) {
+			continue
+		}
+		object := functionPrefix + strings.ToLower(f)
+		template := fmt.Sprintf("{{ 'ON' if value_json.functions.%s else 'OFF' }}", f)
+		configs = append(configs, switchEntity(object, f, template))
+	}
+
+	return configs
+}
+
+// ParseCommand turns the command of a switch received on
+// <base>/ha/set/<object> into a request. The current vfo has to be
+// set by the caller.
+func ParseCommand(s Settings, object, payload string) (sbRadio.SetState, error) {
+
+	req := sbRadio.SetState{}
+	req.Vfo = &sbRadio.Vfo{}
+	req.Vfo.Split = &sbRadio.Split{}
+	req.Md = &sbRadio.MetaData{}
+	req.UserId = UserID
+
+	var value bool
+	switch strings.ToUpper(strings.TrimSpace(payload)) {
+	case payloadOn:
+		value = true
+	case payloadOff:
+		value = false
+	default:
+		return req, fmt.Errorf("invalid payload %q for %s", payload, object)
+	}
+
+	switch {
+	case object == "power":
+		req.Md.HasRadioOn = true
+		req.RadioOn = value
+
+	case object == "ptt":
+		if !s.PttSwitch {
+			return req, errors.New("ptt switch not enabled")
+		}
+		req.Md.HasPtt = true
+		req.Ptt = value
+
+	case strings.HasPrefix(object, functionPrefix):
+		f := strings.ToUpper(strings.TrimPrefix(object, functionPrefix))
+		if !contains(upper(s.Functions), f) {
+			return req, fmt.Errorf("function %s not enabled", f)
+		}
+		req.Md.HasFunctions = true
+		req.Vfo.Functions = map[string]bool{f: value}
+
+	default:
+		return req, fmt.Errorf("unknown switch %q", object)
+	}
+
+	return req, nil
+}
+
+func hasValue(values []*sbRadio.Value, name string) bool {
+	for _, v := range values {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func upper(list []string) []string {
+	u := make([]string, 0, len(list))
+	for _, s := range list {
+		u = append(u, strings.ToUpper(s))
+	}
+	return u
+}
@@ -0,0 +1,279 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/events"
+)
+
+const (
+	// maxDatagramSize is the max. size of the UDP packets; batches
+	// are split into several packets
+	maxDatagramSize = 1400
+
+	minRetryBackoff = time.Second
+	maxRetryBackoff = time.Minute
+
+	httpTimeout = time.Second * 5
+)
+
+// Settings of the exporter
+type Settings struct {
+	// http(s)://host:8086/api/v2/write?org=<org>&bucket=<bucket> (2.x),
+	// http(s)://host:8086/write?db=<db> (1.x) or udp://host:8089
+	URL           string
+	Token         string            // sent as "Authorization: Token <token>" (optional)
+	Tags          map[string]string // added to all points, e.g. station and radio
+	BatchSize     int               // max. number of points per request
+	FlushInterval time.Duration     // max. time a point is held back
+	BufferSize    int               // max. number of points kept while the endpoint is unavailable
+	PointsCh      chan Point
+	WaitGroup     *sync.WaitGroup
+	Events        *pubsub.PubSub
+	Logger        *log.Logger
+}
+
+// writer sends a batch of lines to the endpoint
+type writer interface {
+	write(lines []string) error
+}
+
+// permanentError is returned by the endpoint for an invalid batch;
+// retrying it doesn't help
+type permanentError struct {
+	error
+}
+
+// Export receives the points on PointsCh and writes them in batches
+// to InfluxDB. If the endpoint is unavailable, the points are kept (up
+// to BufferSize, then the oldest ones are dropped) and the write is
+// retried with an exponential backoff. This function is typically
+// executed as a goroutine.
+func Export(s Settings) {
+
+	defer s.WaitGroup.Done()
+
+	shutdownCh := s.Events.Sub(events.Shutdown)
+
+	w, err := newWriter(s)
+	if err != nil {
+		s.Logger.Println("influx:", err)
+		// keep on receiving so that the producers don't block
+		for {
+			select {
+			case <-s.PointsCh:
+			case <-shutdownCh:
+				return
+			}
+		}
+	}
+
+	e := exporter{settings: s, writer: w}
+
+	flushTicker := time.NewTicker(s.FlushInterval)
+	defer flushTicker.Stop()
+
+	for {
+		select {
+		case p := <-s.PointsCh:
+			e.add(p)
+			if len(e.pending) >= s.BatchSize {
+				e.flush(time.Now())
+			}
+
+		case now := <-flushTicker.C:
+			e.flush(now)
+
+		case <-shutdownCh:
+			// last attempt, without waiting for the backoff
+			e.retryAt = time.Time{}
+			e.flush(time.Now())
+			if len(e.pending) > 0 {
+				s.Logger.Printf("influx: %d points not written\n", len(e.pending))
+			}
+			return
+		}
+	}
+}
+
+type exporter struct {
+	settings Settings
+	writer   writer
+	pending  []string
+	dropped  int
+	failing  bool
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+func (e *exporter) add(p Point) {
+
+	line := p.Line(e.settings.Tags)
+	if len(line) == 0 {
+		return
+	}
+
+	e.pending = append(e.pending, line)
+
+	if len(e.pending) > e.settings.BufferSize {
+		e.pending = e.pending[len(e.pending)-e.settings.BufferSize:]
+		e.dropped++
+	}
+}
+
+// flush writes the pending points in batches. On a transient error
+// the remaining points are kept and the next attempt is delayed.
+func (e *exporter) flush(now time.Time) {
+
+	if now.Before(e.retryAt) {
+		return
+	}
+
+	for len(e.pending) > 0 {
+
+		n := len(e.pending)
+		if n > e.settings.BatchSize {
+			n = e.settings.BatchSize
+		}
+
+		err := e.writer.write(e.pending[:n])
+
+		if _, ok := err.(permanentError); ok {
+			e.settings.Logger.Printf("influx: %v; dropping %d points\n", err, n)
+			err = nil
+		}
+
+		if err != nil {
+			if !e.failing {
+				e.settings.Logger.Printf("influx: %v; retrying\n", err)
+			}
+			e.failing = true
+			e.backoff *= 2
+			if e.backoff < minRetryBackoff {
+				e.backoff = minRetryBackoff
+			}
+			if e.backoff > maxRetryBackoff {
+				e.backoff = maxRetryBackoff
+			}
+			e.retryAt = now.Add(e.backoff)
+			return
+		}
+
+		if e.failing {
+			e.settings.Logger.Println("influx: endpoint available again")
+			if e.dropped > 0 {
+				e.settings.Logger.Printf("influx: %d points dropped (buffer full)\n", e.dropped)
+			}
+			e.failing = false
+			e.dropped = 0
+		}
+		e.backoff = 0
+		e.pending = e.pending[n:]
+	}
+
+	// release the memory of the written points
+	e.pending = nil
+}
+
+func newWriter(s Settings) (writer, error) {
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return &httpWriter{
+			url:    s.URL,
+			token:  s.Token,
+			client: &http.Client{Timeout: httpTimeout},
+		}, nil
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &udpWriter{conn: conn}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported url %q (http, https or udp)", s.URL)
+}
+
+type httpWriter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (w *httpWriter) write(lines []string) error {
+
+	body := strings.Join(lines, "\n") + "\n"
+
+	req, err := http.NewRequest("POST", w.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(w.token) > 0 {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+
+	// the batch is invalid (e.g. a field type conflict); unauthorized
+	// requests and the rate limit (429) are retried
+	if resp.StatusCode == http.StatusBadRequest ||
+		resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return permanentError{err}
+	}
+
+	return err
+}
+
+type udpWriter struct {
+	conn net.Conn
+}
+
+func (w *udpWriter) write(lines []string) error {
+
+	buf := bytes.Buffer{}
+
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > maxDatagramSize {
+			if _, err := w.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+
+	_, err := w.conn.Write(buf.Bytes())
+
+	return err
+}
@@ -0,0 +1,230 @@
+package influx
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/events"
+)
+
+// endpoint is a fake InfluxDB which answers with the given status
+// codes (the last one is repeated) and records the received batches
+type endpoint struct {
+	sync.Mutex
+	codes   []int
+	batches [][]string
+	auth    string
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	body, _ := ioutil.ReadAll(req.Body)
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.auth = req.Header.Get("Authorization")
+
+	code := e.codes[0]
+	if len(e.codes) > 1 {
+		e.codes = e.codes[1:]
+	}
+	if code < 300 {
+		lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+		e.batches = append(e.batches, lines)
+	}
+
+	w.WriteHeader(code)
+	if code >= 300 {
+		w.Write([]byte("error"))
+	}
+}
+
+func (e *endpoint) received() [][]string {
+	e.Lock()
+	defer e.Unlock()
+	return append([][]string{}, e.batches...)
+}
+
+func point(v float64) Point {
+	return Point{
+		Measurement: "radio_meters",
+		Fields:      map[string]interface{}{"swr": v},
+		Time:        time.Unix(0, 1),
+	}
+}
+
+func testExporter(t *testing.T, url string, batchSize, bufferSize int) *exporter {
+	t.Helper()
+	s := Settings{
+		URL:        url,
+		Token:      "secret",
+		BatchSize:  batchSize,
+		BufferSize: bufferSize,
+		Logger:     log.New(ioutil.Discard, "", 0),
+	}
+	w, err := newWriter(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &exporter{settings: s, writer: w}
+}
+
+func TestExportBatches(t *testing.T) {
+
+	ep := &endpoint{codes: []int{http.StatusNoContent}}
+	srv := httptest.NewServer(ep)
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	evPS := pubsub.New(1)
+	pointsCh := make(chan Point)
+
+	s := Settings{
+		URL:           srv.URL + "/write?db=radio",
+		Token:         "secret",
+		Tags:          map[string]string{"station": "st"},
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		BufferSize:    100,
+		PointsCh:      pointsCh,
+		WaitGroup:     &wg,
+		Events:        evPS,
+		Logger:        log.New(ioutil.Discard, "", 0),
+	}
+
+	wg.Add(1)
+	go Export(s)
+
+	for i := 1; i <= 5; i++ {
+		pointsCh <- point(float64(i))
+	}
+
+	// the remaining point is written on shutdown
+	evPS.Pub(true, events.Shutdown)
+	wg.Wait()
+
+	batches := ep.received()
+	if len(batches) != 3 {
+		t.Fatalf("got %d batches, want 3: %v", len(batches), batches)
+	}
+	for i, n := range []int{2, 2, 1} {
+		if len(batches[i]) != n {
+			t.Errorf("batch %d has %d points, want %d", i, len(batches[i]), n)
+		}
+	}
+	if want := "radio_meters,station=st swr=1 1"; batches[0][0] != want {
+		t.Errorf("got %q, want %q", batches[0][0], want)
+	}
+	if ep.auth != "Token secret" {
+		t.Errorf("got authorization %q", ep.auth)
+	}
+}
+
+func TestExportRetry(t *testing.T) {
+
+	ep := &endpoint{codes: []int{http.StatusServiceUnavailable, http.StatusNoContent}}
+	srv := httptest.NewServer(ep)
+	defer srv.Close()
+
+	e := testExporter(t, srv.URL+"/write?db=radio", 10, 100)
+	now := time.Now()
+
+	e.add(point(1))
+	e.add(point(2))
+	e.flush(now)
+
+	if len(e.pending) != 2 || !e.failing {
+		t.Fatalf("points not kept after a failed write: %d pending", len(e.pending))
+	}
+
+	// no new attempt during the backoff
+	e.add(point(3))
+	e.flush(now.Add(minRetryBackoff / 2))
+	if len(ep.received()) != 0 {
+		t.Fatal("retried during the backoff")
+	}
+
+	e.flush(now.Add(minRetryBackoff))
+
+	batches := ep.received()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("got %v, want one batch with 3 points", batches)
+	}
+	if len(e.pending) != 0 || e.failing || e.backoff != 0 {
+		t.Errorf("exporter not reset after a successful write")
+	}
+}
+
+func TestExportDropsInvalidBatch(t *testing.T) {
+
+	ep := &endpoint{codes: []int{http.StatusBadRequest, http.StatusNoContent}}
+	srv := httptest.NewServer(ep)
+	defer srv.Close()
+
+	e := testExporter(t, srv.URL+"/write?db=radio", 10, 100)
+	now := time.Now()
+
+	e.add(point(1))
+	e.flush(now)
+
+	if len(e.pending) != 0 || e.failing {
+		t.Fatalf("invalid batch not dropped: %d pending", len(e.pending))
+	}
+
+	// the next batch is written without a backoff
+	e.add(point(2))
+	e.flush(now)
+
+	batches := ep.received()
+	if len(batches) != 1 || batches[0][0] != "radio_meters swr=2 1" {
+		t.Errorf("got %v", batches)
+	}
+}
+
+func TestExportBufferSize(t *testing.T) {
+
+	ep := &endpoint{codes: []int{http.StatusServiceUnavailable, http.StatusNoContent}}
+	srv := httptest.NewServer(ep)
+	defer srv.Close()
+
+	e := testExporter(t, srv.URL+"/write?db=radio", 10, 2)
+
+	for i := 1; i <= 4; i++ {
+		e.add(point(float64(i)))
+	}
+	if len(e.pending) != 2 || e.pending[0] != "radio_meters swr=3 1" {
+		t.Errorf("oldest points not dropped: %v", e.pending)
+	}
+}
+
+func TestLineSkipsNonFiniteFields(t *testing.T) {
+
+	p := Point{
+		Measurement: "radio_meters",
+		Fields: map[string]interface{}{
+			"alc":   math.NaN(),
+			"swr":   math.Inf(1),
+			"power": float32(math.Inf(-1)),
+			"level": 0.5,
+		},
+		Time: time.Unix(0, 1),
+	}
+
+	if got, want := p.Line(nil), "radio_meters level=0.5 1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	p.Fields = map[string]interface{}{"swr": math.NaN()}
+	if got := p.Line(nil); got != "" {
+		t.Errorf("got %q for a point without valid fields", got)
+	}
+}
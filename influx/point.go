@@ -0,0 +1,119 @@
+package influx
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point is a measurement which is written to InfluxDB
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{} // float64, float32, int, int32, int64, bool or string
+	Time        time.Time
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// Line encodes the point in the InfluxDB line protocol with a
+// timestamp in nanoseconds. Tags and fields are sorted by key;
+// fields with an unsupported type or a non-finite value are
+// skipped. A point without fields can't be written; an empty
+// string is returned.
+func (p *Point) Line(defaultTags map[string]string) string {
+
+	tags := make(map[string]string, len(defaultTags)+len(p.Tags))
+	for k, v := range defaultTags {
+		tags[k] = v
+	}
+	for k, v := range p.Tags {
+		tags[k] = v
+	}
+
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.Measurement))
+
+	for _, k := range sortedKeys(tags) {
+		// empty tag values are not allowed
+		if len(tags[k]) == 0 {
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteString("=")
+		b.WriteString(keyEscaper.Replace(tags[k]))
+	}
+
+	keys := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sep := " "
+	for _, k := range keys {
+		v, ok := fieldValue(p.Fields[k])
+		if !ok {
+			continue
+		}
+		b.WriteString(sep)
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteString("=")
+		b.WriteString(v)
+		sep = ","
+	}
+
+	if sep == " " {
+		return ""
+	}
+
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(p.Time.UnixNano(), 10))
+
+	return b.String()
+}
+
+// fieldValue formats a field value for the line protocol. Values which
+// can't be represented (e.g. NaN or ±Inf) are skipped, since InfluxDB
+// would reject the whole batch.
+func fieldValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	case int:
+		return strconv.Itoa(v) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,47 @@
+package meter
+
+import (
+	"encoding/json"
+)
+
+// RxMeters are the hamlib levels which are polled while receiving
+var RxMeters = []string{"STRENGTH"}
+
+// TxMeters are the hamlib levels which are polled while transmitting.
+// The version of goHamlib we depend on doesn't know the levels
+// RFPOWER_METER, COMP_METER, VD_METER and ID_METER of newer hamlib
+// releases, so they can't be read yet.
+var TxMeters = []string{"SWR", "ALC"}
+
+// IsMeter returns true if the level is a meter reading rather
+// than a setting of the radio
+func IsMeter(level string) bool {
+	for _, m := range RxMeters {
+		if m == level {
+			return true
+		}
+	}
+	for _, m := range TxMeters {
+		if m == level {
+			return true
+		}
+	}
+	return false
+}
+
+// Reading contains the meter values of one polling cycle
+type Reading struct {
+	Timestamp int64              `json:"ts"` // unix time [ms]
+	Tx        bool               `json:"tx"`
+	Values    map[string]float32 `json:"values"`
+}
+
+// Marshal encodes the reading for the wire
+func (r *Reading) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Unmarshal decodes a reading received from the wire
+func (r *Reading) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, r)
+}
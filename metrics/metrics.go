@@ -0,0 +1,390 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the metrics exported by the radio server
+const (
+	RigCommands        = "gorigctl_rig_commands_total"
+	RigCommandDuration = "gorigctl_rig_command_duration_seconds"
+	HamlibErrors       = "gorigctl_hamlib_errors_total"
+	RigConnected       = "gorigctl_rig_connected"
+	RigFrequency       = "gorigctl_rig_frequency_hertz"
+	RigMode            = "gorigctl_rig_mode"
+	RigPtt             = "gorigctl_rig_ptt"
+	RigMeter           = "gorigctl_rig_meter"
+	MqttConnected      = "gorigctl_mqtt_connected"
+	MqttReceived       = "gorigctl_mqtt_messages_received_total"
+	MqttSent           = "gorigctl_mqtt_messages_sent_total"
+	QueueLength        = "gorigctl_queue_length"
+)
+
+// DurationBuckets are the upper bounds [s] of the histogram of the
+// rig command durations
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+// Labels of a time series, e.g. {"field": "frequency"}
+type Labels map[string]string
+
+// Registry holds the metrics and renders them in the Prometheus text
+// exposition format. A nil Registry discards all values, so that the
+// metrics can be updated unconditionally.
+type Registry struct {
+	sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labels string
+	value  float64
+	fn     func() float64
+	counts []uint64 // per bucket (histogram)
+	sum    float64
+	count  uint64
+}
+
+// NewRegistry returns a registry with all metrics of the radio server
+func NewRegistry() *Registry {
+
+	r := &Registry{families: make(map[string]*family)}
+
+	r.declare(RigCommands, counter, "Requests of the clients by field and result (ok, error, denied).", nil)
+	r.declare(RigCommandDuration, histogram, "Time needed to apply a request to the rig, by field.", DurationBuckets)
+	r.declare(HamlibErrors, counter, "Errors returned by hamlib while polling the rig, by error class.", nil)
+	r.declare(RigConnected, gauge, "1 if the connection to the rig is established.", nil)
+	r.declare(RigFrequency, gauge, "Frequency of the current vfo.", nil)
+	r.declare(RigMode, gauge, "Mode of the current vfo (1 for the active mode).", nil)
+	r.declare(RigPtt, gauge, "1 while transmitting.", nil)
+	r.declare(RigMeter, gauge, "Last meter readings of the rig.", nil)
+	r.declare(MqttConnected, gauge, "1 if the connection to the MQTT broker is established.", nil)
+	r.declare(MqttReceived, counter, "MQTT messages received by topic (client IDs replaced by +).", nil)
+	r.declare(MqttSent, counter, "MQTT messages sent by topic (client IDs replaced by +).", nil)
+	r.declare(QueueLength, gauge, "Messages waiting in the internal queues.", nil)
+
+	return r
+}
+
+func (r *Registry) declare(name, kind, help string, buckets []float64) {
+	r.families[name] = &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// get returns the series of the metric with the given labels; the
+// caller must hold the lock. Unknown metrics return nil.
+func (r *Registry) get(name string, l Labels) *series {
+
+	f, ok := r.families[name]
+	if !ok {
+		return nil
+	}
+
+	key := l.String()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		if f.kind == histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// Inc increments a counter by one
+func (r *Registry) Inc(name string, l Labels) {
+	r.Add(name, l, 1)
+}
+
+// Add adds v to a counter or gauge
+func (r *Registry) Add(name string, l Labels, v float64) {
+
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if s := r.get(name, l); s != nil {
+		s.value += v
+	}
+}
+
+// Set sets a gauge to v
+func (r *Registry) Set(name string, l Labels, v float64) {
+
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if s := r.get(name, l); s != nil {
+		s.value = v
+	}
+}
+
+// SetFunc sets a gauge whose value is read from fn on each scrape
+func (r *Registry) SetFunc(name string, l Labels, fn func() float64) {
+
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if s := r.get(name, l); s != nil {
+		s.fn = fn
+	}
+}
+
+// Reset removes all series of a metric, e.g. before setting the
+// active mode
+func (r *Registry) Reset(name string) {
+
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		f.series = make(map[string]*series)
+	}
+}
+
+// Observe adds a sample to a histogram
+func (r *Registry) Observe(name string, l Labels, v float64) {
+
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	f, ok := r.families[name]
+	if !ok || f.kind != histogram {
+		return
+	}
+
+	s := r.get(name, l)
+	for i, le := range f.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// WriteTo renders all metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	for _, name := range names {
+		f := r.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(cw, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(cw, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != histogram {
+				v := s.value
+				if s.fn != nil {
+					v = s.fn()
+				}
+				fmt.Fprintf(cw, "%s%s %s\n", f.name, s.labels, formatFloat(v))
+				continue
+			}
+			for i, le := range f.buckets {
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name,
+					withLabel(s.labels, "le", formatFloat(le)), s.counts[i])
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", f.name, s.labels, formatFloat(s.sum))
+			fmt.Fprintf(cw, "%s_count%s %d\n", f.name, s.labels, s.count)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics to the Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Listen serves the metrics on http://<addr>/metrics. Errors after the
+// listener has been opened are logged.
+func Listen(addr string, r *Registry, logger *log.Logger) error {
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+
+	go func() {
+		logger.Println("metrics:", http.Serve(ln, mux))
+	}()
+
+	return nil
+}
+
+// String renders the labels as {name="value",...}, sorted by name
+func (l Labels) String() string {
+
+	if len(l) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(l))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+quote(l[name]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// perClientTopics are the topics whose last segment identifies a
+// client
+var perClientTopics = map[string]bool{
+	"presence":   true,
+	"clientping": true,
+}
+
+// TopicLabel returns the value of the "topic" label of a MQTT topic.
+// The segments which identify a client (or a slot of the chat history,
+// <station>/chat/<user>/<slot>) are replaced by "+", so that the
+// number of time series doesn't grow with each client which connects
+// to the server.
+func TopicLabel(topic string) string {
+
+	parts := strings.Split(topic, "/")
+
+	switch {
+	case len(parts) > 2 && parts[1] == "chat":
+		for i := 2; i < len(parts); i++ {
+			parts[i] = "+"
+		}
+	case len(parts) > 1 && perClientTopics[parts[len(parts)-2]]:
+		parts[len(parts)-1] = "+"
+	default:
+		return topic
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// withLabel adds a label to rendered labels
+func withLabel(labels, name, value string) string {
+	pair := name + "=" + quote(value)
+	if len(labels) == 0 {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+// labelEscaper escapes label values as required by the exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, r *Registry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d bytes, wrote %d", n, buf.Len())
+	}
+	return buf.String()
+}
+
+func TestCounterExposition(t *testing.T) {
+
+	r := NewRegistry()
+	r.Inc(RigCommands, Labels{"result": "ok", "field": "frequency"})
+	r.Inc(RigCommands, Labels{"result": "ok", "field": "frequency"})
+	r.Inc(RigCommands, Labels{"field": "ptt", "result": "denied"})
+
+	want := `# HELP gorigctl_rig_commands_total Requests of the clients by field and result (ok, error, denied).
+# TYPE gorigctl_rig_commands_total counter
+gorigctl_rig_commands_total{field="frequency",result="ok"} 2
+gorigctl_rig_commands_total{field="ptt",result="denied"} 1
+`
+	if got := render(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGauges(t *testing.T) {
+
+	r := NewRegistry()
+	r.Set(RigFrequency, nil, 14074000)
+	r.Add(QueueLength, Labels{"queue": "rig"}, 3)
+	r.Add(QueueLength, Labels{"queue": "rig"}, -1)
+	r.SetFunc(MqttConnected, nil, func() float64 { return 1 })
+	r.Set(RigMeter, Labels{"meter": "SWR"}, math.Inf(1))
+	r.Set(RigMeter, Labels{"meter": "ALC"}, math.NaN())
+
+	got := render(t, r)
+
+	for _, line := range []string{
+		"gorigctl_rig_frequency_hertz 1.4074e+07\n",
+		`gorigctl_queue_length{queue="rig"} 2` + "\n",
+		"gorigctl_mqtt_connected 1\n",
+		`gorigctl_rig_meter{meter="SWR"} +Inf` + "\n",
+		`gorigctl_rig_meter{meter="ALC"} NaN` + "\n",
+		"# TYPE gorigctl_rig_frequency_hertz gauge\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("missing %q in\n%s", line, got)
+		}
+	}
+
+	// metrics without series are omitted
+	if strings.Contains(got, RigPtt) {
+		t.Errorf("unexpected %s in\n%s", RigPtt, got)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+
+	r := NewRegistry()
+	r.Inc(MqttReceived, Labels{"topic": "a\\b\"c\nd"})
+
+	want := `gorigctl_mqtt_messages_received_total{topic="a\\b\"c\nd"} 1` + "\n"
+	if got := render(t, r); !strings.Contains(got, want) {
+		t.Errorf("missing %q in\n%s", want, got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+
+	r := NewRegistry()
+	l := Labels{"field": "ptt"}
+	r.Observe(RigCommandDuration, l, 0.003)
+	r.Observe(RigCommandDuration, l, 0.2)
+	r.Observe(RigCommandDuration, l, 30)
+
+	got := render(t, r)
+
+	name := RigCommandDuration
+	for _, line := range []string{
+		"# TYPE " + name + " histogram\n",
+		name + `_bucket{field="ptt",le="0.005"} 1` + "\n",
+		name + `_bucket{field="ptt",le="0.1"} 1` + "\n",
+		name + `_bucket{field="ptt",le="0.25"} 2` + "\n",
+		name + `_bucket{field="ptt",le="5"} 2` + "\n",
+		name + `_bucket{field="ptt",le="+Inf"} 3` + "\n",
+		name + `_sum{field="ptt"} 30.203` + "\n",
+		name + `_count{field="ptt"} 3` + "\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("missing %q in\n%s", line, got)
+		}
+	}
+
+	// the buckets are rendered in ascending order, +Inf last
+	if strings.Index(got, `le="5"`) > strings.Index(got, `le="+Inf"`) {
+		t.Errorf("+Inf bucket is not the last one:\n%s", got)
+	}
+
+	// samples of other metrics are ignored
+	r.Observe(RigFrequency, nil, 1)
+	if strings.Contains(render(t, r), RigFrequency) {
+		t.Error("Observe changed a gauge")
+	}
+}
+
+func TestReset(t *testing.T) {
+
+	r := NewRegistry()
+	r.Set(RigMode, Labels{"mode": "USB"}, 1)
+	r.Reset(RigMode)
+	r.Set(RigMode, Labels{"mode": "CW"}, 1)
+
+	got := render(t, r)
+	if strings.Contains(got, "USB") || !strings.Contains(got, `gorigctl_rig_mode{mode="CW"} 1`) {
+		t.Errorf("unexpected series after reset:\n%s", got)
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+
+	var r *Registry
+	r.Inc(RigCommands, nil)
+	r.Set(RigPtt, nil, 1)
+	r.SetFunc(RigPtt, nil, func() float64 { return 1 })
+	r.Observe(RigCommandDuration, nil, 1)
+	r.Reset(RigMode)
+}
+
+func TestServeHTTP(t *testing.T) {
+
+	r := NewRegistry()
+	r.Set(RigPtt, nil, 1)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "gorigctl_rig_ptt 1\n") {
+		t.Errorf("unexpected body:\n%s", rec.Body.String())
+	}
+}
+
+func TestTopicLabel(t *testing.T) {
+
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{"st/radios/r1/cat/setstate", "st/radios/r1/cat/setstate"},
+		{"st/radios/r1/cat/presence/gorigctl-gui-abcde", "st/radios/r1/cat/presence/+"},
+		{"st/radios/r1/cat/clientping/gorigctl-cli-xyz", "st/radios/r1/cat/clientping/+"},
+		{"st/radios/r1/cat/clientpong", "st/radios/r1/cat/clientpong"},
+		{"st/chat/gorigctl-cli-abcde/7", "st/chat/+/+"},
+		{"st/radios/presence/cat/status", "st/radios/presence/cat/status"},
+		{"presence", "presence"},
+	}
+
+	for _, tc := range tests {
+		if got := TopicLabel(tc.topic); got != tc.want {
+			t.Errorf("TopicLabel(%q) = %q, want %q", tc.topic, got, tc.want)
+		}
+	}
+}
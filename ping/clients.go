@@ -0,0 +1,93 @@
+package ping
+
+import (
+	"time"
+
+	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/presence"
+	sbPing "github.com/dh1tw/gorigctl/sb_ping"
+)
+
+// ClientPingTopic returns the topic on which the server pings a client
+func ClientPingTopic(baseTopic, userID string) string {
+	return baseTopic + "/clientping/" + userID
+}
+
+// ClientPongTopic returns the topic on which the clients reply to the
+// pings of the server
+func ClientPongTopic(baseTopic string) string {
+	return baseTopic + "/clientpong"
+}
+
+// PingClients sends a ping every second to each client which is
+// connected to the server (events.Operators) to determine the latency
+// of their links. The clients reflect the pings with EchoPing. The
+// statistics of the short window are published once per second on
+// events.ClientLatency as map[userID]Stats. PingTopic is the base
+// topic of the radio. This Function is typically executed as a
+// goroutine on server applications.
+func PingClients(ps Settings) {
+
+	defer ps.WaitGroup.Done()
+
+	shutdownCh := ps.Events.Sub(events.Shutdown)
+	operatorsCh := ps.Events.Sub(events.Operators)
+	connectionStatusCh := ps.Events.Sub(events.MqttConnStatus)
+
+	connectionStatus := comms.DISCONNECTED
+
+	pingTicker := time.NewTicker(time.Second)
+	defer pingTicker.Stop()
+
+	clients := map[string]*tracker{}
+
+	for {
+		select {
+		case <-shutdownCh:
+			return
+
+		case ev := <-operatorsCh:
+			operators := map[string]bool{}
+			for _, p := range ev.([]presence.Presence) {
+				operators[p.UserID] = true
+				if _, ok := clients[p.UserID]; !ok {
+					clients[p.UserID] = &tracker{}
+				}
+			}
+			for userID := range clients {
+				if !operators[userID] {
+					delete(clients, userID)
+				}
+			}
+
+		case <-pingTicker.C:
+			now := time.Now()
+			latency := make(map[string]Stats, len(clients))
+			for userID, t := range clients {
+				if connectionStatus == comms.CONNECTED {
+					sendPing(userID, ClientPingTopic(ps.PingTopic, userID), t.sent(now), ps.ToWireCh)
+				}
+				latency[userID] = t.stats(ShortWindow, now)
+			}
+			ps.Events.Pub(latency, events.ClientLatency)
+
+		case msg := <-ps.PongCh:
+			pong := sbPing.Ping{}
+			if err := pong.Unmarshal(msg); err != nil {
+				continue
+			}
+			if t, ok := clients[pong.UserId]; ok {
+				t.received(pong.Timestamp, time.Since(time.Unix(0, pong.Timestamp)))
+			}
+
+		case ev := <-connectionStatusCh:
+			connectionStatus = ev.(int)
+			if connectionStatus != comms.CONNECTED {
+				for _, t := range clients {
+					t.reset()
+				}
+			}
+		}
+	}
+}
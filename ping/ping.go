@@ -21,11 +21,15 @@ type Settings struct {
 	UserID    string
 	WaitGroup *sync.WaitGroup
 	Events    *pubsub.PubSub
+	// thresholds for the PTT warning; DefaultThresholds if not set
+	Thresholds *Thresholds
 }
 
 // CheckLatency sends out a ping every second to the server
 // to determine the system latency.  This Function is
-// typically executed as a goroutine in client applications
+// typically executed as a goroutine in client applications.
+// The round trip time of each pong is published on events.Pong
+// and the statistics of the link (NetStats) on events.NetStats.
 func CheckLatency(ps Settings) {
 
 	defer ps.WaitGroup.Done()
@@ -38,24 +42,45 @@ func CheckLatency(ps Settings) {
 
 	pingTicker := time.NewTicker(time.Second)
 
+	thresholds := DefaultThresholds
+	if ps.Thresholds != nil {
+		thresholds = *ps.Thresholds
+	}
+
+	t := tracker{}
+	netStats := NetStats{}
+
 	for {
 		select {
 		case <-shutdownCh:
 			return
 
 		case <-pingTicker.C:
+			now := time.Now()
 			if connectionStatus == comms.CONNECTED {
-				sendPing(ps.UserID, ps.PingTopic, ps.ToWireCh)
+				sendPing(ps.UserID, ps.PingTopic, t.sent(now), ps.ToWireCh)
 			}
+			netStats.Connected = connectionStatus == comms.CONNECTED
+			netStats.Short = t.stats(ShortWindow, now)
+			netStats.Long = t.stats(LongWindow, now)
+			netStats.evaluate(thresholds)
+			ps.Events.Pub(netStats, events.NetStats)
 
 		case msg := <-ps.PongCh:
-			pong, err := deserializePong(msg, ps.UserID)
+			stamp, pong, err := deserializePong(msg, ps.UserID)
 			if err == nil {
+				t.received(stamp, time.Duration(pong))
+				netStats.Last = time.Duration(pong)
 				ps.Events.Pub(pong, events.Pong)
 			}
 
 		case ev := <-connectionStatusCh:
 			connectionStatus = ev.(int)
+			if connectionStatus != comms.CONNECTED {
+				// pings which got lost while the connection was down
+				// say nothing about the quality of the link
+				t.reset()
+			}
 		}
 	}
 }
@@ -82,12 +107,11 @@ func EchoPing(ps Settings) {
 	}
 }
 
-func sendPing(userID, topic string, toWireCh chan comms.IOMsg) {
-	now := time.Now().UnixNano()
+func sendPing(userID, topic string, stamp int64, toWireCh chan comms.IOMsg) {
 
 	req := sbPing.Ping{}
 	req.UserId = userID
-	req.Timestamp = now
+	req.Timestamp = stamp
 
 	data, err := req.Marshal()
 	if err != nil {
@@ -101,19 +125,20 @@ func sendPing(userID, topic string, toWireCh chan comms.IOMsg) {
 	}
 }
 
-// deserialize Pong (Ping reply) and return the passed Duration (in Nanoseconds)
-func deserializePong(msg []byte, myUserID string) (int64, error) {
+// deserialize Pong (Ping reply) and return the timestamp of the ping
+// and the passed Duration (in Nanoseconds)
+func deserializePong(msg []byte, myUserID string) (int64, int64, error) {
 	pong := sbPing.Ping{}
 	err := pong.Unmarshal(msg)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	if myUserID != pong.UserId {
-		return 0, errors.New("not determined for this user")
+		return 0, 0, errors.New("not determined for this user")
 	}
 
 	pingTimestamp := time.Unix(0, pong.Timestamp)
 	delta := time.Since(pingTimestamp)
-	return delta.Nanoseconds(), nil
+	return pong.Timestamp, delta.Nanoseconds(), nil
 }
@@ -0,0 +1,151 @@
+package ping
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/events"
+)
+
+// ProbeSettings of a ping run against a radio server
+type ProbeSettings struct {
+	BrokerURL  string
+	BrokerPort int
+	Username   string
+	Password   string
+	ClientID   string
+	BaseTopic  string        // <station>/radios/<radio>/cat
+	Count      int           // number of pings
+	Interval   time.Duration // between the pings
+	Wait       time.Duration // time to wait for the pongs after the last ping
+	Logger     *log.Logger
+	OnReply    func(seq uint64, rtt time.Duration) // called for each pong
+}
+
+// Probe connects to the broker, sends Count pings to the server of the
+// radio and returns the statistics of the run. Pings which have not
+// been answered Wait after the last ping are counted as lost.
+func Probe(s ProbeSettings) (Stats, error) {
+
+	if s.Count > 1 && s.Interval <= 0 {
+		return Stats{}, errors.New("interval must be positive")
+	}
+
+	toWireCh := make(chan comms.IOMsg, 20)
+	pongCh := make(chan []byte, 20)
+
+	evPS := pubsub.New(10)
+	var wg sync.WaitGroup
+
+	mqttSettings := comms.MqttSettings{
+		WaitGroup:                   &wg,
+		Transport:                   "tcp",
+		BrokerURL:                   s.BrokerURL,
+		BrokerPort:                  s.BrokerPort,
+		ClientID:                    s.ClientID,
+		Username:                    s.Username,
+		Password:                    s.Password,
+		Topics:                      []string{s.BaseTopic + "/pong"},
+		ToDeserializePingResponseCh: pongCh,
+		ToWire:                      toWireCh,
+		Events:                      evPS,
+		Logger:                      s.Logger,
+	}
+
+	connectionStatusCh := evPS.Sub(events.MqttConnStatus)
+	prepareShutdownCh := evPS.Sub(events.PrepareShutdown)
+
+	wg.Add(1)
+	go comms.MqttClient(mqttSettings)
+
+	defer func() {
+		// keep on draining the pongs, otherwise the MQTT client
+		// might block while disconnecting
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-pongCh:
+				case <-stop:
+					return
+				}
+			}
+		}()
+		evPS.Pub(true, events.Shutdown)
+		wg.Wait()
+		close(stop)
+	}()
+
+	t := tracker{keepAll: true}
+	var started time.Time
+	var ticker *time.Ticker
+	var tickCh <-chan time.Time
+	var done <-chan time.Time
+
+	for {
+		select {
+		case <-prepareShutdownCh:
+			return Stats{}, errors.New("unable to connect to the MQTT broker")
+
+		case ev := <-connectionStatusCh:
+			if ev.(int) == comms.CONNECTED && ticker == nil {
+				started = time.Now()
+				sendPing(s.ClientID, s.BaseTopic+"/ping", t.sent(started), toWireCh)
+				if s.Count > 1 {
+					ticker = time.NewTicker(s.Interval)
+					defer ticker.Stop()
+					tickCh = ticker.C
+				} else {
+					done = time.After(s.Wait)
+				}
+			}
+
+		case now := <-tickCh:
+			sendPing(s.ClientID, s.BaseTopic+"/ping", t.sent(now), toWireCh)
+			if int(t.nextSeq) >= s.Count {
+				ticker.Stop()
+				tickCh = nil
+				done = time.After(s.Wait)
+			}
+
+		case msg := <-pongCh:
+			stamp, rtt, err := deserializePong(msg, s.ClientID)
+			if err != nil {
+				continue
+			}
+			seq, ok := t.received(stamp, time.Duration(rtt))
+			if !ok {
+				continue
+			}
+			if s.OnReply != nil {
+				s.OnReply(seq, time.Duration(rtt))
+			}
+			if t.complete(s.Count) && done != nil {
+				done = time.After(0)
+			}
+
+		case now := <-done:
+			elapsed := now.Sub(started)
+			stats := t.summarize(elapsed+time.Second, now, 0)
+			stats.Window = elapsed
+			return stats, nil
+		}
+	}
+}
+
+// complete returns true if all count pings have been answered
+func (t *tracker) complete(count int) bool {
+	if len(t.samples) < count {
+		return false
+	}
+	for _, s := range t.samples {
+		if !s.received {
+			return false
+		}
+	}
+	return true
+}
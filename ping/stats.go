@@ -0,0 +1,278 @@
+package ping
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Windows over which the network statistics are calculated
+const (
+	ShortWindow = time.Second * 10
+	LongWindow  = time.Minute
+)
+
+// LossTimeout is the time after which an unanswered ping is
+// counted as lost
+const LossTimeout = time.Second * 3
+
+// MinSamples is the minimum number of answered or lost pings in the
+// short window before the link is judged
+const MinSamples = 3
+
+// Thresholds above which the link is considered unsafe for
+// transmitting (PTT). A zero value disables the check.
+type Thresholds struct {
+	MaxLoss   float64       // packet loss [0...1]
+	MaxRtt    time.Duration // 95th percentile of the round trip time
+	MaxJitter time.Duration
+}
+
+// DefaultThresholds are used if no thresholds have been configured
+var DefaultThresholds = Thresholds{
+	MaxLoss:   0.05,
+	MaxRtt:    time.Millisecond * 500,
+	MaxJitter: time.Millisecond * 150,
+}
+
+// Stats summarize the pings sent within a window
+type Stats struct {
+	Window     time.Duration `json:"window"`
+	Sent       int           `json:"sent"` // pings which have been answered or are lost
+	Received   int           `json:"received"`
+	Lost       int           `json:"lost"`
+	Reordered  int           `json:"reordered,omitempty"` // pongs which arrived after a pong of a later ping
+	Duplicates int           `json:"duplicates,omitempty"`
+	Loss       float64       `json:"loss"` // [0...1]
+	Min        time.Duration `json:"min"`
+	Avg        time.Duration `json:"avg"`
+	Max        time.Duration `json:"max"`
+	Jitter     time.Duration `json:"jitter"` // mean deviation between consecutive round trip times
+	P50        time.Duration `json:"p50"`
+	P95        time.Duration `json:"p95"`
+	P99        time.Duration `json:"p99"`
+	Answered   bool          `json:"answered,omitempty"` // any ping has ever been answered
+}
+
+// String formats the stats similar to the summary of the Unix ping tool
+func (s Stats) String() string {
+	str := fmt.Sprintf("%d sent, %d received, %.1f%% loss", s.Sent, s.Received, s.Loss*100)
+	if s.Received > 0 {
+		str += fmt.Sprintf(", rtt min/avg/max/jitter = %v/%v/%v/%v, p50/p95/p99 = %v/%v/%v",
+			ms(s.Min), ms(s.Avg), ms(s.Max), ms(s.Jitter), ms(s.P50), ms(s.P95), ms(s.P99))
+	}
+	if s.Reordered > 0 || s.Duplicates > 0 {
+		str += fmt.Sprintf(", %d reordered, %d duplicates", s.Reordered, s.Duplicates)
+	}
+	return str
+}
+
+// NetStats is the quality of the link to the server. It is published
+// once per second on events.NetStats.
+type NetStats struct {
+	Connected bool
+	Last      time.Duration // round trip time of the last pong
+	Short     Stats         // over ShortWindow
+	Long      Stats         // over LongWindow
+	PttUnsafe bool
+	Reason    string // why PTT is unsafe
+}
+
+// evaluate checks the short window against the thresholds
+func (n *NetStats) evaluate(t Thresholds) {
+
+	n.PttUnsafe = false
+	n.Reason = ""
+
+	s := n.Short
+
+	switch {
+	case !n.Connected:
+		n.Reason = "not connected to the broker"
+	case s.Sent < MinSamples:
+		return
+	case s.Received == 0:
+		n.Reason = "no reply from the server"
+	case t.MaxLoss > 0 && s.Loss > t.MaxLoss:
+		n.Reason = fmt.Sprintf("%.0f%% packet loss", s.Loss*100)
+	case t.MaxRtt > 0 && s.P95 > t.MaxRtt:
+		n.Reason = fmt.Sprintf("round trip time %v", ms(s.P95))
+	case t.MaxJitter > 0 && s.Jitter > t.MaxJitter:
+		n.Reason = fmt.Sprintf("jitter %v", ms(s.Jitter))
+	default:
+		return
+	}
+
+	n.PttUnsafe = true
+}
+
+type sample struct {
+	seq       uint64
+	stamp     int64 // timestamp of the ping [ns], identifies its pong
+	sent      time.Time
+	received  bool
+	rtt       time.Duration
+	reordered bool
+	dups      int
+}
+
+// tracker keeps the pings of the long window. The Ping message of the
+// ICD has no sequence number; the pongs are matched by the timestamp of
+// the ping, which the tracker keeps strictly increasing.
+type tracker struct {
+	samples   []sample // sorted by sequence number (and timestamp)
+	nextSeq   uint64
+	lastStamp int64
+	lastRx    uint64 // highest sequence number received
+	answered  bool   // any ping has ever been answered
+	keepAll   bool   // don't prune old pings
+}
+
+// sent registers a new ping and returns the timestamp [ns] which has
+// to be sent with it
+func (t *tracker) sent(now time.Time) int64 {
+	stamp := now.UnixNano()
+	if stamp <= t.lastStamp {
+		stamp = t.lastStamp + 1
+	}
+	t.lastStamp = stamp
+	t.nextSeq++
+	t.samples = append(t.samples, sample{seq: t.nextSeq, stamp: stamp, sent: now})
+	t.prune(now)
+	return stamp
+}
+
+// received registers the pong of the ping with the given timestamp and
+// returns its sequence number. Pongs of unknown (or already pruned)
+// pings are ignored.
+func (t *tracker) received(stamp int64, rtt time.Duration) (uint64, bool) {
+
+	i := sort.Search(len(t.samples), func(i int) bool {
+		return t.samples[i].stamp >= stamp
+	})
+	if i == len(t.samples) || t.samples[i].stamp != stamp {
+		return 0, false
+	}
+
+	s := &t.samples[i]
+	if s.received {
+		s.dups++
+		return s.seq, true
+	}
+
+	s.received = true
+	s.rtt = rtt
+	t.answered = true
+	if s.seq < t.lastRx {
+		s.reordered = true
+	} else {
+		t.lastRx = s.seq
+	}
+
+	return s.seq, true
+}
+
+// prune removes the pings which are older than the long window
+func (t *tracker) prune(now time.Time) {
+	if t.keepAll {
+		return
+	}
+	i := 0
+	for i < len(t.samples) && now.Sub(t.samples[i].sent) > LongWindow {
+		i++
+	}
+	t.samples = t.samples[i:]
+}
+
+// reset drops all pings, e.g. after the connection has been lost.
+// Whether the peer answers pings at all is kept.
+func (t *tracker) reset() {
+	t.samples = nil
+	t.lastRx = 0
+}
+
+// stats calculates the statistics of the pings sent within the
+// window. Unanswered pings which are younger than LossTimeout are
+// still pending and not taken into account.
+func (t *tracker) stats(window time.Duration, now time.Time) Stats {
+	return t.summarize(window, now, LossTimeout)
+}
+
+// summarize calculates the statistics of the pings sent within the
+// window; pings which haven't been answered within timeout are lost
+func (t *tracker) summarize(window time.Duration, now time.Time, timeout time.Duration) Stats {
+
+	s := Stats{Window: window, Answered: t.answered}
+
+	rtts := []time.Duration{}
+	var sum, deviation time.Duration
+	var prev *sample
+
+	for i := range t.samples {
+		smpl := &t.samples[i]
+		age := now.Sub(smpl.sent)
+		if age > window {
+			continue
+		}
+		if !smpl.received {
+			if age >= timeout {
+				s.Sent++
+				s.Lost++
+			}
+			continue
+		}
+		s.Sent++
+		s.Received++
+		s.Duplicates += smpl.dups
+		if smpl.reordered {
+			s.Reordered++
+		}
+		rtts = append(rtts, smpl.rtt)
+		sum += smpl.rtt
+		if prev != nil {
+			d := smpl.rtt - prev.rtt
+			if d < 0 {
+				d = -d
+			}
+			deviation += d
+		}
+		prev = smpl
+	}
+
+	if s.Sent > 0 {
+		s.Loss = float64(s.Lost) / float64(s.Sent)
+	}
+
+	if len(rtts) == 0 {
+		return s
+	}
+
+	s.Avg = sum / time.Duration(len(rtts))
+	if len(rtts) > 1 {
+		s.Jitter = deviation / time.Duration(len(rtts)-1)
+	}
+
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	s.Min = rtts[0]
+	s.Max = rtts[len(rtts)-1]
+	s.P50 = percentile(rtts, 50)
+	s.P95 = percentile(rtts, 95)
+	s.P99 = percentile(rtts, 99)
+
+	return s
+}
+
+// percentile returns the p-th percentile (nearest rank) of the
+// sorted values
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// ms rounds a duration to 0.1ms for printing
+func ms(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond / 10)
+}
@@ -0,0 +1,48 @@
+package polling
+
+import (
+	"encoding/json"
+
+	"github.com/dh1tw/gorigctl/comms"
+)
+
+// Request changes the settings of a field group which is polled by the
+// server (e.g. "meters", "vfo" or "levels"). The global intervals can
+// be changed with SetState (PollingInterval and SyncInterval); the
+// per group settings are not part of the ICD and are therefore sent
+// as a separate request. Fields with a zero value are left unchanged.
+type Request struct {
+	UserID      string `json:"user_id"`
+	Group       string `json:"group"`
+	Interval    int64  `json:"interval,omitempty"`     // [ms] after a change
+	MaxInterval int64  `json:"max_interval,omitempty"` // [ms] limit of the back off
+	Priority    int    `json:"priority,omitempty"`
+	Disabled    *bool  `json:"disabled,omitempty"`
+}
+
+// Marshal encodes the request for the wire
+func (r *Request) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Unmarshal decodes a request received from the wire
+func (r *Request) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, r)
+}
+
+// SendRequest publishes a request on the given topic
+func SendRequest(toWireCh chan comms.IOMsg, topic string, req Request) error {
+
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+
+	msg := comms.IOMsg{}
+	msg.Data = data
+	msg.Topic = topic
+
+	toWireCh <- msg
+
+	return nil
+}
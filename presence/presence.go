@@ -0,0 +1,100 @@
+package presence
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dh1tw/gorigctl/comms"
+)
+
+// Types of clients
+const (
+	ClientCli = "cli"
+	ClientGui = "gui"
+	ClientWeb = "web"
+)
+
+// Presence announces whether a client is connected to the broker. Clients
+// publish it (retained) on <station>/radios/<radio>/cat/presence/<userID>
+// and register the offline variant as their MQTT last will, so that the
+// broker announces the disconnect if the client vanishes unexpectedly.
+// The server removes the retained offline messages.
+type Presence struct {
+	UserID     string `json:"user_id"`
+	Online     bool   `json:"online"`
+	ClientType string `json:"client_type,omitempty"`
+	Version    string `json:"version,omitempty"`
+	Since      int64  `json:"since,omitempty"` // [ms] when the client was started
+}
+
+// Marshal encodes the presence message for the wire
+func (p *Presence) Marshal() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// Unmarshal decodes a presence message received from the wire
+func (p *Presence) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, p)
+}
+
+// Topic returns the presence topic of a particular user
+func Topic(baseTopic, userID string) string {
+	return baseTopic + "/presence/" + userID
+}
+
+// NewLastWill returns the MQTT last will which marks the user as offline
+func NewLastWill(topic, userID string) (*comms.LastWill, error) {
+
+	p := Presence{
+		UserID: userID,
+		Online: false,
+	}
+
+	data, err := p.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	lw := comms.LastWill{
+		Topic:  topic,
+		Data:   data,
+		Qos:    0,
+		Retain: true,
+	}
+
+	return &lw, nil
+}
+
+// SinceTime returns the time since when the client is connected
+func (p *Presence) SinceTime() time.Time {
+	return time.Unix(0, p.Since*int64(time.Millisecond))
+}
+
+// Send publishes the presence of a user
+func Send(toWireCh chan comms.IOMsg, topic string, p Presence) error {
+
+	data, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+
+	msg := comms.IOMsg{}
+	msg.Data = data
+	msg.Topic = topic
+	msg.Retain = true
+
+	toWireCh <- msg
+
+	return nil
+}
+
+// Clear removes a retained presence message from the broker
+func Clear(toWireCh chan comms.IOMsg, topic string) {
+
+	msg := comms.IOMsg{}
+	msg.Data = []byte{}
+	msg.Topic = topic
+	msg.Retain = true
+
+	toWireCh <- msg
+}
@@ -0,0 +1,225 @@
+package remoteradio
+
+import (
+	"sort"
+	"time"
+
+	"github.com/dh1tw/gorigctl/delta"
+	"github.com/dh1tw/gorigctl/events"
+	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+)
+
+// cmdTimeout is the time after which a request which hasn't been
+// acknowledged by the server is counted as timed out
+const cmdTimeout = time.Second * 5
+
+// cmdHistory is the number of samples kept per field
+const cmdHistory = 100
+
+// CmdSample is the latency of a request from sending it until the
+// server's state update which acknowledges it has been received.
+// Total is split into the time needed by the rig (queued + executed
+// on the server) and the remaining time spent on the network.
+type CmdSample struct {
+	Field   string
+	Total   time.Duration
+	Rig     time.Duration
+	Network time.Duration
+}
+
+// CmdStats summarize the latency of the requests of a field
+type CmdStats struct {
+	Field    string
+	Count    int
+	Timeouts int
+	Min      time.Duration
+	Avg      time.Duration
+	P95      time.Duration
+	Max      time.Duration
+	Network  time.Duration // average
+	Rig      time.Duration // average
+}
+
+type pendingCmd struct {
+	field string
+	sent  time.Time
+}
+
+type cmdLatency struct {
+	pending  map[uint64][]pendingCmd // by request ID, oldest first
+	samples  map[string][]CmdSample
+	timeouts map[string]int
+}
+
+func newCmdLatency() cmdLatency {
+	return cmdLatency{
+		pending:  make(map[uint64][]pendingCmd),
+		samples:  make(map[string][]CmdSample),
+		timeouts: make(map[string]int),
+	}
+}
+
+// requestField returns the name of the field a request changes, used
+// to group the statistics
+func requestField(req *sbRadio.SetState) string {
+
+	md := req.Md
+	if md == nil {
+		return "other"
+	}
+
+	switch {
+	case md.HasRadioOn:
+		return "radio_on"
+	case md.HasFrequency:
+		return "frequency"
+	case md.HasMode, md.HasPbWidth:
+		return "mode"
+	case md.HasAnt:
+		return "antenna"
+	case md.HasRit:
+		return "rit"
+	case md.HasXit:
+		return "xit"
+	case md.HasSplit:
+		return "split"
+	case md.HasTuningStep:
+		return "tuning_step"
+	case md.HasFunctions:
+		return "function"
+	case md.HasLevels:
+		return "level"
+	case md.HasParameters:
+		return "parameter"
+	case md.HasPtt:
+		return "ptt"
+	case md.HasPollingInterval:
+		return "polling_interval"
+	case md.HasSyncInterval:
+		return "sync_interval"
+	case len(req.VfoOperations) > 0:
+		return "vfo_operation"
+	}
+
+	return "vfo"
+}
+
+// trackRequest remembers when a request (data as sent on the wire) has
+// been sent. Identical requests share the same ID; their
+// acknowledgements are matched in the order the requests were sent.
+func (r *RemoteRadio) trackRequest(req *sbRadio.SetState, data []byte) {
+
+	now := time.Now()
+	r.expireRequests(now)
+
+	id := delta.RequestID(data)
+	r.cmdLatency.pending[id] = append(r.cmdLatency.pending[id], pendingCmd{
+		field: requestField(req),
+		sent:  now,
+	})
+}
+
+// expireRequests counts the requests which haven't been acknowledged
+// within cmdTimeout (e.g. lost, superseded or rejected by an older
+// server)
+func (r *RemoteRadio) expireRequests(now time.Time) {
+	for id, pending := range r.cmdLatency.pending {
+		for len(pending) > 0 && now.Sub(pending[0].sent) > cmdTimeout {
+			r.cmdLatency.timeouts[pending[0].field]++
+			pending = pending[1:]
+		}
+		if len(pending) == 0 {
+			delete(r.cmdLatency.pending, id)
+		} else {
+			r.cmdLatency.pending[id] = pending
+		}
+	}
+}
+
+// ackRequest logs the errors reported for an acknowledged request,
+// records its latency and publishes it on events.CmdLatency
+func (r *RemoteRadio) ackRequest(ack *delta.Ack) {
+
+	if ack == nil || ack.UserID != r.userID {
+		return
+	}
+
+	for _, e := range ack.Errors {
+		r.logger.Println("request failed:", e)
+	}
+
+	pending := r.cmdLatency.pending[ack.RequestID]
+	if len(pending) == 0 {
+		return
+	}
+	p := pending[0]
+	if len(pending) == 1 {
+		delete(r.cmdLatency.pending, ack.RequestID)
+	} else {
+		r.cmdLatency.pending[ack.RequestID] = pending[1:]
+	}
+
+	s := CmdSample{
+		Field: p.field,
+		Total: time.Since(p.sent),
+		Rig:   time.Duration(ack.Queued+ack.Applied) * time.Microsecond,
+	}
+	s.Network = s.Total - s.Rig
+	if s.Network < 0 {
+		s.Network = 0
+	}
+
+	samples := append(r.cmdLatency.samples[p.field], s)
+	if len(samples) > cmdHistory {
+		samples = samples[len(samples)-cmdHistory:]
+	}
+	r.cmdLatency.samples[p.field] = samples
+
+	r.events.Pub(s, events.CmdLatency)
+}
+
+// GetCmdStats returns the latency statistics of the requests, sorted
+// by field
+func (r *RemoteRadio) GetCmdStats() ([]CmdStats, error) {
+
+	r.expireRequests(time.Now())
+
+	fields := map[string]bool{}
+	for f := range r.cmdLatency.samples {
+		fields[f] = true
+	}
+	for f := range r.cmdLatency.timeouts {
+		fields[f] = true
+	}
+
+	stats := make([]CmdStats, 0, len(fields))
+
+	for f := range fields {
+		s := CmdStats{Field: f, Timeouts: r.cmdLatency.timeouts[f]}
+		samples := r.cmdLatency.samples[f]
+		s.Count = len(samples)
+		if s.Count > 0 {
+			totals := make([]time.Duration, 0, s.Count)
+			var sum, network, rig time.Duration
+			for _, smpl := range samples {
+				totals = append(totals, smpl.Total)
+				sum += smpl.Total
+				network += smpl.Network
+				rig += smpl.Rig
+			}
+			sort.Slice(totals, func(i, j int) bool { return totals[i] < totals[j] })
+			n := time.Duration(s.Count)
+			s.Min = totals[0]
+			s.Max = totals[s.Count-1]
+			s.Avg = sum / n
+			s.P95 = totals[(95*s.Count+99)/100-1]
+			s.Network = network / n
+			s.Rig = rig / n
+		}
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Field < stats[j].Field })
+
+	return stats, nil
+}
@@ -0,0 +1,180 @@
+package remoteradio
+
+import (
+	"time"
+
+	"github.com/dh1tw/gorigctl/delta"
+	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+)
+
+// localHold is the time a debounced value keeps overriding the state
+// reported by the server after it has been sent. This avoids that the
+// displayed value jumps back while the server catches up.
+const localHold = time.Second
+
+// debounced is a value (e.g. the frequency) which is sent at most
+// once per rate limit interval. The latest request replaces any
+// request which hasn't been sent yet.
+type debounced struct {
+	req      sbRadio.SetState
+	apply    func(s *sbRadio.State)
+	pending  bool
+	lastSent time.Time
+}
+
+func (d *debounced) active(now time.Time) bool {
+	return d.pending || now.Before(d.lastSent.Add(localHold))
+}
+
+// SetRateLimit limits the requests for frequency, RIT, XIT and level
+// changes to n per second and value. Intermediate changes are merged
+// into the latest one. 0 disables the rate limit.
+func (r *RemoteRadio) SetRateLimit(n int) {
+	r.rateLimit = n
+}
+
+// FlushCh fires when debounced requests have to be sent. The client's
+// event loop must call Flush when it receives from this channel.
+func (r *RemoteRadio) FlushCh() <-chan time.Time {
+	return r.flushTimer.C
+}
+
+// Flush sends the debounced requests which are due. It returns true if
+// the locally displayed state has changed, since values which were
+// overridden locally are reverted to the state reported by the server.
+func (r *RemoteRadio) Flush() bool {
+
+	now := time.Now()
+	expired := false
+
+	for key, d := range r.debounced {
+		if d.pending && !now.Before(d.lastSent.Add(r.rateInterval())) {
+			if err := r.publishCatRequest(d.req); err != nil {
+				r.logger.Println(err)
+			}
+			d.pending = false
+			d.lastSent = now
+		}
+		if !d.active(now) {
+			delete(r.debounced, key)
+			expired = true
+		}
+	}
+
+	r.armFlushTimer()
+
+	if expired {
+		r.applyState(delta.Copy(&r.reported))
+	}
+
+	return expired
+}
+
+func (r *RemoteRadio) rateInterval() time.Duration {
+	if r.rateLimit <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(r.rateLimit)
+}
+
+// sendDebounced applies the change immediately to the local state and
+// sends the request, unless a request for the same value has been sent
+// within the rate limit interval. In this case the request is sent
+// when the interval has expired.
+func (r *RemoteRadio) sendDebounced(key string, req sbRadio.SetState, apply func(s *sbRadio.State)) error {
+
+	if r.rateLimit <= 0 {
+		return r.sendCatRequest(req)
+	}
+
+	if !r.radioOnline {
+		return r.publishCatRequest(req)
+	}
+
+	apply(&r.state)
+
+	d, ok := r.debounced[key]
+	if !ok {
+		d = &debounced{}
+		r.debounced[key] = d
+	}
+	d.req = req
+	d.apply = apply
+
+	now := time.Now()
+	if now.Before(d.lastSent.Add(r.rateInterval())) {
+		d.pending = true
+		r.armFlushTimer()
+		return nil
+	}
+
+	d.pending = false
+	d.lastSent = now
+	r.armFlushTimer()
+
+	return r.publishCatRequest(req)
+}
+
+// flushDebounced sends all pending requests immediately, so that they
+// are not overtaken by a subsequent request.
+func (r *RemoteRadio) flushDebounced() {
+
+	now := time.Now()
+
+	for _, d := range r.debounced {
+		if !d.pending {
+			continue
+		}
+		if err := r.publishCatRequest(d.req); err != nil {
+			r.logger.Println(err)
+		}
+		d.pending = false
+		d.lastSent = now
+	}
+}
+
+// applyLocalChanges overrides the state reported by the server with
+// the values which have been changed locally but not yet confirmed.
+func (r *RemoteRadio) applyLocalChanges(s *sbRadio.State) {
+
+	if s.Vfo == nil {
+		return
+	}
+
+	now := time.Now()
+
+	for _, d := range r.debounced {
+		if d.active(now) {
+			d.apply(s)
+		}
+	}
+}
+
+// armFlushTimer sets the timer to the next pending request or the
+// expiry of the next local override.
+func (r *RemoteRadio) armFlushTimer() {
+
+	if !r.flushTimer.Stop() {
+		select {
+		case <-r.flushTimer.C:
+		default:
+		}
+	}
+
+	var next time.Time
+	for _, d := range r.debounced {
+		due := d.lastSent.Add(localHold)
+		if d.pending {
+			due = d.lastSent.Add(r.rateInterval())
+		}
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+
+	if next.IsZero() {
+		return
+	}
+
+	r.flushTimer.Reset(time.Until(next))
+}
@@ -2,10 +2,17 @@ package remoteradio
 
 import (
 	"reflect"
+	"time"
 
+	"github.com/dh1tw/gorigctl/bandplan"
+	"github.com/dh1tw/gorigctl/delta"
 	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/meter"
+	"github.com/dh1tw/gorigctl/rigstatus"
 	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
 	sbStatus "github.com/dh1tw/gorigctl/sb_status"
+	"github.com/dh1tw/gorigctl/serverstatus"
+	"github.com/dh1tw/gorigctl/station"
 )
 
 func (r *RemoteRadio) DeserializeRadioStatus(data []byte) error {
@@ -15,14 +22,60 @@ func (r *RemoteRadio) DeserializeRadioStatus(data []byte) error {
 		return err
 	}
 
-	if r.radioOnline != rStatus.Online {
-		r.radioOnline = rStatus.Online
-		r.events.Pub(rStatus.Online, events.RadioOnline)
+	r.serverOnline = rStatus.Online
+	r.updateOnline()
+
+	return nil
+}
+
+// DeserializeServerStatus decodes the details of the server's status
+// (version, operators, health of the rig). Whether the server is
+// online is taken from the radio status, since only that is cleared
+// by the server's last will.
+func (r *RemoteRadio) DeserializeServerStatus(data []byte) error {
+
+	sStatus := serverstatus.Status{}
+	if err := sStatus.Unmarshal(data); err != nil {
+		return err
 	}
 
+	r.serverStatus = sStatus
+	r.operators = sStatus.Operators
+	r.latency = sStatus.Latency
+
 	return nil
 }
 
+// DeserializeStationStatus decodes the status of a multi-radio server.
+// The radio is offline if the server is offline, even if the radio's
+// own (retained) status still claims that it is online.
+func (r *RemoteRadio) DeserializeStationStatus(radio string, data []byte) error {
+
+	sStatus := station.Status{}
+	if len(data) > 0 {
+		if err := sStatus.Unmarshal(data); err != nil {
+			return err
+		}
+	}
+
+	r.stationDown = len(data) > 0 && !sStatus.RadioOnline(radio)
+	r.updateOnline()
+
+	return nil
+}
+
+// updateOnline publishes events.RadioOnline when the radio went
+// online or offline
+func (r *RemoteRadio) updateOnline() {
+
+	online := r.serverOnline && !r.stationDown
+
+	if r.radioOnline != online {
+		r.radioOnline = online
+		r.events.Pub(online, events.RadioOnline)
+	}
+}
+
 func (r *RemoteRadio) DeserializeCaps(msg []byte) error {
 
 	caps := sbRadio.Capabilities{}
@@ -36,6 +89,56 @@ func (r *RemoteRadio) DeserializeCaps(msg []byte) error {
 	return nil
 }
 
+func (r *RemoteRadio) DeserializeMeters(msg []byte) error {
+
+	reading := meter.Reading{}
+	if err := reading.Unmarshal(msg); err != nil {
+		return err
+	}
+
+	// discard readings which arrive out of order
+	if reading.Timestamp < r.meters.Timestamp {
+		return nil
+	}
+
+	r.meters = reading
+
+	return nil
+}
+
+func (r *RemoteRadio) updatePowerLimit(pl bandplan.ActivePowerLimit) {
+
+	if pl != r.powerLimit {
+		r.powerLimit = pl
+		if r.printRigUpdates {
+			r.logger.Printf("Updated power limit: %v (%s, RFPOWER %.2f)\n", pl.Active, pl.Band, pl.RfPower)
+		}
+	}
+}
+
+// DeserializeRigStatus decodes the status of the connection between
+// the server and the rig. An empty message clears the status.
+func (r *RemoteRadio) DeserializeRigStatus(msg []byte) error {
+
+	if len(msg) == 0 {
+		r.rigStatus = rigstatus.Status{}
+		return nil
+	}
+
+	s := rigstatus.Status{}
+	if err := s.Unmarshal(msg); err != nil {
+		return err
+	}
+
+	if s.State != r.rigStatus.State || s.Error != r.rigStatus.Error {
+		r.logger.Println("Rig", s)
+	}
+
+	r.rigStatus = s
+
+	return nil
+}
+
 func (r *RemoteRadio) DeserializeCatResponse(msg []byte) error {
 
 	ns := sbRadio.State{}
@@ -44,6 +147,51 @@ func (r *RemoteRadio) DeserializeCatResponse(msg []byte) error {
 		return err
 	}
 
+	r.reported = delta.Copy(&ns)
+
+	return r.applyState(ns)
+}
+
+// DeserializeStateDelta applies a state delta received from the server.
+// If a delta got lost, a full snapshot of the state is requested.
+func (r *RemoteRadio) DeserializeStateDelta(msg []byte) error {
+
+	d := delta.Delta{}
+	if err := d.Unmarshal(msg); err != nil {
+		return err
+	}
+
+	r.ackRequest(d.Ack)
+
+	if !d.Full && (!r.stateSynced || d.Seq != r.stateSeq+1) {
+		r.stateSynced = false
+		// don't flood the server with requests while waiting for the snapshot
+		if time.Since(r.lastStateReq) > time.Second {
+			r.logger.Printf("state out of sync (seq %d, expected %d); requesting full state\n", d.Seq, r.stateSeq+1)
+			return r.RequestState()
+		}
+		return nil
+	}
+
+	r.stateSeq = d.Seq
+	r.stateSynced = true
+
+	if d.PowerLimit != nil {
+		r.updatePowerLimit(*d.PowerLimit)
+	}
+
+	ns := delta.Copy(&r.reported)
+	d.Apply(&ns)
+	r.reported = delta.Copy(&ns)
+
+	return r.applyState(ns)
+}
+
+func (r *RemoteRadio) applyState(ns sbRadio.State) error {
+
+	// values which are being changed locally take precedence
+	r.applyLocalChanges(&ns)
+
 	if ns.CurrentVfo != r.state.CurrentVfo {
 		r.state.CurrentVfo = ns.CurrentVfo
 		if r.printRigUpdates {
@@ -3,8 +3,14 @@ package remoteradio
 import (
 	"errors"
 
+	"github.com/dh1tw/gorigctl/bandplan"
 	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/meter"
+	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/presence"
+	"github.com/dh1tw/gorigctl/rigstatus"
 	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+	"github.com/dh1tw/gorigctl/serverstatus"
 )
 
 func (r *RemoteRadio) GetCaps() (sbRadio.Capabilities, error) {
@@ -15,6 +21,50 @@ func (r *RemoteRadio) GetState() (sbRadio.State, error) {
 	return r.state, nil
 }
 
+func (r *RemoteRadio) GetPowerLimit() (bandplan.ActivePowerLimit, error) {
+	return r.powerLimit, nil
+}
+
+func (r *RemoteRadio) GetRigStatus() (rigstatus.Status, error) {
+	return r.rigStatus, nil
+}
+
+func (r *RemoteRadio) GetOperators() ([]presence.Presence, error) {
+	return r.operators, nil
+}
+
+// GetOperatorLatency returns the statistics of the operators' links,
+// as measured by the server
+func (r *RemoteRadio) GetOperatorLatency() (map[string]ping.Stats, error) {
+	return r.latency, nil
+}
+
+// GetServerStatus returns the last status (heartbeat) published by
+// the server
+func (r *RemoteRadio) GetServerStatus() (serverstatus.Status, error) {
+	return r.serverStatus, nil
+}
+
+func (r *RemoteRadio) GetNetStats() (ping.NetStats, error) {
+	return r.netStats, nil
+}
+
+// SetNetStats updates the statistics of the link to the server and
+// warns when the link becomes unsafe for transmitting (or recovers).
+func (r *RemoteRadio) SetNetStats(s ping.NetStats) {
+	wasUnsafe := r.netStats.Connected && r.netStats.PttUnsafe
+	r.netStats = s
+	if s.Connected && s.PttUnsafe && !wasUnsafe {
+		r.logger.Printf("WARNING: link to the server degraded (%s); PTT is unsafe\n", s.Reason)
+	} else if wasUnsafe && s.Connected && !s.PttUnsafe {
+		r.logger.Println("link to the server recovered")
+	}
+}
+
+func (r *RemoteRadio) GetMeters() (meter.Reading, error) {
+	return r.meters, nil
+}
+
 func (r *RemoteRadio) GetFrequency() (float64, error) {
 	return r.state.Vfo.Frequency, nil
 }
@@ -23,7 +73,9 @@ func (r *RemoteRadio) SetFrequency(freq float64) error {
 	req := r.initSetState()
 	req.Vfo.Frequency = freq
 	req.Md.HasFrequency = true
-	return r.sendCatRequest(req)
+	return r.sendDebounced("frequency", req, func(s *sbRadio.State) {
+		s.Vfo.Frequency = freq
+	})
 }
 
 func (r *RemoteRadio) GetMode() (string, int, error) {
@@ -60,7 +112,9 @@ func (r *RemoteRadio) SetRit(rit int) error {
 	req := r.initSetState()
 	req.Md.HasRit = true
 	req.Vfo.Rit = int32(rit)
-	return r.sendCatRequest(req)
+	return r.sendDebounced("rit", req, func(s *sbRadio.State) {
+		s.Vfo.Rit = int32(rit)
+	})
 }
 
 func (r *RemoteRadio) GetXit() (int, error) {
@@ -71,7 +125,9 @@ func (r *RemoteRadio) SetXit(xit int) error {
 	req := r.initSetState()
 	req.Md.HasXit = true
 	req.Vfo.Xit = int32(xit)
-	return r.sendCatRequest(req)
+	return r.sendDebounced("xit", req, func(s *sbRadio.State) {
+		s.Vfo.Xit = int32(xit)
+	})
 }
 
 func (r *RemoteRadio) GetAntenna() (int, error) {
@@ -90,6 +146,9 @@ func (r *RemoteRadio) GetPtt() (bool, error) {
 }
 
 func (r *RemoteRadio) SetPtt(ptt bool) error {
+	if ptt && r.netStats.Connected && r.netStats.PttUnsafe {
+		r.logger.Printf("WARNING: link to the server degraded (%s); the transmitter might not be released in time\n", r.netStats.Reason)
+	}
 	req := r.initSetState()
 	req.Md.HasPtt = true
 	req.Ptt = ptt
@@ -221,7 +280,11 @@ func (r *RemoteRadio) SetLevel(level string, value float32) error {
 	req.Md.HasLevels = true
 	req.Vfo.Levels = make(map[string]float32)
 	req.Vfo.Levels[level] = value
-	return r.sendCatRequest(req)
+	return r.sendDebounced("level."+level, req, func(s *sbRadio.State) {
+		if s.Vfo.Levels != nil {
+			s.Vfo.Levels[level] = value
+		}
+	})
 }
 
 func (r *RemoteRadio) GetParameter(parm string) (float32, error) {
@@ -242,6 +305,14 @@ func (r *RemoteRadio) SetParameter(parm string, value float32) error {
 
 func (r *RemoteRadio) sendCatRequest(req sbRadio.SetState) error {
 
+	// pending debounced requests must not be overtaken
+	r.flushDebounced()
+
+	return r.publishCatRequest(req)
+}
+
+func (r *RemoteRadio) publishCatRequest(req sbRadio.SetState) error {
+
 	if !r.radioOnline {
 		return errors.New("unable to send request since radio is offline")
 	}
@@ -251,6 +322,8 @@ func (r *RemoteRadio) sendCatRequest(req sbRadio.SetState) error {
 		return err
 	}
 
+	r.trackRequest(&req, data)
+
 	msg := comms.IOMsg{}
 	msg.Data = data
 	msg.Topic = r.catRequestTopic
@@ -1,23 +1,57 @@
 package remoteradio
 
 import (
+	"bytes"
+	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cskr/pubsub"
+	"github.com/dh1tw/gorigctl/alarm"
+	"github.com/dh1tw/gorigctl/bandplan"
 	"github.com/dh1tw/gorigctl/cli"
 	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/delta"
+	"github.com/dh1tw/gorigctl/meter"
+	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/polling"
+	"github.com/dh1tw/gorigctl/presence"
+	"github.com/dh1tw/gorigctl/rigstatus"
 	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+	"github.com/dh1tw/gorigctl/serverstatus"
+	"github.com/olekukonko/tablewriter"
 )
 
 type RemoteRadio struct {
 	state           sbRadio.State
 	caps            sbRadio.Capabilities
+	powerLimit      bandplan.ActivePowerLimit
+	meters          meter.Reading
+	rigStatus       rigstatus.Status
+	operators       []presence.Presence
+	latency         map[string]ping.Stats
+	serverStatus    serverstatus.Status
+	netStats        ping.NetStats
+	cmdLatency      cmdLatency
 	printRigUpdates bool
 	userID          string
 	radioOnline     bool
+	serverOnline    bool // according to the radio's status
+	stationDown     bool // the multi-radio server is offline
 	logger          *log.Logger
 	catRequestTopic string
+	alarmAckTopic   string
+	pollingReqTopic string
+	stateReqTopic   string
+	stateSeq        uint64
+	reported        sbRadio.State
+	rateLimit       int
+	debounced       map[string]*debounced
+	flushTimer      *time.Timer
+	stateSynced     bool
+	lastStateReq    time.Time
 	toWireCh        chan comms.IOMsg
 	events          *pubsub.PubSub
 }
@@ -46,10 +80,52 @@ func NewRemoteRadio(topic, userID string, toWire chan comms.IOMsg, logger *log.L
 	r.catRequestTopic = topic
 	r.logger = logger
 	r.events = events
+	r.reported = delta.Copy(&r.state)
+	r.debounced = make(map[string]*debounced)
+	r.flushTimer = time.NewTimer(time.Hour)
+	r.flushTimer.Stop()
+	r.cmdLatency = newCmdLatency()
 
 	return r
 }
 
+// SetAlarmAckTopic sets the topic on which protection alarms
+// (e.g. high SWR) are acknowledged.
+func (r *RemoteRadio) SetAlarmAckTopic(topic string) {
+	r.alarmAckTopic = topic
+}
+
+// SetPollingRequestTopic sets the topic on which the polling of a
+// field group can be changed.
+func (r *RemoteRadio) SetPollingRequestTopic(topic string) {
+	r.pollingReqTopic = topic
+}
+
+// SetStateRequestTopic sets the topic on which a full snapshot of the
+// radio's state can be requested from the server.
+func (r *RemoteRadio) SetStateRequestTopic(topic string) {
+	r.stateReqTopic = topic
+}
+
+// RequestState asks the server to publish a full snapshot of the
+// radio's state.
+func (r *RemoteRadio) RequestState() error {
+
+	if r.stateReqTopic == "" {
+		return nil
+	}
+
+	r.lastStateReq = time.Now()
+
+	msg := comms.IOMsg{}
+	msg.Data = []byte{'x'}
+	msg.Topic = r.stateReqTopic
+
+	r.toWireCh <- msg
+
+	return nil
+}
+
 func (r *RemoteRadio) initSetState() sbRadio.SetState {
 	request := sbRadio.SetState{}
 
@@ -113,6 +189,61 @@ func SetSyncInterval(r *RemoteRadio, log *log.Logger, args []string) {
 	}
 }
 
+func SetPolling(r *RemoteRadio, log *log.Logger, args []string) {
+	if len(args) < 2 || len(args) > 4 {
+		log.Println("ERROR: wrong number of arguments")
+		return
+	}
+
+	if r.pollingReqTopic == "" {
+		log.Println("ERROR: polling requests not supported")
+		return
+	}
+
+	req := polling.Request{
+		UserID: r.userID,
+		Group:  args[0],
+	}
+
+	switch args[1] {
+	case "off":
+		disabled := true
+		req.Disabled = &disabled
+	case "on":
+		disabled := false
+		req.Disabled = &disabled
+	default:
+		interval, err := time.ParseDuration(args[1])
+		if err != nil || interval <= 0 {
+			log.Println("ERROR: interval must be a positive duration (e.g. 500ms), on or off")
+			return
+		}
+		req.Interval = int64(interval / time.Millisecond)
+	}
+
+	if len(args) > 2 {
+		maxInterval, err := time.ParseDuration(args[2])
+		if err != nil || maxInterval <= 0 {
+			log.Println("ERROR: max. interval must be a positive duration (e.g. 5s)")
+			return
+		}
+		req.MaxInterval = int64(maxInterval / time.Millisecond)
+	}
+
+	if len(args) > 3 {
+		priority, err := strconv.Atoi(args[3])
+		if err != nil {
+			log.Println("ERROR: priority must be an integer")
+			return
+		}
+		req.Priority = priority
+	}
+
+	if err := polling.SendRequest(r.toWireCh, r.pollingReqTopic, req); err != nil {
+		log.Println("ERROR:", err)
+	}
+}
+
 func SetPrintRigUpdates(r *RemoteRadio, log *log.Logger, args []string) {
 	if err := cli.CheckArgs(args, 1); err != nil {
 		log.Println(err)
@@ -132,6 +263,136 @@ func GetPrintRigUpdates(r *RemoteRadio, log *log.Logger, args []string) {
 	log.Printf("Print rig updates: %v", r.printRigUpdates)
 }
 
+func AckAlarm(r *RemoteRadio, log *log.Logger, args []string) {
+	if r.alarmAckTopic == "" {
+		log.Println("ERROR: alarm acknowledgement not supported")
+		return
+	}
+
+	if err := alarm.SendAck(r.toWireCh, r.alarmAckTopic, r.userID); err != nil {
+		log.Println("ERROR:", err)
+	}
+}
+
+func GetPowerLimit(r *RemoteRadio, log *log.Logger, args []string) {
+	if !r.powerLimit.Active {
+		log.Println("No power limit active")
+		return
+	}
+	log.Printf("Power limit (%s): RFPOWER %.2f\n", r.powerLimit.Band, r.powerLimit.RfPower)
+}
+
+func GetRigStatus(r *RemoteRadio, log *log.Logger, args []string) {
+	if r.rigStatus.State == "" {
+		log.Println("Rig status unknown")
+		return
+	}
+	log.Printf("Rig %s since %s\n", r.rigStatus, r.rigStatus.Since.Local().Format("15:04:05"))
+	for _, f := range r.rigStatus.Fields {
+		log.Printf("  %s: %s after %d errors (%s: %s)\n", f.Field, f.State, f.Failures, f.Class, f.Error)
+	}
+}
+
+func Who(r *RemoteRadio, log *log.Logger, args []string) {
+	if len(r.operators) == 0 {
+		log.Println("No operators connected")
+		return
+	}
+	for _, p := range r.operators {
+		me := ""
+		if p.UserID == r.userID {
+			me = " (you)"
+		}
+		client := p.ClientType
+		if len(p.Version) > 0 {
+			client += " " + p.Version
+		}
+		link := ""
+		if l, ok := r.latency[p.UserID]; ok && l.Received > 0 {
+			link = fmt.Sprintf(", rtt %v, %.0f%% loss", l.P95.Round(time.Millisecond), l.Loss*100)
+		}
+		log.Printf("%s%s: %s, connected since %s%s\n", p.UserID, me, client,
+			p.SinceTime().Local().Format("2006-01-02 15:04:05"), link)
+	}
+}
+
+func GetServerStatus(r *RemoteRadio, log *log.Logger, args []string) {
+	s := r.serverStatus
+	if s.Timestamp == 0 {
+		log.Println("Server status unknown")
+		return
+	}
+	online := "offline"
+	if s.Online {
+		online = "online"
+	}
+	log.Printf("Server %s (version %s), last update %s\n", online, s.Version,
+		s.Time().Local().Format("2006-01-02 15:04:05"))
+	if s.Started > 0 {
+		log.Printf("Uptime: %v\n", time.Duration(s.Uptime)*time.Second)
+	}
+	if s.Rig == nil {
+		return
+	}
+	rig := s.Rig
+	log.Printf("Rig: %s %s (model %d, driver %s)\n", rig.Manufacturer, rig.Name,
+		rig.Model, rig.DriverVersion)
+	if len(rig.Port) > 0 {
+		log.Printf("Port: %s\n", rig.Port)
+	}
+	lastPoll := "never"
+	if rig.LastPoll > 0 {
+		lastPoll = rig.LastPollTime().Local().Format("2006-01-02 15:04:05")
+	}
+	log.Printf("State: %s, last successful poll: %s\n", rig.State, lastPoll)
+	log.Printf("Commands: %d (%d failed), poll errors: %d\n", rig.Commands,
+		rig.CommandErrors, rig.PollErrors)
+}
+
+func GetNetStats(r *RemoteRadio, log *log.Logger, args []string) {
+	s := r.netStats
+	if !s.Connected {
+		log.Println("Not connected")
+		return
+	}
+	log.Printf("Last round trip time: %v\n", s.Last.Round(time.Millisecond/10))
+	for _, w := range []ping.Stats{s.Short, s.Long} {
+		log.Printf("Last %v: %s\n", w.Window, w)
+	}
+	if s.PttUnsafe {
+		log.Printf("PTT is unsafe: %s\n", s.Reason)
+	} else {
+		log.Println("PTT is safe")
+	}
+}
+
+func GetCmdStats(r *RemoteRadio, log *log.Logger, args []string) {
+	stats, _ := r.GetCmdStats()
+	if len(stats) == 0 {
+		log.Println("No requests sent yet")
+		return
+	}
+
+	buf := bytes.Buffer{}
+	table := tablewriter.NewWriter(&buf)
+	table.SetHeader([]string{"Field", "Count", "Timeouts", "Min", "Avg", "P95", "Max", "Network", "Rig"})
+	table.SetAlignment(tablewriter.ALIGN_RIGHT)
+
+	ms := func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	}
+
+	for _, s := range stats {
+		table.Append([]string{s.Field, strconv.Itoa(s.Count), strconv.Itoa(s.Timeouts),
+			ms(s.Min), ms(s.Avg), ms(s.P95), ms(s.Max), ms(s.Network), ms(s.Rig)})
+	}
+	table.Render()
+
+	for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		log.Println(line)
+	}
+}
+
 func GetRemoteCliCmds() []RemoteCliCmd {
 
 	cliCmds := make([]RemoteCliCmd, 0, 40)
@@ -176,6 +437,17 @@ func GetRemoteCliCmds() []RemoteCliCmd {
 
 	cliCmds = append(cliCmds, cliSetSyncInterval)
 
+	cliSetPolling := RemoteCliCmd{
+		Cmd:         SetPolling,
+		Name:        "set_polling",
+		Shortcut:    "",
+		Parameters:  "Group, Interval [on, off], (Max. Interval), (Priority)",
+		Description: "Set the polling of a field group (meters, powerstat, vfo, split, settings, functions, levels, parameters)",
+		Example:     "set_polling levels 2s 30s 1",
+	}
+
+	cliCmds = append(cliCmds, cliSetPolling)
+
 	cliSetPrintUpdates := RemoteCliCmd{
 		Cmd:         SetPrintRigUpdates,
 		Name:        "set_print_rig_updates",
@@ -195,6 +467,69 @@ func GetRemoteCliCmds() []RemoteCliCmd {
 
 	cliCmds = append(cliCmds, cliGetPrintUpdates)
 
+	cliAckAlarm := RemoteCliCmd{
+		Cmd:         AckAlarm,
+		Name:        "ack_alarm",
+		Shortcut:    "",
+		Description: "Acknowledge a SWR / ALC alarm and unlock the transmitter",
+	}
+
+	cliCmds = append(cliCmds, cliAckAlarm)
+
+	cliGetPowerLimit := RemoteCliCmd{
+		Cmd:         GetPowerLimit,
+		Name:        "get_power_limit",
+		Shortcut:    "",
+		Description: "Get the maximum RFPOWER level permitted on the current band",
+	}
+
+	cliCmds = append(cliCmds, cliGetPowerLimit)
+
+	cliGetRigStatus := RemoteCliCmd{
+		Cmd:         GetRigStatus,
+		Name:        "get_rig_status",
+		Shortcut:    "",
+		Description: "Get the status of the connection between the server and the rig and the fields which can't be polled",
+	}
+
+	cliCmds = append(cliCmds, cliGetRigStatus)
+
+	cliWho := RemoteCliCmd{
+		Cmd:         Who,
+		Name:        "who",
+		Shortcut:    "",
+		Description: "List the operators connected to the radio",
+	}
+
+	cliCmds = append(cliCmds, cliWho)
+
+	cliServerStatus := RemoteCliCmd{
+		Cmd:         GetServerStatus,
+		Name:        "server_status",
+		Shortcut:    "",
+		Description: "Show the server's heartbeat: uptime, versions, rig model, port, rig state and counters",
+	}
+
+	cliCmds = append(cliCmds, cliServerStatus)
+
+	cliNetStats := RemoteCliCmd{
+		Cmd:         GetNetStats,
+		Name:        "net_stats",
+		Shortcut:    "",
+		Description: "Show the round trip time, jitter and packet loss of the link to the server",
+	}
+
+	cliCmds = append(cliCmds, cliNetStats)
+
+	cliCmdStats := RemoteCliCmd{
+		Cmd:         GetCmdStats,
+		Name:        "cmd_stats",
+		Shortcut:    "",
+		Description: "Show the time until requests have been applied by the rig and reported back, split into network and rig",
+	}
+
+	cliCmds = append(cliCmds, cliCmdStats)
+
 	return cliCmds
 
 }
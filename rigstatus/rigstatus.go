@@ -0,0 +1,76 @@
+package rigstatus
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// States of the connection between the radio server and the radio
+const (
+	Connected     = "connected"
+	Disconnected  = "disconnected"
+	Reconnecting  = "reconnecting"
+	NotResponding = "not responding"
+)
+
+// Classes of the errors returned by the rig
+const (
+	ErrNotImplemented   = "not implemented"
+	ErrInvalidParameter = "invalid parameter"
+	ErrTimeout          = "timeout"
+	ErrIO               = "io"
+	ErrOther            = "other"
+)
+
+// States of a field which can't be polled
+const (
+	FieldFailing  = "failing"  // retried with backoff
+	FieldDisabled = "disabled" // not supported by the rig
+)
+
+// FieldHealth describes a field (e.g. "frequency" or "level.AF")
+// which can't be read from the rig.
+type FieldHealth struct {
+	Field    string `json:"field"`
+	State    string `json:"state"`
+	Class    string `json:"class"`
+	Error    string `json:"error"`
+	Failures int    `json:"failures"`
+}
+
+// Status describes the connection between the radio server and the
+// radio (e.g. through the serial port). It is independent of the
+// server's MQTT online status.
+type Status struct {
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Attempts int       `json:"attempts,omitempty"`
+	Since    time.Time `json:"since"`
+	// Fields lists the fields which currently can't be polled
+	Fields []FieldHealth `json:"fields,omitempty"`
+}
+
+// Marshal encodes the status for the wire
+func (s *Status) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// Unmarshal decodes a status received from the wire
+func (s *Status) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, s)
+}
+
+// String returns a human readable description of the status
+func (s Status) String() string {
+
+	str := s.State
+	if s.Attempts > 0 {
+		str += " (attempt " + strconv.Itoa(s.Attempts) + ")"
+	}
+	if s.Error != "" {
+		str += ": " + s.Error
+	}
+
+	return str
+}
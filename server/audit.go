@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/dh1tw/gorigctl/audit"
+)
+
+// auditLog writes a request and its outcome to the audit trail
+func (r *localRadio) auditLog(userID, field string, oldValue, newValue interface{}, result string) {
+
+	e := audit.Entry{
+		UserID:   userID,
+		Field:    field,
+		OldValue: oldValue,
+		NewValue: newValue,
+		Result:   result,
+	}
+
+	r.countCommand(result == audit.ResultOK)
+
+	// only the requests of the clients are measured, not e.g. alarms
+	if !r.cmdMark.IsZero() {
+		r.commandMetrics(field, result)
+		// reported back to the client with the acknowledgement
+		if result != audit.ResultOK {
+			r.reqErrors = append(r.reqErrors, field+": "+result)
+		}
+	}
+
+	if err := r.settings.Audit.Log(e); err != nil {
+		r.appLogger.Println("unable to write audit trail:", err)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"time"
+
+	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/delta"
+	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+)
+
+// sendState publishes the changes of the radio's state since the last
+// update. If no StateDeltaTopic is configured, the full state is sent.
+// With LegacyFullState, the full state is sent in addition to the delta
+// for clients which don't support deltas.
+func (r *localRadio) sendState() error {
+
+	if len(r.settings.StateDeltaTopic) == 0 {
+		return r.sendFullState()
+	}
+
+	if r.stateSeq == 0 ||
+		(r.settings.SnapshotInterval > 0 && time.Since(r.lastSnapshot) > r.settings.SnapshotInterval) {
+		return r.sendSnapshot()
+	}
+
+	d, ok := delta.Diff(&r.publishedState, &r.state)
+	if !ok {
+		return r.sendSnapshot()
+	}
+
+	if r.powerLimit != r.sentPowerLimit {
+		r.addPowerLimit(&d)
+	}
+
+	// the acknowledgement of a request is sent even if the request
+	// didn't change anything
+	if d.Empty() && r.pendingAck == nil {
+		return nil
+	}
+
+	if err := r.sendDelta(d); err != nil {
+		return err
+	}
+
+	if r.settings.LegacyFullState {
+		return r.sendFullState()
+	}
+
+	return nil
+}
+
+// ackRequest confirms the execution of a request (data as received from
+// the wire) with the next state update
+func (r *localRadio) ackRequest(req *sbRadio.SetState, data []byte, received, started time.Time) {
+
+	r.pendingAck = &delta.Ack{
+		UserID:    req.UserId,
+		RequestID: delta.RequestID(data),
+		Queued:    int64(started.Sub(received) / time.Microsecond),
+		Applied:   int64(time.Since(started) / time.Microsecond),
+		Errors:    r.reqErrors,
+	}
+	r.reqErrors = nil
+}
+
+// sendSnapshot publishes the complete state as a delta message as well as
+// on the CatResponseTopic for clients which don't support deltas.
+func (r *localRadio) sendSnapshot() error {
+
+	if len(r.settings.StateDeltaTopic) == 0 {
+		return r.sendFullState()
+	}
+
+	r.lastSnapshot = time.Now()
+
+	d := delta.Snapshot(&r.state)
+	r.addPowerLimit(&d)
+
+	if err := r.sendDelta(d); err != nil {
+		return err
+	}
+
+	return r.sendFullState()
+}
+
+// addPowerLimit adds the active power limit to the delta
+func (r *localRadio) addPowerLimit(d *delta.Delta) {
+
+	if len(r.settings.PowerLimits) == 0 {
+		return
+	}
+
+	pl := r.powerLimit
+	d.PowerLimit = &pl
+	r.sentPowerLimit = pl
+}
+
+func (r *localRadio) sendDelta(d delta.Delta) error {
+
+	r.stateSeq++
+	d.Seq = r.stateSeq
+	d.Ack = r.pendingAck
+	r.pendingAck = nil
+
+	data, err := d.Marshal()
+	if err != nil {
+		return err
+	}
+
+	msg := comms.IOMsg{}
+	msg.Data = data
+	msg.Topic = r.settings.StateDeltaTopic
+	msg.Retain = false
+
+	r.settings.ToWireCh <- msg
+
+	r.publishedState = delta.Copy(&r.state)
+	r.stateMetrics()
+	r.exportState()
+	r.publishHaState()
+
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	hl "github.com/dh1tw/goHamlib"
+	"github.com/dh1tw/gorigctl/audit"
 	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
 	"github.com/dh1tw/gorigctl/utils"
 )
@@ -21,9 +22,12 @@ func (r *localRadio) deserializeCatRequest(request []byte) error {
 	if ns.Md.HasRadioOn {
 		if ns.GetRadioOn() != r.state.RadioOn {
 			r.appLogger.Printf("%s requested to set powerstat to %v", ns.GetUserId(), ns.GetRadioOn())
-			if err := r.updatePowerOn(ns.GetRadioOn()); err != nil {
+			oldRadioOn := r.state.RadioOn
+			err := r.updatePowerOn(ns.GetRadioOn())
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			r.auditLog(ns.GetUserId(), "radio_on", oldRadioOn, ns.GetRadioOn(), audit.Result(err))
 
 			return nil
 		}
@@ -33,23 +37,36 @@ func (r *localRadio) deserializeCatRequest(request []byte) error {
 
 	if ns.GetCurrentVfo() != r.state.CurrentVfo {
 		r.appLogger.Printf("%s requested to set vfo to %v", ns.GetUserId(), ns.GetCurrentVfo())
-		if err := r.updateCurrentVfo(ns.GetCurrentVfo()); err != nil {
+		oldVfo := r.state.CurrentVfo
+		err := r.updateCurrentVfo(ns.GetCurrentVfo())
+		if err != nil {
 			r.radioLogger.Println(err)
 		}
+		r.auditLog(ns.GetUserId(), "vfo", oldVfo, ns.GetCurrentVfo(), audit.Result(err))
 	}
 
 	if len(ns.GetVfoOperations()) > 0 {
 		r.appLogger.Printf("%s requested execution of vfo operation(s) %v", ns.GetUserId(), ns.GetVfoOperations())
-		if err := r.execVfoOperations(ns.GetVfoOperations()); err != nil {
+		err := r.execVfoOperations(ns.GetVfoOperations())
+		if err != nil {
 			r.radioLogger.Println(err)
 		}
+		r.auditLog(ns.GetUserId(), "vfo_operations", nil, ns.GetVfoOperations(), audit.Result(err))
 	}
 
 	if ns.Md.HasFrequency {
 		if ns.Vfo.GetFrequency() != r.state.Vfo.Frequency {
 			r.appLogger.Printf("%s requested to set frequency to %.0f Hz\n", ns.GetUserId(), ns.Vfo.GetFrequency())
-			if err := r.updateFrequency(ns.Vfo.GetFrequency()); err != nil {
-				r.radioLogger.Println(err)
+			oldFreq := r.state.Vfo.Frequency
+			if err := r.checkQsyWhileTx(ns.GetUserId(), ns.Vfo.GetFrequency(), r.state.Vfo.Mode); err != nil {
+				r.radioLogger.Println("frequency change rejected:", err)
+				r.auditLog(ns.GetUserId(), "frequency", oldFreq, ns.Vfo.GetFrequency(), audit.Denied(err))
+			} else {
+				err := r.updateFrequency(ns.Vfo.GetFrequency())
+				if err != nil {
+					r.radioLogger.Println(err)
+				}
+				r.auditLog(ns.GetUserId(), "frequency", oldFreq, ns.Vfo.GetFrequency(), audit.Result(err))
 			}
 		}
 	}
@@ -57,8 +74,16 @@ func (r *localRadio) deserializeCatRequest(request []byte) error {
 	if ns.Md.HasMode {
 		if ns.Vfo.GetMode() != r.state.Vfo.Mode {
 			r.appLogger.Printf("%s requested to set mode to %v", ns.GetUserId(), ns.Vfo.GetMode())
-			if err := r.updateMode(ns.Vfo.GetMode(), ns.Vfo.GetPbWidth()); err != nil {
-				r.radioLogger.Println(err)
+			oldMode := r.state.Vfo.Mode
+			if err := r.checkQsyWhileTx(ns.GetUserId(), r.state.Vfo.Frequency, ns.Vfo.GetMode()); err != nil {
+				r.radioLogger.Println("mode change rejected:", err)
+				r.auditLog(ns.GetUserId(), "mode", oldMode, ns.Vfo.GetMode(), audit.Denied(err))
+			} else {
+				err := r.updateMode(ns.Vfo.GetMode(), ns.Vfo.GetPbWidth())
+				if err != nil {
+					r.radioLogger.Println(err)
+				}
+				r.auditLog(ns.GetUserId(), "mode", oldMode, ns.Vfo.GetMode(), audit.Result(err))
 			}
 		}
 	}
@@ -66,44 +91,64 @@ func (r *localRadio) deserializeCatRequest(request []byte) error {
 	if ns.Md.HasPbWidth {
 		if ns.Vfo.GetPbWidth() != r.state.Vfo.PbWidth {
 			r.appLogger.Printf("%s requested to set pbwidth to %d Hz\n", ns.GetUserId(), ns.Vfo.GetPbWidth())
-			if err := r.updatePbWidth(ns.Vfo.GetPbWidth()); err != nil {
+			oldPbWidth := r.state.Vfo.PbWidth
+			err := r.updatePbWidth(ns.Vfo.GetPbWidth())
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			r.auditLog(ns.GetUserId(), "pb_width", oldPbWidth, ns.Vfo.GetPbWidth(), audit.Result(err))
 		}
 	}
 
 	if ns.Md.HasAnt {
 		if ns.Vfo.GetAnt() != r.state.Vfo.Ant {
 			r.appLogger.Printf("%s requested to set antenna to %v\n", ns.GetUserId(), ns.Vfo.GetAnt())
-			if err := r.updateAntenna(ns.Vfo.GetAnt()); err != nil {
+			oldAnt := r.state.Vfo.Ant
+			err := r.updateAntenna(ns.Vfo.GetAnt())
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			r.auditLog(ns.GetUserId(), "antenna", oldAnt, ns.Vfo.GetAnt(), audit.Result(err))
 		}
 	}
 
 	if ns.Md.HasRit {
 		if ns.Vfo.GetRit() != r.state.Vfo.Rit {
 			r.appLogger.Printf("%s requested to set rit to %d Hz\n", ns.GetUserId(), ns.Vfo.GetRit())
-			if err := r.updateRit(ns.Vfo.GetRit()); err != nil {
+			oldRit := r.state.Vfo.Rit
+			err := r.updateRit(ns.Vfo.GetRit())
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			r.auditLog(ns.GetUserId(), "rit", oldRit, ns.Vfo.GetRit(), audit.Result(err))
 		}
 	}
 
 	if ns.Md.HasXit {
 		if ns.Vfo.GetXit() != r.state.Vfo.Xit {
 			r.appLogger.Printf("%s requested to set xit to %d Hz\n", ns.GetUserId(), ns.Vfo.GetXit())
-			if err := r.updateXit(ns.Vfo.GetXit()); err != nil {
+			oldXit := r.state.Vfo.Xit
+			err := r.updateXit(ns.Vfo.GetXit())
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			r.auditLog(ns.GetUserId(), "xit", oldXit, ns.Vfo.GetXit(), audit.Result(err))
 		}
 	}
 
 	if ns.Md.HasSplit {
 		if !reflect.DeepEqual(ns.Vfo.GetSplit(), r.state.Vfo.Split) {
 			r.appLogger.Printf("%s requested to set split to %v\n", ns.GetUserId(), ns.Vfo.GetSplit())
-			if err := r.updateSplit(ns.Vfo.GetSplit()); err != nil {
-				r.radioLogger.Println(err)
+			oldSplit := *r.state.Vfo.Split
+			if err := r.checkSplitWhileTx(ns.GetUserId(), ns.Vfo.GetSplit()); err != nil {
+				r.radioLogger.Println("split change rejected:", err)
+				r.auditLog(ns.GetUserId(), "split", oldSplit, ns.Vfo.GetSplit(), audit.Denied(err))
+			} else {
+				err := r.updateSplit(ns.Vfo.GetSplit())
+				if err != nil {
+					r.radioLogger.Println(err)
+				}
+				r.auditLog(ns.GetUserId(), "split", oldSplit, ns.Vfo.GetSplit(), audit.Result(err))
 			}
 		}
 	}
@@ -111,45 +156,73 @@ func (r *localRadio) deserializeCatRequest(request []byte) error {
 	if ns.Md.HasTuningStep {
 		if ns.Vfo.GetTuningStep() != r.state.Vfo.TuningStep {
 			r.appLogger.Printf("%s requested to set tuning step to %d Hz\n", ns.GetUserId(), ns.Vfo.GetTuningStep())
-			if err := r.updateTs(ns.Vfo.GetTuningStep()); err != nil {
+			oldTuningStep := r.state.Vfo.TuningStep
+			err := r.updateTs(ns.Vfo.GetTuningStep())
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			r.auditLog(ns.GetUserId(), "tuning_step", oldTuningStep, ns.Vfo.GetTuningStep(), audit.Result(err))
 		}
 	}
 
 	if ns.Md.HasFunctions {
 		if !reflect.DeepEqual(ns.Vfo.GetFunctions(), r.state.Vfo.Functions) {
 			r.appLogger.Printf("%s requested to set the function(s):\n", ns.GetUserId())
+			oldFuncs := make(map[string]bool, len(r.state.Vfo.Functions))
+			for funcName, funcValue := range r.state.Vfo.Functions {
+				oldFuncs[funcName] = funcValue
+			}
 			for funcName, funcValue := range ns.Vfo.GetFunctions() {
 				r.appLogger.Printf(" - %v: %v", funcName, funcValue)
 			}
-			if err := r.updateFunctions(ns.Vfo.GetFunctions()); err != nil {
+			err := r.updateFunctions(ns.Vfo.GetFunctions())
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			for funcName, funcValue := range ns.Vfo.GetFunctions() {
+				r.auditLog(ns.GetUserId(), "function."+funcName, oldFuncs[funcName], funcValue, audit.Result(err))
+			}
 		}
 	}
 
 	if ns.Md.HasLevels {
 		if !reflect.DeepEqual(ns.Vfo.GetLevels(), r.state.Vfo.Levels) {
 			r.appLogger.Printf("%s requested to set the level(s):\n", ns.GetUserId())
+			oldLevels := make(map[string]float32, len(r.state.Vfo.Levels))
+			for levelName, levelValue := range r.state.Vfo.Levels {
+				oldLevels[levelName] = levelValue
+			}
 			for levelName, levelValue := range ns.Vfo.GetLevels() {
 				r.appLogger.Printf(" - %v: %v", levelName, levelValue)
 			}
-			if err := r.updateLevels(ns.Vfo.GetLevels()); err != nil {
+			newLevels := r.clampRfPower(ns.Vfo.GetLevels())
+			err := r.updateLevels(newLevels)
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			for levelName, levelValue := range newLevels {
+				r.auditLog(ns.GetUserId(), "level."+levelName, oldLevels[levelName], levelValue, audit.Result(err))
+			}
 		}
 	}
 
 	if ns.Md.HasParameters {
 		if !reflect.DeepEqual(ns.Vfo.GetParameters(), r.state.Vfo.Parameters) {
 			r.appLogger.Printf("%s requested to set the parameter(s):\n", ns.GetUserId())
+			oldParams := make(map[string]float32, len(r.state.Vfo.Parameters))
+			for parmName, parmValue := range r.state.Vfo.Parameters {
+				oldParams[parmName] = parmValue
+			}
 			for parmName, parmValue := range ns.Vfo.GetParameters() {
 				r.appLogger.Printf(" - %v: %v", parmName, parmValue)
 			}
-			if err := r.updateParams(ns.Vfo.GetParameters()); err != nil {
+			err := r.updateParams(ns.Vfo.GetParameters())
+			if err != nil {
 				r.radioLogger.Println(err)
 			}
+			for parmName, parmValue := range ns.Vfo.GetParameters() {
+				r.auditLog(ns.GetUserId(), "parameter."+parmName, oldParams[parmName], parmValue, audit.Result(err))
+			}
 		}
 	}
 	// }
@@ -157,8 +230,24 @@ func (r *localRadio) deserializeCatRequest(request []byte) error {
 	if ns.Md.HasPtt {
 		if ns.GetPtt() != r.state.Ptt {
 			r.appLogger.Printf("%s requested to set ptt to %v\n", ns.GetUserId(), ns.GetPtt())
-			if err := r.updatePtt(ns.GetPtt()); err != nil {
-				r.radioLogger.Println(err)
+			oldPtt := r.state.Ptt
+			if err := r.checkPtt(ns.GetUserId(), ns.GetPtt()); err != nil {
+				r.radioLogger.Println("ptt rejected:", err)
+				r.auditLog(ns.GetUserId(), "ptt", oldPtt, ns.GetPtt(), audit.Denied(err))
+			} else {
+				err := r.updatePtt(ns.GetPtt())
+				if err != nil {
+					r.radioLogger.Println(err)
+				}
+				r.auditLog(ns.GetUserId(), "ptt", oldPtt, ns.GetPtt(), audit.Result(err))
+			}
+			// remember who keyed the transmitter so that we can release
+			// the PTT if this client disconnects unexpectedly
+			if r.state.Ptt {
+				r.pttUser = ns.GetUserId()
+				r.pttKeyed = time.Now()
+			} else {
+				r.pttUser = ""
 			}
 		}
 	}
@@ -167,13 +256,14 @@ func (r *localRadio) deserializeCatRequest(request []byte) error {
 		if ns.GetPollingInterval() != r.state.PollingInterval {
 			if ns.GetPollingInterval() > 0 {
 				r.appLogger.Printf("%s requested to set rig polling interval to %dms\n", ns.GetUserId(), ns.GetPollingInterval())
+				r.auditLog(ns.GetUserId(), "polling_interval", r.state.PollingInterval, ns.GetPollingInterval(), audit.ResultOK)
 				newPollingInterval := time.Millisecond * time.Duration(ns.GetPollingInterval())
-				r.pollingTicker.Stop()
-				r.pollingTicker = time.NewTicker(newPollingInterval)
+				r.setPollingInterval(newPollingInterval)
 				r.state.PollingInterval = ns.GetPollingInterval()
 			} else {
 				r.appLogger.Printf("%s requested to stop rig polling\n", ns.GetUserId())
-				r.pollingTicker.Stop()
+				r.auditLog(ns.GetUserId(), "polling_interval", r.state.PollingInterval, 0, audit.ResultOK)
+				r.setPollingInterval(0)
 				r.state.PollingInterval = 0
 			}
 		}
@@ -183,13 +273,14 @@ func (r *localRadio) deserializeCatRequest(request []byte) error {
 		if ns.GetSyncInterval() != r.state.SyncInterval {
 			if ns.GetSyncInterval() > 0 {
 				r.appLogger.Printf("%s requested to set rig sync interval to %ds\n", ns.GetUserId(), ns.GetSyncInterval())
+				r.auditLog(ns.GetUserId(), "sync_interval", r.state.SyncInterval, ns.GetSyncInterval(), audit.ResultOK)
 				newSyncInterval := time.Second * time.Duration(ns.GetSyncInterval())
-				r.syncTicker.Stop()
-				r.syncTicker = time.NewTicker(newSyncInterval)
+				r.setSyncInterval(newSyncInterval)
 				r.state.SyncInterval = ns.GetSyncInterval()
 			} else {
 				r.appLogger.Printf("%s requested to stop rig sync\n", ns.GetUserId())
-				r.syncTicker.Stop()
+				r.auditLog(ns.GetUserId(), "sync_interval", r.state.SyncInterval, 0, audit.ResultOK)
+				r.setSyncInterval(0)
 				r.state.SyncInterval = 0
 			}
 		}
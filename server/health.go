@@ -0,0 +1,212 @@
+package server
+
+import (
+	"sort"
+	"syscall"
+	"time"
+
+	hl "github.com/dh1tw/goHamlib"
+	"github.com/dh1tw/gorigctl/metrics"
+	"github.com/dh1tw/gorigctl/rigstatus"
+)
+
+const (
+	// unsupportedThreshold is the number of consecutive errors after
+	// which a field which is not supported by the rig is no longer polled
+	unsupportedThreshold = 3
+
+	fieldMinBackoff = time.Second
+	fieldMaxBackoff = time.Minute
+)
+
+// classifyError maps a hamlib error onto an error class. goHamlib
+// returns a *hl.HamlibError if hamlib reported an error and wraps the
+// errno of a failed system call (e.g. of the serial port) in a
+// *hl.Error.
+func classifyError(err error) string {
+
+	for {
+		wrapped, ok := err.(*hl.Error)
+		if !ok {
+			break
+		}
+		err = wrapped.UnderlyingError
+	}
+
+	if errno, ok := err.(syscall.Errno); ok {
+		switch errno {
+		case syscall.EIO, syscall.ENXIO, syscall.ENODEV, syscall.EBADF:
+			return rigstatus.ErrIO
+		case syscall.EAGAIN, syscall.ETIMEDOUT:
+			return rigstatus.ErrTimeout
+		}
+		return rigstatus.ErrOther
+	}
+
+	hlErr, ok := err.(*hl.HamlibError)
+	if !ok {
+		return rigstatus.ErrOther
+	}
+
+	switch hlErr.Errorcode {
+	case hl.RIG_ENIMPL, hl.RIG_ENAVAIL:
+		return rigstatus.ErrNotImplemented
+	case hl.RIG_EINVAL, hl.RIG_EARG, hl.RIG_EDOM, hl.RIG_ENTARGET, hl.RIG_EVFO:
+		return rigstatus.ErrInvalidParameter
+	case hl.RIG_ETIMEOUT:
+		return rigstatus.ErrTimeout
+	case hl.RIG_EIO, hl.RIG_BUSERROR, hl.RIG_BUSBUSY:
+		return rigstatus.ErrIO
+	}
+
+	return rigstatus.ErrOther
+}
+
+// isIoError returns true if the error class indicates that the
+// connection to the radio is broken (as opposed to e.g. an unsupported
+// command)
+func isIoError(class string) bool {
+	return class == rigstatus.ErrTimeout || class == rigstatus.ErrIO
+}
+
+// fieldState keeps track of the errors of a polled field
+// (e.g. "frequency" or "level.AF")
+type fieldState struct {
+	failures int
+	class    string
+	lastErr  string
+	disabled bool
+	backoff  time.Duration
+	nextTry  time.Time
+}
+
+// canPoll returns false if the field has been disabled or if it is
+// backing off after a transient error
+func (r *localRadio) canPoll(field string) bool {
+
+	f, ok := r.fields[field]
+	if !ok {
+		return true
+	}
+
+	return !f.disabled && !time.Now().Before(f.nextTry)
+}
+
+// fieldResult records the outcome of reading a field and returns err.
+// Only changes of the field's health are logged: the first failure,
+// disabling an unsupported field and the recovery.
+func (r *localRadio) fieldResult(field string, err error) error {
+
+	class := ""
+	if err != nil {
+		class = classifyError(err)
+	}
+
+	if isIoError(class) {
+		r.ioErrors++
+		r.lastIoErr = err
+	} else {
+		r.ioErrors = 0
+	}
+
+	f, ok := r.fields[field]
+
+	if err == nil {
+		if ok {
+			r.radioLogger.Printf("%s: polling works again\n", field)
+			delete(r.fields, field)
+			r.publishFieldHealth()
+		}
+		return nil
+	}
+
+	r.settings.Metrics.Inc(metrics.HamlibErrors, metrics.Labels{"class": class})
+
+	if !ok {
+		f = &fieldState{}
+		r.fields[field] = f
+		r.radioLogger.Printf("%s: %v\n", field, err)
+	}
+
+	changed := !ok || class != f.class
+	if class != f.class {
+		f.failures = 0
+	}
+	f.failures++
+	f.class = class
+	f.lastErr = err.Error()
+
+	switch class {
+	case rigstatus.ErrNotImplemented, rigstatus.ErrInvalidParameter:
+		if f.failures >= unsupportedThreshold {
+			f.disabled = true
+			changed = true
+			r.radioLogger.Printf("%s: not supported by the rig (%v); polling disabled\n", field, err)
+		}
+	default:
+		f.backoff *= 2
+		if f.backoff < fieldMinBackoff {
+			f.backoff = fieldMinBackoff
+		}
+		if f.backoff > fieldMaxBackoff {
+			f.backoff = fieldMaxBackoff
+		}
+		f.nextTry = time.Now().Add(f.backoff)
+	}
+
+	if changed {
+		r.publishFieldHealth()
+	}
+
+	return err
+}
+
+// resetFieldBackoff retries all fields with transient errors, e.g.
+// after the connection to the rig has been reestablished
+func (r *localRadio) resetFieldBackoff() {
+	for field, f := range r.fields {
+		if !f.disabled {
+			delete(r.fields, field)
+		}
+	}
+	r.publishFieldHealth()
+}
+
+// fieldHealth returns the fields which currently can't be polled
+func (r *localRadio) fieldHealth() []rigstatus.FieldHealth {
+
+	health := []rigstatus.FieldHealth{}
+
+	for field, f := range r.fields {
+		h := rigstatus.FieldHealth{
+			Field:    field,
+			Class:    f.class,
+			Error:    f.lastErr,
+			Failures: f.failures,
+			State:    rigstatus.FieldFailing,
+		}
+		if f.disabled {
+			h.State = rigstatus.FieldDisabled
+		}
+		health = append(health, h)
+	}
+
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Field < health[j].Field
+	})
+
+	return health
+}
+
+// publishFieldHealth publishes the rig status with the current
+// health of the polled fields
+func (r *localRadio) publishFieldHealth() {
+
+	health := r.fieldHealth()
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	r.rigStatus.Fields = health
+	r.publishRigStatus()
+}
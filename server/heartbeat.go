@@ -0,0 +1,82 @@
+package server
+
+import (
+	"time"
+
+	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/serverstatus"
+)
+
+// rigCounters are published with the server's heartbeat. They are
+// guarded by statusMu since they are updated on the rig worker.
+type rigCounters struct {
+	commands      uint64
+	commandErrors uint64
+	pollErrors    uint64
+	lastPoll      time.Time
+}
+
+// countCommand records the outcome of a client's request. Other
+// changes which are audited (e.g. the reactions to an alarm) are not
+// counted; they are made outside of a client's request (cmdMark).
+func (r *localRadio) countCommand(ok bool) {
+
+	if r.cmdMark.IsZero() {
+		return
+	}
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	r.counters.commands++
+	if !ok {
+		r.counters.commandErrors++
+	}
+}
+
+// countPoll records the outcome of polling the rig
+func (r *localRadio) countPoll(err error) {
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	if err != nil {
+		r.counters.pollErrors++
+		return
+	}
+	r.counters.lastPoll = time.Now()
+}
+
+// rigHealth returns the health of the rig for the server's heartbeat
+func (r *localRadio) rigHealth() serverstatus.Rig {
+
+	h := serverstatus.Rig{
+		Model:         r.settings.RigModel,
+		Manufacturer:  r.rig.Caps.MfgName,
+		Name:          r.rig.Caps.ModelName,
+		DriverVersion: r.rig.Caps.Version,
+	}
+
+	// the dummy rig doesn't use a port
+	if r.settings.RigModel != 1 {
+		h.Port = r.settings.Port.Portname
+	}
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	h.State = r.rigStatus.State
+	h.Commands = r.counters.commands
+	h.CommandErrors = r.counters.commandErrors
+	h.PollErrors = r.counters.pollErrors
+	if !r.counters.lastPoll.IsZero() {
+		h.LastPoll = r.counters.lastPoll.UnixNano() / int64(time.Millisecond)
+	}
+
+	return h
+}
+
+// publishRigHealth publishes the health of the rig on events.RigHealth
+func (r *localRadio) publishRigHealth() {
+	r.settings.Events.Pub(r.rigHealth(), events.RigHealth)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/homeassistant"
+	"github.com/dh1tw/gorigctl/rigstatus"
+)
+
+// haMeterInterval is the min. time between two meter updates for
+// Home Assistant
+const haMeterInterval = time.Second
+
+// publishHaDiscovery publishes the (retained) discovery configs of the
+// entities which are supported by the rig
+func (r *localRadio) publishHaDiscovery() {
+
+	if r.settings.HomeAssistant == nil {
+		return
+	}
+
+	caps := r.capabilities()
+
+	for _, d := range homeassistant.Configs(*r.settings.HomeAssistant, &caps) {
+		data, err := json.Marshal(d.Config)
+		if err != nil {
+			r.appLogger.Println(err)
+			continue
+		}
+		r.settings.ToWireCh <- comms.IOMsg{
+			Topic:  d.Topic,
+			Data:   data,
+			Retain: true,
+		}
+	}
+}
+
+// publishHaState publishes the state for Home Assistant if it has changed
+func (r *localRadio) publishHaState() {
+
+	if r.settings.HomeAssistant == nil {
+		return
+	}
+
+	s := homeassistant.State{
+		RadioOn:   r.state.RadioOn,
+		Ptt:       r.state.Ptt,
+		Frequency: r.state.Vfo.Frequency,
+		Mode:      r.state.Vfo.Mode,
+		Functions: r.state.Vfo.Functions,
+	}
+	if rfPower, ok := r.state.Vfo.Levels["RFPOWER"]; ok {
+		s.RfPower = &rfPower
+	}
+
+	data, err := s.Marshal()
+	if err != nil {
+		r.appLogger.Println(err)
+		return
+	}
+
+	if bytes.Equal(data, r.haState) {
+		return
+	}
+	r.haState = data
+
+	r.settings.ToWireCh <- comms.IOMsg{
+		Topic:  homeassistant.StateTopic(r.settings.BaseTopic),
+		Data:   data,
+		Retain: true,
+	}
+}
+
+// publishHaMeters publishes the last readings of the meters for Home
+// Assistant, at most every haMeterInterval. Meters which are only read
+// while transmitting keep their last value.
+func (r *localRadio) publishHaMeters(values map[string]float32) {
+
+	if r.settings.HomeAssistant == nil {
+		return
+	}
+
+	if r.haMeters == nil {
+		r.haMeters = make(map[string]float32)
+	}
+
+	for _, level := range homeassistant.MeterLevels() {
+		if value, ok := values[level]; ok {
+			r.haMeters[strings.ToLower(level)] = value
+		}
+	}
+
+	if len(r.haMeters) == 0 || time.Since(r.lastHaMeters) < haMeterInterval {
+		return
+	}
+	r.lastHaMeters = time.Now()
+
+	data, err := json.Marshal(r.haMeters)
+	if err != nil {
+		r.appLogger.Println(err)
+		return
+	}
+
+	r.settings.ToWireCh <- comms.IOMsg{
+		Topic:  homeassistant.MetersTopic(r.settings.BaseTopic),
+		Data:   data,
+		Retain: true,
+	}
+}
+
+// checkHaPttTimeout releases the PTT if it has been keyed from Home
+// Assistant for longer than the configured timeout. Unlike the clients,
+// Home Assistant has no last will which would release the PTT if Home
+// Assistant or the connection to the broker fail. It is retried with
+// each meter poll until the rig confirms the release.
+func (r *localRadio) checkHaPttTimeout() error {
+
+	ha := r.settings.HomeAssistant
+
+	if ha == nil || !r.state.Ptt || r.pttUser != homeassistant.UserID ||
+		time.Since(r.pttKeyed) < ha.PttTimeout {
+		return nil
+	}
+
+	if err := r.updatePtt(false); err != nil {
+		return fmt.Errorf("unable to release PTT keyed by home assistant: %v", err)
+	}
+
+	if r.state.Ptt {
+		return errors.New("unable to release PTT keyed by home assistant: rig still transmitting")
+	}
+
+	r.radioLogger.Printf("PTT keyed by home assistant for more than %v; released\n", ha.PttTimeout)
+	r.auditLog(homeassistant.UserID, "ptt", true, false, "released (timeout)")
+	r.pttUser = ""
+
+	return r.sendState()
+}
+
+// handleHaCommand executes the command of a switch in Home Assistant
+// like a request of a client
+func (r *localRadio) handleHaCommand(msg comms.IOMsg) {
+
+	if r.settings.HomeAssistant == nil {
+		return
+	}
+
+	if state := r.getRigState(); state == rigstatus.Disconnected || state == rigstatus.Reconnecting {
+		r.radioLogger.Printf("rig %s; ignoring home assistant command\n", state)
+		return
+	}
+
+	object := msg.Topic[strings.LastIndex(msg.Topic, "/")+1:]
+
+	ns, err := homeassistant.ParseCommand(*r.settings.HomeAssistant, object, string(msg.Data))
+	if err != nil {
+		r.appLogger.Println("home assistant:", err)
+		return
+	}
+
+	priority, key := catRequestPriority(&ns)
+	received := time.Now()
+
+	exec := func() {
+		ns.CurrentVfo = r.state.CurrentVfo
+		data, err := ns.Marshal()
+		if err != nil {
+			r.appLogger.Println(err)
+			return
+		}
+		r.execCatRequest(data, &ns, received)
+	}
+
+	if isPttRelease(&ns) {
+		r.submitSafety("home assistant ptt release", exec)
+	} else {
+		r.submit("home assistant", priority, key, exec)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/dh1tw/gorigctl/influx"
+	"github.com/dh1tw/gorigctl/meter"
+)
+
+// InfluxSettings configure the export of the radio's state and meter
+// readings to InfluxDB
+type InfluxSettings struct {
+	PointsCh      chan influx.Point // nil = disabled
+	MeterInterval time.Duration     // min. time between two exported meter readings
+}
+
+// exportState writes the main settings of the radio as a point of the
+// "radio_state" measurement whenever one of them has changed
+func (r *localRadio) exportState() {
+
+	if r.settings.Influx.PointsCh == nil {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"radio_on":  r.state.RadioOn,
+		"ptt":       r.state.Ptt,
+		"vfo":       r.state.CurrentVfo,
+		"frequency": r.state.Vfo.Frequency,
+		"mode":      r.state.Vfo.Mode,
+		"pb_width":  r.state.Vfo.PbWidth,
+		"rit":       r.state.Vfo.Rit,
+		"xit":       r.state.Vfo.Xit,
+	}
+
+	if split := r.state.Vfo.Split; split != nil {
+		fields["split"] = split.Enabled
+		if split.Enabled {
+			fields["split_frequency"] = split.Frequency
+		}
+	}
+
+	if reflect.DeepEqual(fields, r.exportedState) {
+		return
+	}
+	r.exportedState = fields
+
+	r.export(influx.Point{
+		Measurement: "radio_state",
+		Fields:      fields,
+		Time:        time.Now(),
+	})
+}
+
+// exportMeters writes the meter reading as a point of the
+// "radio_meters" measurement, at most every MeterInterval
+func (r *localRadio) exportMeters(reading meter.Reading) {
+
+	if r.settings.Influx.PointsCh == nil || len(reading.Values) == 0 {
+		return
+	}
+
+	ts := time.Unix(0, reading.Timestamp*int64(time.Millisecond))
+	if ts.Sub(r.lastMeterExport) < r.settings.Influx.MeterInterval {
+		return
+	}
+	r.lastMeterExport = ts
+
+	fields := make(map[string]interface{}, len(reading.Values))
+	for name, value := range reading.Values {
+		fields[strings.ToLower(name)] = value
+	}
+
+	tx := "false"
+	if reading.Tx {
+		tx = "true"
+	}
+
+	r.export(influx.Point{
+		Measurement: "radio_meters",
+		Tags:        map[string]string{"tx": tx},
+		Fields:      fields,
+		Time:        ts,
+	})
+}
+
+// export hands the point over to the exporter. The rig worker must not
+// block; if the exporter doesn't keep up, the point is dropped.
+func (r *localRadio) export(p influx.Point) {
+	select {
+	case r.settings.Influx.PointsCh <- p:
+	default:
+	}
+}
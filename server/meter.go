@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/meter"
+)
+
+// hasGetLevel checks if the radio can read the level
+func (r *localRadio) hasGetLevel(name string) bool {
+	for _, level := range r.rig.Caps.GetLevels {
+		if level.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMeters publishes the meter values on the MetersTopic
+func (r *localRadio) sendMeters(reading meter.Reading) error {
+
+	r.meterMetrics(reading.Values)
+	r.exportMeters(reading)
+	r.publishHaMeters(reading.Values)
+
+	if len(r.settings.MetersTopic) == 0 {
+		return nil
+	}
+
+	data, err := reading.Marshal()
+	if err != nil {
+		return err
+	}
+
+	msg := comms.IOMsg{}
+	msg.Data = data
+	msg.Topic = r.settings.MetersTopic
+	msg.Retain = false
+	msg.Qos = 0
+
+	r.settings.ToWireCh <- msg
+
+	return nil
+}
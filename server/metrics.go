@@ -0,0 +1,61 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dh1tw/gorigctl/audit"
+	"github.com/dh1tw/gorigctl/metrics"
+)
+
+// commandMetrics records the result of a field of a client's request
+// and the time the rig needed to apply it
+func (r *localRadio) commandMetrics(field, result string) {
+
+	class := "error"
+	switch {
+	case result == audit.ResultOK:
+		class = "ok"
+	case strings.HasPrefix(result, "denied"):
+		class = "denied"
+	}
+
+	r.settings.Metrics.Inc(metrics.RigCommands,
+		metrics.Labels{"field": field, "result": class})
+
+	now := time.Now()
+	r.settings.Metrics.Observe(metrics.RigCommandDuration,
+		metrics.Labels{"field": field}, now.Sub(r.cmdMark).Seconds())
+	r.cmdMark = now
+}
+
+// stateMetrics updates the gauges of the published state
+func (r *localRadio) stateMetrics() {
+
+	m := r.settings.Metrics
+	if m == nil {
+		return
+	}
+
+	m.Set(metrics.RigFrequency, nil, r.state.Vfo.Frequency)
+
+	m.Reset(metrics.RigMode)
+	if len(r.state.Vfo.Mode) > 0 {
+		m.Set(metrics.RigMode, metrics.Labels{"mode": r.state.Vfo.Mode}, 1)
+	}
+
+	ptt := 0.0
+	if r.state.Ptt {
+		ptt = 1
+	}
+	m.Set(metrics.RigPtt, nil, ptt)
+}
+
+// meterMetrics updates the gauges of the meters. The meters which are
+// only read while transmitting are removed when switching to receive.
+func (r *localRadio) meterMetrics(values map[string]float32) {
+	r.settings.Metrics.Reset(metrics.RigMeter)
+	for name, value := range values {
+		r.settings.Metrics.Set(metrics.RigMeter, metrics.Labels{"meter": name}, float64(value))
+	}
+}
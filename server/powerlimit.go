@@ -0,0 +1,76 @@
+package server
+
+import (
+	"github.com/dh1tw/gorigctl/bandplan"
+)
+
+// the RFPOWER level read back from the rig is quantized, so we allow
+// a little bit of slack before enforcing the limit again
+const powerLimitTolerance = 0.01
+
+// txPowerLimit returns the power limit for the current transmit frequency
+func (r *localRadio) txPowerLimit() (bandplan.PowerLimit, bool) {
+	freq, _ := r.txFrequencyMode()
+	return r.settings.PowerLimits.Lookup(freq)
+}
+
+// clampRfPower limits the requested RFPOWER level to the maximum level
+// permitted on the current transmit frequency.
+func (r *localRadio) clampRfPower(levels map[string]float32) map[string]float32 {
+
+	rfPower, ok := levels["RFPOWER"]
+	if !ok {
+		return levels
+	}
+
+	limit, ok := r.txPowerLimit()
+	if !ok || rfPower <= limit.RfPower {
+		return levels
+	}
+
+	r.radioLogger.Printf("RFPOWER %.2f exceeds the limit for %s; clamped to %.2f\n",
+		rfPower, limit.Name, limit.RfPower)
+
+	clamped := make(map[string]float32, len(levels))
+	for name, value := range levels {
+		clamped[name] = value
+	}
+	clamped["RFPOWER"] = limit.RfPower
+
+	return clamped
+}
+
+// applyPowerLimit has to be called whenever the frequency might have
+// changed. It updates the active power limit (published with the next
+// state update) and reduces RFPOWER if it is above the limit of the
+// new band.
+func (r *localRadio) applyPowerLimit() error {
+
+	if len(r.settings.PowerLimits) == 0 {
+		return nil
+	}
+
+	active := bandplan.ActivePowerLimit{}
+	limit, ok := r.txPowerLimit()
+	if ok {
+		active.Active = true
+		active.Band = limit.Name
+		active.RfPower = limit.RfPower
+	}
+
+	r.powerLimit = active
+
+	if !active.Active {
+		return nil
+	}
+
+	rfPower, ok := r.state.Vfo.Levels["RFPOWER"]
+	if !ok || rfPower <= active.RfPower+powerLimitTolerance {
+		return nil
+	}
+
+	r.radioLogger.Printf("RFPOWER %.2f exceeds the limit for %s; reducing to %.2f\n",
+		rfPower, active.Band, active.RfPower)
+
+	return r.updateLevels(map[string]float32{"RFPOWER": active.RfPower})
+}
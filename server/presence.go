@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dh1tw/gorigctl/audit"
+	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/presence"
+)
+
+func (r *localRadio) deserializePresence(msg []byte) error {
+
+	// an empty message clears a retained presence message
+	if len(msg) == 0 {
+		return nil
+	}
+
+	p := presence.Presence{}
+	if err := p.Unmarshal(msg); err != nil {
+		return err
+	}
+
+	if p.Online {
+		r.operators[p.UserID] = p
+		r.publishOperators()
+		return nil
+	}
+
+	if _, ok := r.operators[p.UserID]; ok {
+		delete(r.operators, p.UserID)
+		r.publishOperators()
+	}
+
+	if !r.state.Ptt || p.UserID != r.pttUser {
+		// the offline message is retained (e.g. as last will); since
+		// the user is gone, it can be removed from the broker
+		presence.Clear(r.settings.ToWireCh, presence.Topic(r.settings.BaseTopic, p.UserID))
+		return nil
+	}
+
+	r.radioLogger.Printf("%s went offline while transmitting; releasing PTT\n", p.UserID)
+	r.offlinePttUser = p.UserID
+
+	err := r.releaseOfflinePtt()
+	if err != nil {
+		r.auditLog(p.UserID, "ptt", true, false, audit.Result(err))
+	}
+
+	return err
+}
+
+// releaseOfflinePtt unkeys the transmitter which was keyed by a client
+// that went offline. Until the rig confirms the release, it is retried
+// with each meter poll. The retained offline message of the client is
+// kept until then, so that the release is retried after a restart of
+// the server, too.
+func (r *localRadio) releaseOfflinePtt() error {
+
+	userID := r.offlinePttUser
+
+	if r.state.Ptt {
+		if err := r.updatePtt(false); err != nil {
+			return fmt.Errorf("unable to release PTT of %s: %v", userID, err)
+		}
+		if r.state.Ptt {
+			return fmt.Errorf("unable to release PTT of %s: rig still transmitting", userID)
+		}
+		r.auditLog(userID, "ptt", true, false, "released (client went offline)")
+		r.radioLogger.Printf("PTT of %s released\n", userID)
+	}
+
+	r.offlinePttUser = ""
+	if r.pttUser == userID {
+		r.pttUser = ""
+	}
+	presence.Clear(r.settings.ToWireCh, presence.Topic(r.settings.BaseTopic, userID))
+
+	return r.sendState()
+}
+
+// publishOperators announces the list of connected clients, sorted
+// by the time since when they are connected
+func (r *localRadio) publishOperators() {
+
+	operators := make([]presence.Presence, 0, len(r.operators))
+	for _, p := range r.operators {
+		operators = append(operators, p)
+	}
+
+	sort.Slice(operators, func(i, j int) bool {
+		if operators[i].Since != operators[j].Since {
+			return operators[i].Since < operators[j].Since
+		}
+		return operators[i].UserID < operators[j].UserID
+	})
+
+	r.settings.Events.Pub(operators, events.Operators)
+}
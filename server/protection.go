@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dh1tw/gorigctl/alarm"
+	"github.com/dh1tw/gorigctl/audit"
+)
+
+// ProtectionSettings define when the server drops the PTT to protect
+// the transmitter. A threshold of 0 disables the particular check.
+type ProtectionSettings struct {
+	SwrThreshold float32
+	AlcThreshold float32
+	// number of consecutive meter polls above the threshold
+	// before the protection trips
+	TripCount int
+	// RFPOWER level which is applied after the protection tripped
+	// (0 = leave the power unchanged)
+	RfPower float32
+}
+
+// checkProtection is called after the meter values have been polled while
+// transmitting. If SWR or ALC exceed their thresholds for the configured
+// amount of consecutive polls, the transmitter will be unkeyed.
+func (r *localRadio) checkProtection() error {
+
+	p := r.settings.Protection
+
+	if !r.state.Ptt {
+		return nil
+	}
+
+	// the protection tripped, but the rig didn't release the PTT
+	if r.txLockout {
+		return r.releaseTx()
+	}
+
+	tripCount := p.TripCount
+	if tripCount < 1 {
+		tripCount = 1
+	}
+
+	if swr, ok := r.meters["SWR"]; ok && p.SwrThreshold > 0 {
+		if swr > p.SwrThreshold {
+			r.swrExceeded++
+		} else {
+			r.swrExceeded = 0
+		}
+		if r.swrExceeded >= tripCount {
+			return r.tripProtection(fmt.Sprintf("SWR 1:%.1f exceeded threshold 1:%.1f", swr, p.SwrThreshold))
+		}
+	}
+
+	if alc, ok := r.meters["ALC"]; ok && p.AlcThreshold > 0 {
+		if alc > p.AlcThreshold {
+			r.alcExceeded++
+		} else {
+			r.alcExceeded = 0
+		}
+		if r.alcExceeded >= tripCount {
+			return r.tripProtection(fmt.Sprintf("ALC %.2f exceeded threshold %.2f", alc, p.AlcThreshold))
+		}
+	}
+
+	return nil
+}
+
+// tripProtection locks the transmitter until an operator acknowledges
+// the alarm and unkeys it.
+func (r *localRadio) tripProtection(reason string) error {
+
+	r.txLockout = true
+	r.lockoutReason = reason
+	r.swrExceeded = 0
+	r.alcExceeded = 0
+
+	r.radioLogger.Printf("ALARM: %s (keyed by %s). Transmitter locked until the alarm is acknowledged\n",
+		reason, r.pttUser)
+	r.auditLog(r.pttUser, "alarm", nil, reason, "tripped")
+
+	return r.releaseTx()
+}
+
+// releaseTx unkeys the transmitter after the protection tripped and
+// optionally reduces the power. If the rig doesn't confirm the release,
+// it is retried with the next meter poll (see checkProtection).
+func (r *localRadio) releaseTx() error {
+
+	if err := r.updatePtt(false); err != nil {
+		return fmt.Errorf("unable to release PTT after alarm: %v", err)
+	}
+
+	if r.state.Ptt {
+		return errors.New("unable to release PTT after alarm: rig still transmitting")
+	}
+
+	r.radioLogger.Printf("PTT released (keyed by %s)\n", r.pttUser)
+	r.pttUser = ""
+
+	rfPower := r.settings.Protection.RfPower
+	if curr, ok := r.state.Vfo.Levels["RFPOWER"]; ok && rfPower > 0 && curr > rfPower {
+		r.radioLogger.Printf("reducing RFPOWER from %.2f to %.2f\n", curr, rfPower)
+		if err := r.updateLevels(map[string]float32{"RFPOWER": rfPower}); err != nil {
+			return err
+		}
+	}
+
+	return r.sendState()
+}
+
+func (r *localRadio) deserializeAlarmAck(msg []byte) error {
+
+	ack := alarm.Ack{}
+	if err := ack.Unmarshal(msg); err != nil {
+		return err
+	}
+
+	if !r.txLockout {
+		r.radioLogger.Printf("%s acknowledged alarm, but there is no active alarm\n", ack.UserID)
+		return nil
+	}
+
+	r.radioLogger.Printf("%s acknowledged alarm (%s); transmitter unlocked\n", ack.UserID, r.lockoutReason)
+	r.auditLog(ack.UserID, "alarm", r.lockoutReason, "acknowledged", audit.ResultOK)
+
+	r.txLockout = false
+	r.lockoutReason = ""
+
+	return nil
+}
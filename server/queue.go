@@ -0,0 +1,155 @@
+package server
+
+import (
+	"sync"
+
+	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+)
+
+// jobQueue holds the pending jobs of the rig worker, ordered by
+// priority and within the same priority in the order they arrived.
+type jobQueue struct {
+	sync.Mutex
+	jobs    [numPriorities][]*rigJob
+	size    int
+	maxSize int
+	closed  bool
+	notify  chan struct{}
+}
+
+func newJobQueue(maxSize int) *jobQueue {
+	return &jobQueue{
+		maxSize: maxSize,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// push adds a job to the queue. If a job with the same key is already
+// pending, it is replaced by the new one and keeps its position.
+// False is returned if the queue is full or closed.
+func (q *jobQueue) push(job *rigJob) bool {
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	replaced := false
+	if job.key != "" {
+		for i, pending := range q.jobs[job.priority] {
+			if pending.key == job.key {
+				close(pending.done)
+				q.jobs[job.priority][i] = job
+				replaced = true
+				break
+			}
+		}
+	}
+
+	if !replaced {
+		if q.size >= q.maxSize {
+			return false
+		}
+		q.jobs[job.priority] = append(q.jobs[job.priority], job)
+		q.size++
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// pop removes the job with the highest priority from the queue. If the
+// queue is empty, nil is returned together with the closed flag.
+func (q *jobQueue) pop() (*rigJob, bool) {
+
+	q.Lock()
+	defer q.Unlock()
+
+	for p := range q.jobs {
+		if len(q.jobs[p]) > 0 {
+			job := q.jobs[p][0]
+			q.jobs[p][0] = nil
+			q.jobs[p] = q.jobs[p][1:]
+			q.size--
+			return job, false
+		}
+	}
+
+	return nil, q.closed
+}
+
+// flush discards all pending jobs except the safety jobs
+func (q *jobQueue) flush() {
+
+	q.Lock()
+	defer q.Unlock()
+
+	for p := range q.jobs {
+		kept := []*rigJob{}
+		for _, job := range q.jobs[p] {
+			if job.safety {
+				kept = append(kept, job)
+				continue
+			}
+			close(job.done)
+			q.size--
+		}
+		q.jobs[p] = kept
+	}
+}
+
+// close lets the worker exit once all pending jobs have been executed
+func (q *jobQueue) close() {
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// isPttRelease returns true if the request releases the PTT
+func isPttRelease(ns *sbRadio.SetState) bool {
+	return ns.Md != nil && ns.Md.HasPtt && !ns.Ptt
+}
+
+// catRequestPriority determines the priority of a request. Requests
+// which only change the frequency get a key, so that a burst of
+// frequency changes (e.g. while turning the dial) is coalesced into
+// the most recent one.
+func catRequestPriority(ns *sbRadio.SetState) (int, string) {
+
+	md := ns.Md
+	if md == nil {
+		return priorityNormal, ""
+	}
+
+	switch {
+	case md.HasPtt || md.HasRadioOn:
+		return priorityHigh, ""
+
+	case md.HasFrequency && len(ns.VfoOperations) == 0 &&
+		!md.HasMode && !md.HasPbWidth && !md.HasAnt && !md.HasRit &&
+		!md.HasXit && !md.HasSplit && !md.HasTuningStep &&
+		!md.HasFunctions && !md.HasLevels && !md.HasParameters &&
+		!md.HasPollingInterval && !md.HasSyncInterval:
+		return priorityVfo, "frequency:" + ns.CurrentVfo
+
+	case md.HasFrequency || md.HasMode || md.HasPbWidth || md.HasSplit ||
+		md.HasRit || md.HasXit || md.HasAnt || md.HasTuningStep ||
+		len(ns.VfoOperations) > 0:
+		return priorityVfo, ""
+	}
+
+	return priorityNormal, ""
+}
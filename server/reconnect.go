@@ -0,0 +1,166 @@
+package server
+
+import (
+	"time"
+
+	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/metrics"
+	"github.com/dh1tw/gorigctl/rigstatus"
+)
+
+const (
+	// maxIoErrors is the number of consecutive calls which failed with
+	// an I/O error after which the connection to the rig is reopened
+	maxIoErrors = 5
+
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Second * 30
+)
+
+// checkIoErrors considers the rig to be lost after maxIoErrors
+// consecutive calls failed with an I/O error.
+func (r *localRadio) checkIoErrors() {
+	if r.ioErrors >= maxIoErrors {
+		r.disconnect(r.lastIoErr)
+	}
+}
+
+// disconnect closes the rig. The scheduler will try to reopen it.
+func (r *localRadio) disconnect(err error) {
+
+	r.radioLogger.Println("lost connection to the rig:", err)
+
+	if err := r.rig.Close(); err != nil {
+		r.appLogger.Println(err)
+	}
+
+	r.connected = false
+	r.ioErrors = 0
+	r.reconnectAttempts = 0
+	r.nextReconnect = time.Now().Add(reconnectMinBackoff)
+	r.setRigStatus(rigstatus.Disconnected, err, 0)
+}
+
+// reconnect tries to reopen the rig. On failure, the next attempt is
+// scheduled with an exponential backoff.
+func (r *localRadio) reconnect() {
+
+	r.reconnectAttempts++
+	r.setRigStatus(rigstatus.Reconnecting, nil, r.reconnectAttempts)
+
+	if err := r.rig.Open(); err != nil {
+		backoff := reconnectMinBackoff << uint(r.reconnectAttempts-1)
+		if backoff > reconnectMaxBackoff || backoff <= 0 {
+			backoff = reconnectMaxBackoff
+		}
+		r.nextReconnect = time.Now().Add(backoff)
+		r.setRigStatus(rigstatus.Disconnected, err, r.reconnectAttempts)
+		return
+	}
+
+	r.connected = true
+	r.reconnectAttempts = 0
+	r.radioLogger.Println("connection to the rig established")
+	r.setRigStatus(rigstatus.Connected, nil, 0)
+	r.resetFieldBackoff()
+
+	if err := r.sendCaps(); err != nil {
+		r.radioLogger.Println(err)
+	}
+
+	if err := r.queryVfo(); err != nil {
+		r.radioLogger.Println(err)
+	}
+
+	if err := r.applyPowerLimit(); err != nil {
+		r.radioLogger.Println(err)
+	}
+
+	if err := r.sendSnapshot(); err != nil {
+		r.radioLogger.Println(err)
+	}
+
+	r.boostPolling()
+}
+
+// setRigStatus publishes the status of the connection to the rig
+// if it has changed.
+func (r *localRadio) setRigStatus(state string, err error, attempts int) {
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	r.updateRigStatus(state, err, attempts)
+}
+
+// replaceRigStatus changes the status only if the current state is from
+func (r *localRadio) replaceRigStatus(from, to string) {
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	if r.rigStatus.State == from {
+		r.updateRigStatus(to, nil, 0)
+	}
+}
+
+// getRigState returns the current state of the connection to the rig
+func (r *localRadio) getRigState() string {
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	return r.rigStatus.State
+}
+
+func (r *localRadio) updateRigStatus(state string, err error, attempts int) {
+
+	s := r.rigStatus
+	s.State = state
+	s.Attempts = attempts
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	if s.State == r.rigStatus.State && s.Error == r.rigStatus.Error &&
+		s.Attempts == r.rigStatus.Attempts {
+		return
+	}
+
+	if s.State != r.rigStatus.State {
+		s.Since = time.Now()
+	}
+
+	r.rigStatus = s
+	r.publishRigStatus()
+
+	connected := 0.0
+	if s.State == rigstatus.Connected {
+		connected = 1
+	}
+	r.settings.Metrics.Set(metrics.RigConnected, nil, connected)
+}
+
+// publishRigStatus publishes the rig status as retained message.
+// The caller must hold statusMu.
+func (r *localRadio) publishRigStatus() {
+
+	if len(r.settings.RigStatusTopic) == 0 {
+		return
+	}
+
+	data, err := r.rigStatus.Marshal()
+	if err != nil {
+		r.appLogger.Println(err)
+		return
+	}
+
+	msg := comms.IOMsg{}
+	msg.Data = data
+	msg.Topic = r.settings.RigStatusTopic
+	msg.Retain = true
+	msg.Qos = 0
+
+	r.settings.ToWireCh <- msg
+}
@@ -0,0 +1,463 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	hl "github.com/dh1tw/goHamlib"
+	"github.com/dh1tw/gorigctl/audit"
+	"github.com/dh1tw/gorigctl/delta"
+	"github.com/dh1tw/gorigctl/polling"
+)
+
+// Names of the field groups which are polled by the scheduler
+const (
+	PollMeters      = "meters"
+	PollPowerStat   = "powerstat"
+	PollVfo         = "vfo"
+	PollSplit       = "split"
+	PollVfoSettings = "settings"
+	PollFunctions   = "functions"
+	PollLevels      = "levels"
+	PollParameters  = "parameters"
+)
+
+// PollGroup configures how often a group of fields is read from the radio.
+// The group is polled every Interval after it has changed (or, for the
+// meters, while transmitting). As long as the values don't change, the
+// interval is doubled on each poll up to MaxInterval. When several groups
+// are due, the one with the highest Priority is polled first.
+type PollGroup struct {
+	Interval    time.Duration `mapstructure:"interval"`
+	MaxInterval time.Duration `mapstructure:"max-interval"`
+	Priority    int           `mapstructure:"priority"`
+	Disabled    bool          `mapstructure:"disabled"`
+}
+
+// DefaultPolling returns the default settings of all field groups.
+// The meters are polled every pollingInterval while all other groups
+// are read at least every syncInterval.
+func DefaultPolling(pollingInterval, syncInterval time.Duration) map[string]PollGroup {
+
+	meterBackoff := pollingInterval * 10
+	if meterBackoff > time.Second {
+		meterBackoff = time.Second
+	}
+
+	return map[string]PollGroup{
+		PollMeters:      {Interval: pollingInterval, MaxInterval: meterBackoff, Priority: 5},
+		PollPowerStat:   {Interval: time.Second, MaxInterval: syncInterval, Priority: 4},
+		PollVfo:         {Interval: time.Millisecond * 250, MaxInterval: syncInterval, Priority: 4},
+		PollSplit:       {Interval: time.Millisecond * 500, MaxInterval: syncInterval, Priority: 3},
+		PollVfoSettings: {Interval: time.Millisecond * 500, MaxInterval: syncInterval, Priority: 2},
+		PollFunctions:   {Interval: time.Second, MaxInterval: syncInterval, Priority: 1},
+		PollLevels:      {Interval: time.Second, MaxInterval: syncInterval, Priority: 1},
+		PollParameters:  {Interval: time.Second, MaxInterval: syncInterval, Priority: 1},
+	}
+}
+
+// pollGroup is the runtime state of a field group
+type pollGroup struct {
+	name     string
+	config   PollGroup
+	settings PollGroup
+	off      bool
+	interval time.Duration
+	next     time.Time
+	query    func() (changed bool, err error)
+}
+
+func (g *pollGroup) enabled() bool {
+	return !g.off && !g.settings.Disabled && g.settings.Interval > 0
+}
+
+// backoff doubles the interval of a group which didn't change
+func (g *pollGroup) backoff() {
+	g.interval *= 2
+	if g.interval > g.settings.MaxInterval {
+		g.interval = g.settings.MaxInterval
+	}
+	if g.interval < g.settings.Interval {
+		g.interval = g.settings.Interval
+	}
+}
+
+type scheduler struct {
+	groups  []*pollGroup
+	timer   *time.Timer
+	stopped bool
+}
+
+// initScheduler sets up the field groups supported by the radio. The
+// settings from the config file override the defaults.
+func (r *localRadio) initScheduler() {
+
+	settings := DefaultPolling(r.settings.PollingInterval, r.settings.SyncInterval)
+
+	for name, override := range r.settings.Polling {
+		s, ok := settings[name]
+		if !ok {
+			r.appLogger.Println("unknown polling group:", name)
+			continue
+		}
+		if override.Interval > 0 {
+			s.Interval = override.Interval
+		}
+		if override.MaxInterval > 0 {
+			s.MaxInterval = override.MaxInterval
+		}
+		if override.Priority != 0 {
+			s.Priority = override.Priority
+		}
+		s.Disabled = s.Disabled || override.Disabled
+		settings[name] = s
+	}
+
+	queries := map[string]func() (bool, error){
+		PollMeters:      r.pollMeters,
+		PollVfo:         r.pollState(r.queryFreqMode),
+		PollSplit:       r.pollState(r.querySplit),
+		PollVfoSettings: r.pollState(r.queryVfoSettings),
+		PollFunctions:   r.pollState(r.queryFunctions),
+		PollLevels:      r.pollState(r.queryLevels),
+		PollParameters:  r.pollState(r.queryParameters),
+	}
+
+	if r.rig.Caps.HasGetPowerStat {
+		queries[PollPowerStat] = r.pollState(func(int) error {
+			return r.queryPowerStat()
+		})
+	}
+
+	r.scheduler = scheduler{}
+	now := time.Now()
+
+	for name, query := range queries {
+		s := settings[name]
+		g := &pollGroup{
+			name:     name,
+			config:   s,
+			settings: s,
+			off:      name != PollMeters && r.settings.SyncInterval == 0,
+			interval: s.Interval,
+			next:     now.Add(s.Interval),
+			query:    query,
+		}
+		r.scheduler.groups = append(r.scheduler.groups, g)
+	}
+
+	r.scheduler.sort()
+
+	r.scheduler.timer = time.NewTimer(time.Hour)
+	r.reschedule()
+}
+
+// sort orders the groups by priority, highest first
+func (s *scheduler) sort() {
+	sort.SliceStable(s.groups, func(i, j int) bool {
+		return s.groups[i].settings.Priority > s.groups[j].settings.Priority
+	})
+}
+
+// reschedule arms the timer for the group which is due next
+func (r *localRadio) reschedule() {
+
+	s := &r.scheduler
+
+	if s.timer == nil {
+		return
+	}
+
+	if !s.timer.Stop() {
+		select {
+		case <-s.timer.C:
+		default:
+		}
+	}
+
+	if s.stopped {
+		return
+	}
+
+	if !r.connected {
+		s.timer.Reset(time.Until(r.nextReconnect))
+		return
+	}
+
+	var next time.Time
+	for _, g := range s.groups {
+		if !g.enabled() {
+			continue
+		}
+		if next.IsZero() || g.next.Before(next) {
+			next = g.next
+		}
+	}
+
+	if next.IsZero() {
+		return
+	}
+
+	d := time.Until(next)
+	if d < 0 {
+		d = 0
+	}
+	s.timer.Reset(d)
+}
+
+// stopScheduler stops polling the radio
+func (r *localRadio) stopScheduler() {
+	r.scheduler.stopped = true
+	r.reschedule()
+}
+
+// poll reads the group with the highest priority which is due. Only one
+// group is read at a time so that requests from the clients don't have
+// to wait for a full sync with the radio.
+func (r *localRadio) poll() {
+
+	defer r.reschedule()
+
+	now := time.Now()
+
+	if !r.connected {
+		if !now.Before(r.nextReconnect) {
+			r.reconnect()
+		}
+		return
+	}
+
+	var g *pollGroup
+	for _, group := range r.scheduler.groups {
+		if group.enabled() && !group.next.After(now) {
+			g = group
+			break
+		}
+	}
+
+	if g == nil {
+		return
+	}
+
+	// besides the power status (and the meters, which check it themselves)
+	// there is nothing to read while the radio is turned off
+	if r.rig.Caps.HasGetPowerStat && !r.state.RadioOn &&
+		g.name != PollPowerStat && g.name != PollMeters {
+		g.backoff()
+		g.next = now.Add(g.interval)
+		return
+	}
+
+	// errors have already been logged and recorded per field
+	// by the query
+	changed, err := g.query()
+	r.countPoll(err)
+	r.checkIoErrors()
+	if !r.connected {
+		return
+	}
+
+	if changed || (g.name == PollMeters && r.state.Ptt) {
+		g.interval = g.settings.Interval
+	} else {
+		g.backoff()
+	}
+	g.next = time.Now().Add(g.interval)
+
+	if !changed || g.name == PollMeters {
+		return
+	}
+
+	switch g.name {
+	case PollPowerStat:
+		// the radio has been turned on; read all fields again
+		if r.state.RadioOn {
+			r.boostPolling()
+		}
+	case PollVfo, PollSplit:
+		// the frequency might have been changed on the radio itself
+		if err := r.applyPowerLimit(); err != nil {
+			r.radioLogger.Println(err)
+		}
+	}
+
+	r.lastUpdateSent = time.Now()
+
+	if err := r.sendState(); err != nil {
+		r.radioLogger.Println(err)
+	}
+}
+
+// boostPolling resets all field groups (except the meters) to their
+// fastest interval, e.g. after a client has changed a value.
+func (r *localRadio) boostPolling() {
+
+	now := time.Now()
+
+	for _, g := range r.scheduler.groups {
+		if g.name == PollMeters {
+			continue
+		}
+		g.interval = g.settings.Interval
+		if next := now.Add(g.interval); next.Before(g.next) {
+			g.next = next
+		}
+	}
+
+	r.reschedule()
+}
+
+// setPollingInterval changes the interval of the meters (0 = disabled)
+func (r *localRadio) setPollingInterval(interval time.Duration) {
+
+	for _, g := range r.scheduler.groups {
+		if g.name != PollMeters {
+			continue
+		}
+		g.settings.Interval = interval
+		if g.settings.MaxInterval < interval {
+			g.settings.MaxInterval = interval
+		}
+		g.interval = interval
+		g.next = time.Now().Add(interval)
+	}
+
+	r.reschedule()
+}
+
+// setSyncInterval limits the back off of all groups except the meters,
+// so that every field is read at least once per interval (0 = disabled).
+func (r *localRadio) setSyncInterval(interval time.Duration) {
+
+	now := time.Now()
+
+	for _, g := range r.scheduler.groups {
+		if g.name == PollMeters {
+			continue
+		}
+		g.off = interval == 0
+		if g.off {
+			continue
+		}
+		g.settings.MaxInterval = interval
+		g.settings.Interval = g.config.Interval
+		if g.settings.Interval > interval {
+			g.settings.Interval = interval
+		}
+		g.interval = g.settings.Interval
+		g.next = now.Add(g.interval)
+	}
+
+	r.reschedule()
+}
+
+// deserializePollingRequest changes the settings of a field group on
+// behalf of a client
+func (r *localRadio) deserializePollingRequest(msg []byte) error {
+
+	req := polling.Request{}
+	if err := req.Unmarshal(msg); err != nil {
+		return err
+	}
+
+	field := "polling." + req.Group
+
+	var g *pollGroup
+	for _, group := range r.scheduler.groups {
+		if group.name == req.Group {
+			g = group
+		}
+	}
+
+	if g == nil {
+		err := fmt.Errorf("unknown or unsupported polling group %q", req.Group)
+		r.radioLogger.Println("polling request rejected:", err)
+		r.auditLog(req.UserID, field, nil, req, audit.Denied(err))
+		return nil
+	}
+
+	old := g.settings
+
+	if err := r.setPollGroup(g, req); err != nil {
+		r.radioLogger.Println("polling request rejected:", err)
+		r.auditLog(req.UserID, field, old, req, audit.Denied(err))
+		return nil
+	}
+
+	r.appLogger.Printf("%s changed the polling of %s to %v (max %v, priority %d, disabled %v)\n",
+		req.UserID, g.name, g.settings.Interval, g.settings.MaxInterval, g.settings.Priority, g.settings.Disabled)
+	r.auditLog(req.UserID, field, old, g.settings, audit.ResultOK)
+
+	return nil
+}
+
+// setPollGroup applies the non-zero settings of the request to the
+// group. The new interval and priority are kept when the global
+// SyncInterval is changed.
+func (r *localRadio) setPollGroup(g *pollGroup, req polling.Request) error {
+
+	if req.Interval < 0 || req.MaxInterval < 0 {
+		return fmt.Errorf("negative polling interval for %s", g.name)
+	}
+
+	s := g.settings
+	if req.Interval > 0 {
+		s.Interval = time.Duration(req.Interval) * time.Millisecond
+	}
+	if req.MaxInterval > 0 {
+		s.MaxInterval = time.Duration(req.MaxInterval) * time.Millisecond
+	}
+	if s.MaxInterval < s.Interval {
+		s.MaxInterval = s.Interval
+	}
+	if req.Priority != 0 {
+		s.Priority = req.Priority
+	}
+	if req.Disabled != nil {
+		s.Disabled = *req.Disabled
+	}
+
+	g.settings = s
+	g.config.Interval = s.Interval
+	g.config.Priority = s.Priority
+	g.interval = s.Interval
+	g.next = time.Now().Add(s.Interval)
+
+	r.scheduler.sort()
+	r.reschedule()
+
+	return nil
+}
+
+// pollState wraps a query of the radio's state and reports if any of
+// the values have changed
+func (r *localRadio) pollState(query func(vfo int) error) func() (bool, error) {
+	return func() (bool, error) {
+		old := delta.Copy(&r.state)
+		err := query(hl.VfoValue["CURR"])
+		d, ok := delta.Diff(&old, &r.state)
+		return !ok || !d.Empty(), err
+	}
+}
+
+// pollMeters reads the meters and reports if any of them has changed
+func (r *localRadio) pollMeters() (bool, error) {
+
+	old := r.meters
+	err := r.updateMeter()
+	if err != nil {
+		r.radioLogger.Println(err)
+	}
+
+	if len(old) != len(r.meters) {
+		return true, err
+	}
+	for name, value := range r.meters {
+		if oldValue, ok := old[name]; !ok || oldValue != value {
+			return true, err
+		}
+	}
+
+	return false, err
+}
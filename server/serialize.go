@@ -15,6 +15,15 @@ func (r *localRadio) serializeState() (msg []byte, err error) {
 
 func (r *localRadio) serializeCaps() (msg []byte, err error) {
 
+	caps := r.capabilities()
+	msg, err = caps.Marshal()
+
+	return msg, err
+}
+
+// capabilities returns the capabilities of the rig
+func (r *localRadio) capabilities() sbRadio.Capabilities {
+
 	caps := sbRadio.Capabilities{}
 	caps.Vfos = r.rig.Caps.Vfos
 	caps.Modes = r.rig.Caps.Modes
@@ -47,7 +56,6 @@ func (r *localRadio) serializeCaps() (msg []byte, err error) {
 	if ok {
 		caps.Status = status
 	}
-	msg, err = caps.Marshal()
 
-	return msg, err
+	return caps
 }
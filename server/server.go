@@ -9,8 +9,17 @@ import (
 
 	"github.com/cskr/pubsub"
 	hl "github.com/dh1tw/goHamlib"
+	"github.com/dh1tw/gorigctl/audit"
+	"github.com/dh1tw/gorigctl/bandplan"
 	"github.com/dh1tw/gorigctl/comms"
+	"github.com/dh1tw/gorigctl/delta"
 	"github.com/dh1tw/gorigctl/events"
+	"github.com/dh1tw/gorigctl/homeassistant"
+	"github.com/dh1tw/gorigctl/meter"
+	"github.com/dh1tw/gorigctl/metrics"
+	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/presence"
+	"github.com/dh1tw/gorigctl/rigstatus"
 	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
 )
 
@@ -20,27 +29,83 @@ type RadioSettings struct {
 	HlDebugLevel     int
 	CatRequestCh     chan []byte
 	CapsReqCh        chan []byte
+	PresenceCh       chan []byte
+	AlarmAckCh       chan []byte
+	PollingReqCh     chan []byte
 	ToWireCh         chan comms.IOMsg
 	CatResponseTopic string
+	StateDeltaTopic  string
+	StateReqCh       chan []byte
+	SnapshotInterval time.Duration
+	LegacyFullState  bool // publish the full state on CatResponseTopic with every change
 	CapsTopic        string
+	MetersTopic      string
 	WaitGroup        *sync.WaitGroup
 	Events           *pubsub.PubSub
 	PollingInterval  time.Duration
 	SyncInterval     time.Duration
+	Polling          map[string]PollGroup
+	RigTimeout       time.Duration
 	RadioLogger      *log.Logger
 	AppLogger        *log.Logger
+	Audit            *audit.Logger
+	TxGuard          *bandplan.Guard
+	Protection       ProtectionSettings
+	PowerLimits      bandplan.PowerLimits
+	RigStatusTopic   string
+	BaseTopic        string
+	PttMaxLatency    time.Duration // refuse PTT from clients with a higher round trip time (0 = disabled)
+	PttMaxLoss       float64       // refuse PTT from clients with a higher packet loss [0...1] (0 = disabled)
+	HealthInterval   time.Duration // publish the rig's health on events.RigHealth (0 = only at startup)
+	Metrics          *metrics.Registry
+	Influx           InfluxSettings
+	HomeAssistant    *homeassistant.Settings // nil = disabled
+	HaCommandCh      chan comms.IOMsg
 }
 
 type localRadio struct {
-	rig            hl.Rig
-	state          sbRadio.State
-	settings       *RadioSettings
-	pollingTicker  *time.Ticker
-	radioLogger    *log.Logger
-	appLogger      *log.Logger
-	lastUpdateSent time.Time
-	lastCmdRecvd   time.Time
-	syncTicker     *time.Ticker
+	rig               hl.Rig
+	state             sbRadio.State
+	settings          *RadioSettings
+	scheduler         scheduler
+	worker            rigWorker
+	radioLogger       *log.Logger
+	appLogger         *log.Logger
+	lastUpdateSent    time.Time
+	lastCmdRecvd      time.Time
+	pttUser           string
+	offlinePttUser    string    // went offline while transmitting; PTT not released yet
+	pttKeyed          time.Time // when pttUser keyed the transmitter
+	swrExceeded       int
+	alcExceeded       int
+	txLockout         bool
+	lockoutReason     string
+	powerLimit        bandplan.ActivePowerLimit
+	sentPowerLimit    bandplan.ActivePowerLimit // with the last state update
+	publishedState    sbRadio.State
+	stateSeq          uint64
+	lastSnapshot      time.Time
+	meters            map[string]float32
+	connected         bool
+	ioErrors          int
+	reconnectAttempts int
+	nextReconnect     time.Time
+	statusMu          sync.Mutex
+	rigStatus         rigstatus.Status
+	fields            map[string]*fieldState
+	lastIoErr         error
+	operators         map[string]presence.Presence
+	latencyMu         sync.Mutex
+	clientLatency     map[string]ping.Stats
+	pendingAck        *delta.Ack
+	reqErrors         []string // of the request being executed
+	counters          rigCounters
+	cmdMark           time.Time // start of the current field of a client's request
+	exportedState     map[string]interface{}
+	lastMeterExport   time.Time
+	haState           []byte
+	haMeters          map[string]float32
+	lastHaMeters      time.Time
 }
 
 func StartRadioServer(rs RadioSettings) {
@@ -49,6 +114,7 @@ func StartRadioServer(rs RadioSettings) {
 
 	prepareShutdownCh := rs.Events.Sub(events.PrepareShutdown)
 	shutdownCh := rs.Events.Sub(events.Shutdown)
+	clientLatencyCh := rs.Events.Sub(events.ClientLatency)
 
 	r := localRadio{}
 	r.rig = hl.Rig{}
@@ -62,6 +128,8 @@ func StartRadioServer(rs RadioSettings) {
 	r.settings = &rs
 	r.radioLogger = rs.RadioLogger
 	r.appLogger = rs.AppLogger
+	r.fields = make(map[string]*fieldState)
+	r.operators = make(map[string]presence.Presence)
 
 	r.state.PollingInterval = int32(r.settings.PollingInterval.Nanoseconds() / 1000000)
 	r.state.SyncInterval = int32(r.settings.SyncInterval.Seconds())
@@ -85,265 +153,436 @@ func StartRadioServer(rs RadioSettings) {
 		}
 	}
 
+	// if the rig can not be opened (e.g. the USB-serial adapter is
+	// unplugged), we keep on trying in the background
 	if err := r.rig.Open(); err != nil {
-		// if we can not open the port, we shut down
-		log.Println(err)
-		r.settings.Events.Pub(true, events.Shutdown)
-		return
+		r.radioLogger.Println("unable to open the rig:", err)
+		r.nextReconnect = time.Now().Add(reconnectMinBackoff)
+		r.setRigStatus(rigstatus.Disconnected, err, 0)
+	} else {
+		r.connected = true
+		r.setRigStatus(rigstatus.Connected, nil, 0)
 	}
 
 	// publish the radio's capabilities
 	if err := r.sendCaps(); err != nil {
 		r.radioLogger.Println("Couldn't get all capabilities:", err)
 	}
+	r.publishHaDiscovery()
 
-	if err := r.queryVfo(); err != nil {
-		r.radioLogger.Println(err)
-	}
+	r.initScheduler()
+	r.worker = newRigWorker(rs.RigTimeout)
+	go r.runWorker()
 
-	// publish the radio's state
-	if err := r.sendState(); err != nil {
-		r.radioLogger.Println(err)
-	}
+	r.submit("initial sync", priorityNormal, "", func() {
+		if !r.connected {
+			return
+		}
 
-	if r.settings.PollingInterval > 0 {
-		r.pollingTicker = time.NewTicker(r.settings.PollingInterval)
-	} else {
-		r.pollingTicker = time.NewTicker(time.Second * 100)
-		r.pollingTicker.Stop()
+		if err := r.queryVfo(); err != nil {
+			r.radioLogger.Println(err)
+		}
+
+		if err := r.applyPowerLimit(); err != nil {
+			r.radioLogger.Println(err)
+		}
+
+		// publish the radio's state
+		if err := r.sendState(); err != nil {
+			r.radioLogger.Println(err)
+		}
+	})
+
+	watchdogInterval := r.worker.timeout / 4
+	if watchdogInterval < time.Millisecond*100 {
+		watchdogInterval = time.Millisecond * 100
 	}
-	if r.settings.SyncInterval > 0 {
-		r.syncTicker = time.NewTicker(r.settings.SyncInterval)
-	} else {
-		r.syncTicker = time.NewTicker(time.Second * 100)
-		r.syncTicker.Stop()
+	watchdog := time.NewTicker(watchdogInterval)
+	defer watchdog.Stop()
+
+	r.publishRigHealth()
+	var heartbeatCh <-chan time.Time
+	if rs.HealthInterval > 0 {
+		heartbeat := time.NewTicker(rs.HealthInterval)
+		defer heartbeat.Stop()
+		heartbeatCh = heartbeat.C
 	}
 
 	for {
 		select {
 		case msg := <-rs.CatRequestCh:
-			r.deserializeCatRequest(msg)
-			r.sendState()
-			r.lastCmdRecvd = time.Now()
+			if state := r.getRigState(); state == rigstatus.Disconnected || state == rigstatus.Reconnecting {
+				r.radioLogger.Printf("rig %s; ignoring cat request\n", state)
+				continue
+			}
+			priority, key := priorityNormal, ""
+			ns := sbRadio.SetState{}
+			if err := ns.Unmarshal(msg); err == nil {
+				priority, key = catRequestPriority(&ns)
+			}
+			received := time.Now()
+			exec := func() {
+				r.execCatRequest(msg, &ns, received)
+			}
+			if isPttRelease(&ns) {
+				r.submitSafety("ptt release", exec)
+			} else {
+				r.submit("cat request", priority, key, exec)
+			}
+
+		case msg := <-rs.HaCommandCh:
+			r.handleHaCommand(msg)
 
 		case <-rs.CapsReqCh:
+			// the capabilities are cached; no need to ask the radio
 			r.sendCaps()
 
+		case <-rs.StateReqCh:
+			r.submit("state request", priorityNormal, "state request", func() {
+				if err := r.sendSnapshot(); err != nil {
+					r.radioLogger.Println(err)
+				}
+			})
+
+		case msg := <-rs.PresenceCh:
+			// may release the PTT of an operator who went offline
+			r.submitSafety("presence", func() {
+				if err := r.deserializePresence(msg); err != nil {
+					r.appLogger.Println(err)
+				}
+			})
+
+		case msg := <-rs.PollingReqCh:
+			r.submit("polling request", priorityNormal, "", func() {
+				if err := r.deserializePollingRequest(msg); err != nil {
+					r.appLogger.Println(err)
+				}
+			})
+
+		case msg := <-rs.AlarmAckCh:
+			r.submit("alarm acknowledgement", priorityHigh, "", func() {
+				if err := r.deserializeAlarmAck(msg); err != nil {
+					r.appLogger.Println(err)
+				}
+			})
+
+		case ev := <-clientLatencyCh:
+			r.latencyMu.Lock()
+			r.clientLatency = ev.(map[string]ping.Stats)
+			r.latencyMu.Unlock()
+
+		case <-watchdog.C:
+			r.checkWorker()
+
+		case <-heartbeatCh:
+			r.publishRigHealth()
+
 		case <-prepareShutdownCh:
-			r.pollingTicker.Stop()
-			r.syncTicker.Stop()
+			r.submit("stop polling", priorityHigh, "", r.stopScheduler)
 			r.sendClearState()
 			time.Sleep(time.Millisecond * 100)
 
 		case <-shutdownCh:
 			r.appLogger.Println("Disconnecting from Radio")
-			// maybe we have to check if the connection is really open
-			r.rig.Close()
-			r.rig.Cleanup()
+			// pending requests must not be executed on a closed rig;
+			// a pending PTT release is still executed before closing
+			r.worker.queue.flush()
+			job := r.submit("disconnect", priorityHigh, "", func() {
+				if r.connected {
+					r.rig.Close()
+				}
+				r.rig.Cleanup()
+			})
+			r.worker.queue.close()
+			if !waitJob(job, r.worker.timeout) {
+				r.appLogger.Println("rig not responding; unable to close the connection")
+			}
 			return
+		}
+	}
+}
 
-		case <-r.pollingTicker.C:
-			r.updateMeter()
+// execCatRequest applies a client's request to the rig and publishes
+// the new state. It must be executed on the rig worker.
+func (r *localRadio) execCatRequest(msg []byte, ns *sbRadio.SetState, received time.Time) {
 
-		case <-r.syncTicker.C:
-			// make sure we don't interrupt while receiving data
-			// as updating takes a few hundred milliseconds
-			if time.Since(r.lastCmdRecvd) < time.Second*3 {
-				continue
-			}
+	started := time.Now()
+	r.cmdMark = started
+	r.reqErrors = nil
+	r.deserializeCatRequest(msg)
+	r.cmdMark = time.Time{}
+	if err := r.applyPowerLimit(); err != nil {
+		r.radioLogger.Println(err)
+	}
+	r.ackRequest(ns, msg, received, started)
+	r.sendState()
+	r.lastCmdRecvd = time.Now()
+	// verify the changes made by the client
+	r.boostPolling()
+}
 
-			r.queryVfo()
+func (r *localRadio) queryVfo() error {
 
-			if (r.rig.Caps.HasGetPowerStat && r.state.RadioOn) || !r.rig.Caps.HasGetPowerStat {
+	r.queryPowerStat()
 
-				if err := r.sendState(); err != nil {
-					r.radioLogger.Println(err)
-				}
-			}
-		}
+	// Only query radio if Power is On or if Radio has now PowerStat function
+	// in this case we will assume that the radio is turned on
+	if r.rig.Caps.HasGetPowerStat && !r.state.RadioOn {
+		// announce that the radio has ben turned off
+		return r.sendState()
 	}
+
+	vfo := hl.VfoValue["CURR"]
+
+	r.queryFreqMode(vfo)
+	r.queryVfoSettings(vfo)
+
+	// errors have already been logged
+	r.querySplit(vfo)
+
+	r.queryFunctions(vfo)
+	r.queryLevels(vfo)
+	r.queryParameters(vfo)
+
+	r.lastUpdateSent = time.Now()
+
+	return nil
 }
 
-func (r *localRadio) queryVfo() error {
+func (r *localRadio) queryPowerStat() error {
 
-	if r.rig.Caps.HasGetPowerStat {
-		if pwrOn, err := r.rig.GetPowerStat(); err != nil {
-			r.radioLogger.Println(err)
-			// if the radio doesn't respond, lets assume that the radio if off
-			r.state.RadioOn = false
-		} else {
-			if pwrOn == hl.RIG_POWER_ON {
-				r.state.RadioOn = true
-			} else {
-				r.state.RadioOn = false
-				// announce that the radio has ben turned off
-				if err := r.sendState(); err != nil {
-					return err
-				}
-				return nil
-			}
-		}
+	if !r.rig.Caps.HasGetPowerStat || !r.canPoll("powerstat") {
+		return nil
 	}
 
-	// Only query radio if Power is On or if Radio has now PowerStat function
-	// in this case we will assume that the radio is turned on
-	if (r.rig.Caps.HasGetPowerStat && r.state.RadioOn) || !r.rig.Caps.HasGetPowerStat {
+	pwrOn, err := r.rig.GetPowerStat()
+	if err := r.fieldResult("powerstat", err); err != nil {
+		// if the radio doesn't respond, lets assume that the radio if off
+		r.state.RadioOn = false
+		return err
+	}
+
+	r.state.RadioOn = pwrOn == hl.RIG_POWER_ON
 
-		vfo := hl.VfoValue["CURR"]
+	return nil
+}
+
+func (r *localRadio) queryFreqMode(vfo int) error {
 
-		if r.rig.Caps.HasGetVfo {
+	var lastErr error
+
+	if r.rig.Caps.HasGetVfo {
+		if r.canPoll("vfo") {
 			vfo, err := r.rig.GetVfo()
-			if err != nil {
-				r.radioLogger.Print(err)
+			if err := r.fieldResult("vfo", err); err != nil {
+				lastErr = err
 			} else {
 				r.state.CurrentVfo = hl.VfoName[vfo]
 			}
+		}
+	} else {
+		r.state.CurrentVfo = "CURR"
+	}
+
+	if r.rig.Caps.HasGetFreq && r.canPoll("frequency") {
+		freq, err := r.rig.GetFreq(vfo)
+		if err := r.fieldResult("frequency", err); err != nil {
+			lastErr = err
 		} else {
-			r.state.CurrentVfo = "CURR"
+			r.state.Vfo.Frequency = freq
 		}
+	}
 
-		if r.rig.Caps.HasGetFreq {
-			freq, err := r.rig.GetFreq(vfo)
-			if err != nil {
-				r.radioLogger.Println(err)
+	if r.rig.Caps.HasGetMode && r.canPoll("mode") {
+		mode, pbWidth, err := r.rig.GetMode(vfo)
+		if err := r.fieldResult("mode", err); err != nil {
+			lastErr = err
+		} else {
+			if modeName, ok := hl.ModeName[mode]; ok {
+				r.state.Vfo.Mode = modeName
 			} else {
-				r.state.Vfo.Frequency = freq
+				r.radioLogger.Println("unknown mode:", mode)
 			}
+			r.state.Vfo.PbWidth = int32(pbWidth)
 		}
+	}
 
-		if r.rig.Caps.HasGetMode {
-			mode, pbWidth, err := r.rig.GetMode(vfo)
-			if err != nil {
-				r.radioLogger.Println(err)
-			} else {
-				if modeName, ok := hl.ModeName[mode]; ok {
-					r.state.Vfo.Mode = modeName
-				} else {
-					r.radioLogger.Println("unknown mode:", mode)
-				}
-				r.state.Vfo.PbWidth = int32(pbWidth)
-			}
+	return lastErr
+}
+
+func (r *localRadio) queryVfoSettings(vfo int) error {
+
+	var lastErr error
+
+	if r.rig.Caps.HasGetAnt && r.canPoll("antenna") {
+		ant, err := r.rig.GetAnt(vfo)
+		if err := r.fieldResult("antenna", err); err != nil {
+			lastErr = err
+		} else {
+			r.state.Vfo.Ant = int32(ant)
 		}
+	}
 
-		if r.rig.Caps.HasGetAnt {
-			ant, err := r.rig.GetAnt(vfo)
-			if err != nil {
-				r.radioLogger.Println(err)
-			} else {
-				r.state.Vfo.Ant = int32(ant)
-			}
+	if r.rig.Caps.HasGetRit && r.canPoll("rit") {
+		rit, err := r.rig.GetRit(vfo)
+		if err := r.fieldResult("rit", err); err != nil {
+			lastErr = err
+		} else {
+			r.state.Vfo.Rit = int32(rit)
 		}
+	}
 
-		if r.rig.Caps.HasGetRit {
-			rit, err := r.rig.GetRit(vfo)
-			if err != nil {
-				r.radioLogger.Println(err)
-			} else {
-				r.state.Vfo.Rit = int32(rit)
-			}
+	if r.rig.Caps.HasGetRit && r.canPoll("xit") {
+		xit, err := r.rig.GetXit(vfo)
+		if err := r.fieldResult("xit", err); err != nil {
+			lastErr = err
+		} else {
+			r.state.Vfo.Xit = int32(xit)
 		}
+	}
 
-		if r.rig.Caps.HasGetRit {
-			xit, err := r.rig.GetXit(vfo)
-			if err != nil {
-				r.radioLogger.Println(err)
-			} else {
-				r.state.Vfo.Xit = int32(xit)
-			}
+	if r.rig.Caps.HasGetTs && r.canPoll("tuning_step") {
+		tStep, err := r.rig.GetTs(vfo)
+		if err := r.fieldResult("tuning_step", err); err != nil {
+			lastErr = err
+		} else {
+			r.state.Vfo.TuningStep = int32(tStep)
 		}
+	}
 
-		split := sbRadio.Split{}
+	return lastErr
+}
 
-		if r.rig.Caps.HasGetSplitVfo {
-			splitOn, txVfo, err := r.rig.GetSplit(vfo)
-			if err != nil {
-				r.radioLogger.Println(err)
-			} else {
-				if splitOn == hl.RIG_SPLIT_ON {
-					split.Enabled = true
-				} else {
-					split.Enabled = false
-				}
-				if txVfoName, ok := hl.VfoName[txVfo]; ok {
-					split.Vfo = txVfoName
-				} else {
-					return errors.New("unknown Vfo Name")
-				}
+func (r *localRadio) querySplit(vfo int) error {
 
-				if splitOn == hl.RIG_SPLIT_ON {
-
-					// these checks should be enabled, but most of the
-					// backends don't have these functions implemented
-					// therefore they use the emulated functions which
-					// unfortunately don't work everywhere well (e.g. TS-480)
-					// if r.rig.Caps.HasGetSplitFreq {
-					txFreq, err := r.rig.GetSplitFreq(txVfo)
-					if err != nil {
-						r.radioLogger.Println(err)
-					} else {
-						split.Frequency = txFreq
-					}
-					// }
-
-					// if r.rig.Caps.HasGetSplitMode {
-					txMode, txPbWidth, err := r.rig.GetSplitMode(txVfo)
-					if err != nil {
-						r.radioLogger.Println(err)
-					} else {
-						if txModeName, ok := hl.ModeName[txMode]; ok {
-							split.Mode = txModeName
-						} else {
-							r.radioLogger.Println("unknown Tx Mode")
-						}
-						split.PbWidth = int32(txPbWidth)
-					}
-					// }
-				}
-			}
-		}
+	var lastErr error
+
+	if !r.rig.Caps.HasGetSplitVfo || !r.canPoll("split") {
+		return nil
+	}
+
+	split := sbRadio.Split{}
+
+	splitOn, txVfo, err := r.rig.GetSplit(vfo)
+	if err := r.fieldResult("split", err); err != nil {
+		return err
+	}
 
-		r.state.Vfo.Split = &split
+	if splitOn == hl.RIG_SPLIT_ON {
+		split.Enabled = true
+	} else {
+		split.Enabled = false
+	}
+	if txVfoName, ok := hl.VfoName[txVfo]; ok {
+		split.Vfo = txVfoName
+	} else {
+		r.radioLogger.Println("unknown Vfo Name:", txVfo)
+		return errors.New("unknown Vfo Name")
+	}
 
-		if r.rig.Caps.HasGetTs {
-			tStep, err := r.rig.GetTs(vfo)
-			if err != nil {
-				r.radioLogger.Println(err)
+	if splitOn == hl.RIG_SPLIT_ON {
+
+		// these checks should be enabled, but most of the
+		// backends don't have these functions implemented
+		// therefore they use the emulated functions which
+		// unfortunately don't work everywhere well (e.g. TS-480).
+		// Backends which don't support them at all are detected by
+		// the field health and no longer polled.
+		if r.canPoll("split.frequency") {
+			txFreq, err := r.rig.GetSplitFreq(txVfo)
+			if err := r.fieldResult("split.frequency", err); err != nil {
+				lastErr = err
 			} else {
-				r.state.Vfo.TuningStep = int32(tStep)
+				split.Frequency = txFreq
 			}
 		}
 
-		for _, f := range r.rig.Caps.GetFunctions {
-			fValue, err := r.rig.GetFunc(vfo, hl.FuncValue[f])
-			if err != nil {
-				r.radioLogger.Println(err)
+		if r.canPoll("split.mode") {
+			txMode, txPbWidth, err := r.rig.GetSplitMode(txVfo)
+			if err := r.fieldResult("split.mode", err); err != nil {
+				lastErr = err
+			} else {
+				if txModeName, ok := hl.ModeName[txMode]; ok {
+					split.Mode = txModeName
+				} else {
+					r.radioLogger.Println("unknown Tx Mode")
+				}
+				split.PbWidth = int32(txPbWidth)
 			}
-			r.state.Vfo.Functions[f] = fValue
 		}
+	}
 
-		for _, level := range r.rig.Caps.GetLevels {
-			lValue, err := r.rig.GetLevel(vfo, hl.LevelValue[level.Name])
-			if err != nil {
-				r.radioLogger.Println("Warning:", level.Name, "-", err)
-			}
-			r.state.Vfo.Levels[level.Name] = lValue
+	r.state.Vfo.Split = &split
+
+	return lastErr
+}
+
+func (r *localRadio) queryFunctions(vfo int) error {
+
+	var lastErr error
+
+	for _, f := range r.rig.Caps.GetFunctions {
+		field := "function." + f
+		if !r.canPoll(field) {
+			continue
+		}
+		fValue, err := r.rig.GetFunc(vfo, hl.FuncValue[f])
+		if err := r.fieldResult(field, err); err != nil {
+			lastErr = err
+			continue
 		}
+		r.state.Vfo.Functions[f] = fValue
+	}
 
-		for _, param := range r.rig.Caps.GetParameters {
-			pValue, err := r.rig.GetParm(vfo, hl.ParmValue[param.Name])
-			if err != nil {
-				r.radioLogger.Println(err)
-			}
-			r.state.Vfo.Parameters[param.Name] = pValue
+	return lastErr
+}
+
+func (r *localRadio) queryLevels(vfo int) error {
+
+	var lastErr error
+
+	for _, level := range r.rig.Caps.GetLevels {
+		// meters are published separately by updateMeter
+		if meter.IsMeter(level.Name) {
+			continue
 		}
+		field := "level." + level.Name
+		if !r.canPoll(field) {
+			continue
+		}
+		lValue, err := r.rig.GetLevel(vfo, hl.LevelValue[level.Name])
+		if err := r.fieldResult(field, err); err != nil {
+			lastErr = err
+			continue
+		}
+		r.state.Vfo.Levels[level.Name] = lValue
 	}
 
-	r.lastUpdateSent = time.Now()
+	return lastErr
+}
 
-	return nil
+func (r *localRadio) queryParameters(vfo int) error {
+
+	var lastErr error
+
+	for _, param := range r.rig.Caps.GetParameters {
+		field := "parameter." + param.Name
+		if !r.canPoll(field) {
+			continue
+		}
+		pValue, err := r.rig.GetParm(vfo, hl.ParmValue[param.Name])
+		if err := r.fieldResult(field, err); err != nil {
+			lastErr = err
+			continue
+		}
+		r.state.Vfo.Parameters[param.Name] = pValue
+	}
+
+	return lastErr
 }
 
-func (r *localRadio) sendState() error {
+// sendFullState publishes the complete state on the CatResponseTopic
+func (r *localRadio) sendFullState() error {
 
 	if state, err := r.state.Marshal(); err == nil {
 		stateMsg := comms.IOMsg{}
@@ -377,68 +616,67 @@ func (r *localRadio) sendCaps() error {
 
 func (r *localRadio) updateMeter() error {
 
+	if len(r.offlinePttUser) > 0 {
+		if err := r.releaseOfflinePtt(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.checkHaPttTimeout(); err != nil {
+		return err
+	}
+
 	// Only update the meter when we can be sure that the radio is
 	// actually turned on. If the rig does not provide the powerstat
 	// we quit to avoid sending messages to the radio which will be
-	// continously rejected
+	// continously rejected. While transmitting the radio is obviously
+	// turned on, so that the SWR / ALC protection keeps working.
 
-	if !r.rig.Caps.HasGetPowerStat || !r.rig.Caps.HasSetPowerStat {
-		return nil
-	}
+	if !r.state.Ptt {
+		if !r.rig.Caps.HasGetPowerStat || !r.rig.Caps.HasSetPowerStat {
+			return nil
+		}
 
-	if !r.state.RadioOn {
-		return nil
+		if !r.state.RadioOn {
+			return nil
+		}
 	}
 
 	vfo := hl.VfoValue[r.state.CurrentVfo]
-	newValueAvailable := false
 
+	meters := meter.RxMeters
 	if r.rig.Caps.HasGetPtt && r.state.Ptt {
+		meters = meter.TxMeters
+	}
 
-		if swrCurrValue, ok := r.state.Vfo.Levels["SWR"]; ok {
-			swrNewValue, err := r.rig.GetLevel(vfo, hl.RIG_LEVEL_SWR)
-			if err != nil {
-				return err
-			}
-			if swrNewValue != swrCurrValue {
-				r.state.Vfo.Levels["SWR"] = swrNewValue
-				newValueAvailable = true
-			}
-		}
+	reading := meter.Reading{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Tx:        r.state.Ptt,
+		Values:    make(map[string]float32),
+	}
 
-		if alcCurrValue, ok := r.state.Vfo.Levels["ALC"]; ok {
-			alcNewValue, err := r.rig.GetLevel(vfo, hl.RIG_LEVEL_ALC)
-			if err != nil {
-				return err
-			}
-			if alcNewValue != alcCurrValue {
-				r.state.Vfo.Levels["ALC"] = alcNewValue
-				newValueAvailable = true
-			}
+	// failing meters are recorded in the field health and skipped
+	for _, name := range meters {
+		level, ok := hl.LevelValue[name]
+		if !ok || !r.hasGetLevel(name) || !r.canPoll("level."+name) {
+			continue
 		}
-
-	} else {
-
-		if sCurrValue, ok := r.state.Vfo.Levels["STRENGTH"]; ok {
-			sNewValue, err := r.rig.GetLevel(vfo, hl.RIG_LEVEL_STRENGTH)
-			if err != nil {
-				return err
-			}
-			if sNewValue != sCurrValue {
-				r.state.Vfo.Levels["STRENGTH"] = sNewValue
-				newValueAvailable = true
-			}
+		value, err := r.rig.GetLevel(vfo, level)
+		if r.fieldResult("level."+name, err) != nil {
+			continue
 		}
+		reading.Values[name] = value
 	}
 
-	if newValueAvailable {
-		err := r.sendState()
-		if err != nil {
+	r.meters = reading.Values
+
+	if reading.Tx {
+		if err := r.checkProtection(); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return r.sendMeters(reading)
 }
 
 func (r *localRadio) sendClearState() error {
@@ -451,5 +689,10 @@ func (r *localRadio) sendClearState() error {
 
 	r.settings.ToWireCh <- msg
 
+	if len(r.settings.RigStatusTopic) > 0 {
+		msg.Topic = r.settings.RigStatusTopic
+		r.settings.ToWireCh <- msg
+	}
+
 	return nil
 }
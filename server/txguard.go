@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dh1tw/gorigctl/ping"
+	sbRadio "github.com/dh1tw/gorigctl/sb_radio"
+)
+
+// txFrequencyMode returns the frequency and mode on which the radio
+// will transmit, taking split operation into account
+func (r *localRadio) txFrequencyMode() (float64, string) {
+
+	split := r.state.Vfo.Split
+	if split != nil && split.Enabled && split.Frequency > 0 {
+		mode := split.Mode
+		if len(mode) == 0 {
+			mode = r.state.Vfo.Mode
+		}
+		return split.Frequency, mode
+	}
+
+	return r.state.Vfo.Frequency, r.state.Vfo.Mode
+}
+
+// checkTx verifies against the band plan that the user is permitted to
+// transmit on the given frequency and mode.
+func (r *localRadio) checkTx(userID string, freq float64, mode string) error {
+
+	if r.settings.TxGuard == nil {
+		return nil
+	}
+
+	return r.settings.TxGuard.CheckTx(userID, freq, mode)
+}
+
+// checkPtt verifies that the transmitter is not locked and that the user
+// is permitted to key the transmitter on the current tx frequency and mode.
+// Releasing the PTT is always allowed.
+func (r *localRadio) checkPtt(userID string, ptt bool) error {
+
+	if !ptt {
+		return nil
+	}
+
+	if r.txLockout {
+		return fmt.Errorf("transmitter locked after alarm (%s); acknowledge the alarm first", r.lockoutReason)
+	}
+
+	if err := r.checkLatency(userID); err != nil {
+		return err
+	}
+
+	txFreq, txMode := r.txFrequencyMode()
+
+	return r.checkTx(userID, txFreq, txMode)
+}
+
+// checkLatency verifies that the packet loss and the round trip time
+// (95th percentile) of the user's link over the last seconds do not
+// exceed the limits. Clients which have never answered the server's
+// pings (e.g. older versions) can't be judged and are permitted; a
+// client which stopped answering is refused.
+func (r *localRadio) checkLatency(userID string) error {
+
+	maxLatency := r.settings.PttMaxLatency
+	maxLoss := r.settings.PttMaxLoss
+
+	if maxLatency <= 0 && maxLoss <= 0 {
+		return nil
+	}
+
+	r.latencyMu.Lock()
+	stats, ok := r.clientLatency[userID]
+	r.latencyMu.Unlock()
+
+	if !ok || !stats.Answered || stats.Sent < ping.MinSamples {
+		return nil
+	}
+
+	if stats.Received == 0 {
+		return fmt.Errorf("no reply from %s to the last %d pings", userID, stats.Lost)
+	}
+
+	if maxLoss > 0 && stats.Loss > maxLoss {
+		return fmt.Errorf("packet loss of %s (%.0f%%) exceeds %.0f%%", userID,
+			stats.Loss*100, maxLoss*100)
+	}
+
+	if maxLatency > 0 && stats.P95 > maxLatency {
+		return fmt.Errorf("round trip time of %s (%v) exceeds %v", userID,
+			stats.P95.Round(time.Millisecond), maxLatency)
+	}
+
+	return nil
+}
+
+// checkQsyWhileTx verifies that a frequency or mode change of the current
+// vfo does not move an active transmission outside of the band plan.
+func (r *localRadio) checkQsyWhileTx(userID string, freq float64, mode string) error {
+
+	if !r.state.Ptt {
+		return nil
+	}
+
+	// in split operation the current vfo is not used for transmitting
+	split := r.state.Vfo.Split
+	if split != nil && split.Enabled && split.Frequency > 0 {
+		return nil
+	}
+
+	return r.checkTx(userID, freq, mode)
+}
+
+// checkSplitWhileTx verifies that a change of the split settings does not
+// move an active transmission outside of the band plan.
+func (r *localRadio) checkSplitWhileTx(userID string, newSplit *sbRadio.Split) error {
+
+	if !r.state.Ptt || newSplit == nil {
+		return nil
+	}
+
+	if !newSplit.Enabled || newSplit.Frequency <= 0 {
+		return r.checkTx(userID, r.state.Vfo.Frequency, r.state.Vfo.Mode)
+	}
+
+	mode := newSplit.Mode
+	if len(mode) == 0 {
+		mode = r.state.Vfo.Mode
+	}
+
+	return r.checkTx(userID, newSplit.Frequency, mode)
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dh1tw/gorigctl/rigstatus"
+)
+
+// DefaultRigTimeout is used if no RigTimeout has been specified
+const DefaultRigTimeout = time.Second * 2
+
+// Priorities of the jobs executed by the rig worker. Jobs with a
+// higher priority are executed first.
+const (
+	priorityHigh   = iota // PTT, power, shutdown
+	priorityVfo           // frequency, mode, split, ...
+	priorityNormal        // levels, functions, parameters, ...
+	numPriorities
+)
+
+// rigJob is a unit of work which accesses the radio. Jobs are executed
+// one after the other by the rig worker. A job which couldn't be started
+// before its deadline is discarded, since the request is most likely
+// outdated by then. Safety jobs (releasing the PTT) have no deadline and
+// are kept while the radio isn't responding.
+type rigJob struct {
+	name     string
+	priority int
+	key      string // queued jobs with the same key are coalesced
+	deadline time.Time
+	safety   bool
+	fn       func()
+	done     chan struct{}
+}
+
+// rigWorker executes all calls to the radio (and the polling scheduler)
+// in its own goroutine, so that a radio which doesn't respond doesn't
+// block the server.
+//
+// The timeout can't cancel a call which hangs: hamlib is called through
+// cgo, and a C function can't be interrupted from Go. The call only
+// returns once hamlib's own timeout and retries (per backend, typically
+// a few seconds) have expired. Until then the rig is reported as not
+// responding and all jobs except the safety jobs are rejected; those
+// are executed as soon as the call has returned.
+type rigWorker struct {
+	sync.Mutex
+	queue   *jobQueue
+	timeout time.Duration
+	job     string    // name of the job which is currently executed
+	started time.Time // start time of the current job
+	stuck   bool      // only accessed by the server loop
+}
+
+func newRigWorker(timeout time.Duration) rigWorker {
+
+	if timeout <= 0 {
+		timeout = DefaultRigTimeout
+	}
+
+	return rigWorker{
+		queue:   newJobQueue(100),
+		timeout: timeout,
+	}
+}
+
+// current returns the name and the start time of the job which is
+// currently executed. The name is empty if the worker is idle.
+func (w *rigWorker) current() (string, time.Time) {
+	w.Lock()
+	defer w.Unlock()
+	return w.job, w.started
+}
+
+func (w *rigWorker) setCurrent(name string) {
+	w.Lock()
+	defer w.Unlock()
+	w.job = name
+	w.started = time.Now()
+}
+
+// runWorker executes the queued jobs and polls the radio until the
+// job queue is closed. The radio is only polled while no jobs are
+// pending.
+func (r *localRadio) runWorker() {
+	for {
+		job, closed := r.worker.queue.pop()
+		if job != nil {
+			r.execute(job)
+			continue
+		}
+		if closed {
+			return
+		}
+
+		select {
+		case <-r.worker.queue.notify:
+
+		case <-r.scheduler.timer.C:
+			r.execute(&rigJob{name: "poll", fn: r.poll})
+		}
+	}
+}
+
+func (r *localRadio) execute(job *rigJob) {
+
+	if job.done != nil {
+		defer close(job.done)
+	}
+
+	if !job.deadline.IsZero() && time.Now().After(job.deadline) {
+		r.radioLogger.Printf("rig not responding; discarded %s\n", job.name)
+		return
+	}
+
+	r.worker.setCurrent(job.name)
+	job.fn()
+	r.worker.setCurrent("")
+}
+
+// submit queues a job for the rig worker. A pending job with the same
+// (non empty) key is replaced. If the radio is not responding or the
+// queue is full, the job is rejected and nil is returned.
+func (r *localRadio) submit(name string, priority int, key string, fn func()) *rigJob {
+
+	if r.worker.stuck {
+		r.radioLogger.Printf("rig not responding; ignoring %s\n", name)
+		return nil
+	}
+
+	job := &rigJob{
+		name:     name,
+		priority: priority,
+		key:      key,
+		deadline: time.Now().Add(r.worker.timeout),
+		fn:       fn,
+		done:     make(chan struct{}),
+	}
+
+	if !r.worker.queue.push(job) {
+		r.radioLogger.Printf("rig command queue full; ignoring %s\n", name)
+		return nil
+	}
+
+	return job
+}
+
+// submitSafety queues a job which releases the transmitter. Unlike
+// submit, the job is accepted while the radio is not responding and it
+// is never discarded, since releasing the PTT late is still better than
+// not releasing it at all.
+func (r *localRadio) submitSafety(name string, fn func()) *rigJob {
+
+	job := &rigJob{
+		name:     name,
+		priority: priorityHigh,
+		safety:   true,
+		fn:       fn,
+		done:     make(chan struct{}),
+	}
+
+	if r.worker.stuck {
+		r.radioLogger.Printf("rig not responding; %s queued\n", name)
+	}
+
+	if !r.worker.queue.push(job) {
+		r.radioLogger.Printf("rig command queue full; ignoring %s\n", name)
+		return nil
+	}
+
+	return job
+}
+
+// checkWorker reports if the current job of the rig worker exceeds the
+// timeout and when the radio responds again.
+func (r *localRadio) checkWorker() {
+
+	name, started := r.worker.current()
+	stuck := name != "" && time.Since(started) > r.worker.timeout
+
+	switch {
+	case stuck && !r.worker.stuck:
+		r.radioLogger.Printf("rig not responding (%s pending for %v)\n",
+			name, time.Since(started).Truncate(time.Millisecond))
+		r.worker.queue.flush()
+		r.replaceRigStatus(rigstatus.Connected, rigstatus.NotResponding)
+
+	case !stuck && r.worker.stuck:
+		r.radioLogger.Println("rig responding again")
+		r.replaceRigStatus(rigstatus.NotResponding, rigstatus.Connected)
+		r.worker.stuck = false
+		// the state might have changed in the meantime
+		r.submit("sync", priorityNormal, "sync", r.boostPolling)
+	}
+
+	r.worker.stuck = stuck
+}
+
+// waitJob waits until the job has been executed or the timeout expired.
+// It returns false on timeout.
+func waitJob(job *rigJob, timeout time.Duration) bool {
+
+	if job == nil {
+		return false
+	}
+
+	select {
+	case <-job.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
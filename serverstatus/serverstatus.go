@@ -0,0 +1,69 @@
+package serverstatus
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dh1tw/gorigctl/ping"
+	"github.com/dh1tw/gorigctl/presence"
+)
+
+// Status is published (retained) by a radio server on
+// <station>/radios/<radio>/cat/serverstatus. It is republished
+// periodically as a heartbeat. Whether the server is online is
+// published on <station>/radios/<radio>/cat/status in the Status
+// message of the ICD, which is registered as the server's MQTT last
+// will; only that topic is cleared if the server crashes.
+type Status struct {
+	Online    bool                  `json:"online"`
+	Version   string                `json:"version,omitempty"`
+	Timestamp int64                 `json:"timestamp,omitempty"` // [ms] when the status was published
+	Started   int64                 `json:"started,omitempty"`   // [ms] when the server was started
+	Uptime    int64                 `json:"uptime,omitempty"`    // [s]
+	Operators []presence.Presence   `json:"operators,omitempty"` // clients connected to the radio
+	Latency   map[string]ping.Stats `json:"latency,omitempty"`   // links of the operators, measured by the server
+	Rig       *Rig                  `json:"rig,omitempty"`
+}
+
+// Rig describes the health of the radio served by the server, so that
+// "broker up but rig dead" can be told apart from "all good". The
+// version of the hamlib library is not included, since goHamlib
+// doesn't provide it (hamlib_version is not wrapped).
+type Rig struct {
+	Model         int    `json:"model"` // hamlib rig model
+	Manufacturer  string `json:"manufacturer,omitempty"`
+	Name          string `json:"name,omitempty"`
+	DriverVersion string `json:"driver_version,omitempty"` // of the rig's hamlib backend (caps), not of hamlib
+	Port          string `json:"port,omitempty"`
+	State         string `json:"state"`               // see rigstatus
+	LastPoll      int64  `json:"last_poll,omitempty"` // [ms] last successful poll of the rig
+	Commands      uint64 `json:"commands"`            // requests of the clients
+	CommandErrors uint64 `json:"command_errors"`      // failed or denied requests
+	PollErrors    uint64 `json:"poll_errors"`
+}
+
+// Topic returns the topic of the status of the radio server with the
+// given base topic (<station>/radios/<radio>/cat)
+func Topic(baseTopic string) string {
+	return baseTopic + "/serverstatus"
+}
+
+// LastPollTime returns the time of the last successful poll of the rig
+func (r *Rig) LastPollTime() time.Time {
+	return time.Unix(0, r.LastPoll*int64(time.Millisecond))
+}
+
+// Marshal encodes the status message for the wire
+func (s *Status) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// Unmarshal decodes a status message received from the wire
+func (s *Status) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, s)
+}
+
+// Time returns the time when the status was published
+func (s *Status) Time() time.Time {
+	return time.Unix(0, s.Timestamp*int64(time.Millisecond))
+}
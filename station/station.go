@@ -0,0 +1,50 @@
+package station
+
+import "encoding/json"
+
+// Status is published (retained) by a server which manages several
+// radios. It lists the radios of the station and whether their worker
+// processes are running. The offline variant is registered as the
+// server's MQTT last will.
+type Status struct {
+	Online bool    `json:"online"`
+	Radios []Radio `json:"radios"`
+}
+
+// Radio describes a radio managed by the server
+type Radio struct {
+	Name     string `json:"name"`
+	RigModel int    `json:"rig_model"`
+	Running  bool   `json:"running"`
+}
+
+// RadioOnline returns false if the radio is served by this station's
+// server and the server is offline or the radio's worker process isn't
+// running. The radios share the server's MQTT connection and therefore
+// its last will; after a crash of the server the retained status of
+// each radio still reports that the radio is online.
+func (s *Status) RadioOnline(radio string) bool {
+
+	for _, r := range s.Radios {
+		if r.Name == radio {
+			return s.Online && r.Running
+		}
+	}
+
+	return true
+}
+
+// Topic returns the status topic of a station
+func Topic(station string) string {
+	return station + "/radios/status"
+}
+
+// Marshal encodes the status message for the wire
+func (s *Status) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// Unmarshal decodes a status message received from the wire
+func (s *Status) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, s)
+}